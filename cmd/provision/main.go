@@ -1,35 +1,61 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/nais/onprem/nitro/pkg/analyze"
+	"github.com/nais/onprem/nitro/pkg/cert"
 	"github.com/nais/onprem/nitro/pkg/generate"
+	"github.com/nais/onprem/nitro/pkg/kubernetes"
 	"github.com/nais/onprem/nitro/pkg/ssh"
+	"github.com/nais/onprem/nitro/pkg/templating"
+	"github.com/nais/onprem/nitro/pkg/transpile"
 	"github.com/nais/onprem/nitro/pkg/utils"
 	"github.com/nais/onprem/nitro/pkg/vars"
 	log "github.com/sirupsen/logrus"
+	"github.com/sourcegraph/conc/pool"
 	flag "github.com/spf13/pflag"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/azure"
 )
 
 var cfg struct {
-	cluster        string
-	identityFile   string
-	user           string
-	hosts          []string
-	skipDrain      bool
-	maxParallelism int
-	newCluster     bool
+	cluster          string
+	identityFile     string
+	user             string
+	hosts            []string
+	host             string
+	skipDrain        bool
+	maxParallelism   int
+	checkParallelism int
+	newCluster       bool
+	from             string
+	to               string
+	knownHosts       string
+	knownHostsTofu   string
+	rebootTimeout    time.Duration
+	plan             bool
+	resume           bool
+	emptyDirPolicy   string
+	drainTimeout     time.Duration
+	forceDrain       bool
+	batchSize        string
+	stagger          time.Duration
+	gateTimeout      time.Duration
+	gateSettle       time.Duration
+	ipFamily         string
+	dnsServer        string
+	jumphostDNS      string
+	format           string
+	failOnDrift      bool
 }
 
 func getSupportedCommands() []string {
-	return []string{"generate", "provision", "analyze"}
+	return []string{"generate", "provision", "analyze", "migrate-apiserver", "sync-labels", "vars", "drift"}
 }
 
 func init() {
@@ -39,110 +65,365 @@ func init() {
 	flag.StringVar(&cfg.user, "user", "deployer", "user to use for ssh")
 	flag.BoolVar(&cfg.skipDrain, "skipDrain", false, "run without setting NoExecute taint and NoSchedule on nodes")
 	flag.IntVar(&cfg.maxParallelism, "maxParallelism", 2, "max number of parallel nodes for provisioning")
+	flag.IntVar(&cfg.checkParallelism, "checkParallelism", 10, "max number of nodes checked for changes at a time, and analyzed by analyze and drift")
+	flag.StringVar(&cfg.emptyDirPolicy, "emptyDirPolicy", string(kubernetes.EmptyDirDelete), "what a drain does with pods with emptyDir volumes: delete, skip (leave until reboot) or fail")
+	flag.DurationVar(&cfg.drainTimeout, "drainTimeout", 5*time.Minute, "max time to wait for evictions blocked by PodDisruptionBudgets and for evicted pods to terminate")
+	flag.BoolVar(&cfg.forceDrain, "forceDrain", false, "delete pods still blocked by a PodDisruptionBudget after --drainTimeout instead of failing")
+	flag.StringVar(&cfg.batchSize, "batchSize", "", "workers per rollout batch, as a number or a percentage of the workers, e.g. 25% (default --maxParallelism)")
+	flag.DurationVar(&cfg.stagger, "stagger", 7*time.Second, "delay between starting the workers in a batch")
+	flag.DurationVar(&cfg.gateTimeout, "gateTimeout", 10*time.Minute, "max time for a batch of workers to become Ready with their daemonset pods running")
+	flag.DurationVar(&cfg.gateSettle, "gateSettle", 2*time.Minute, "how long workloads are watched for new crash loops after a batch of workers is up")
 	flag.BoolVar(&cfg.newCluster, "newCluster", false, "first time setup of cluster")
+	flag.DurationVar(&cfg.rebootTimeout, "rebootTimeout", 10*time.Minute, "max time for a node to come back from reboot with config applied and services active")
+	flag.BoolVar(&cfg.plan, "plan", false, "show what provision would do without changing any node (provision)")
+	flag.BoolVar(&cfg.resume, "resume", false, "continue the last unfinished provision run from where each node got to (provision)")
+	flag.StringVar(&cfg.from, "from", "", "current apiserver host (migrate-apiserver)")
+	flag.StringVar(&cfg.to, "to", "", "new apiserver host (migrate-apiserver)")
+	flag.StringVar(&cfg.host, "host", "", "node to print the vars of; the cluster vars without it (vars)")
+	flag.StringVar(&cfg.knownHosts, "known-hosts", "", "known_hosts file to verify host keys against")
+	flag.StringVar(&cfg.ipFamily, "ip-family", string(vars.IPv4), "address family to prefer when resolving hosts: ipv4 or ipv6")
+	flag.StringVar(&cfg.dnsServer, "dns-server", "", "DNS server to resolve hosts with instead of the system resolver, as host:port")
+	flag.StringVar(&cfg.jumphostDNS, "jumphost-dns", "", "ssh host to resolve hosts on with dig, for names only its DNS knows")
+	flag.StringVar(&cfg.format, "format", string(analyze.Markdown), "output format of analyze and drift: markdown, json or github")
+	flag.BoolVar(&cfg.failOnDrift, "fail-on-drift", false, "exit with code 11 if any node differs from the generated config (analyze, drift)")
+	flag.StringVar(&cfg.knownHostsTofu, "known-hosts-tofu", "", "known_hosts store in the cluster repo; copied to --known-hosts, and unknown hosts are trusted on first use and added to it")
 }
 
+// Exit codes, distinct per failure class so CI can tell them apart.
+const (
+	exitFailure       = 1
+	exitUsage         = 2
+	exitInvalidConfig = 3
+	exitTemplate      = 4
+	exitCertificate   = 5
+	exitUnreachable   = 6
+	exitEtcdUnhealthy = 7
+	exitKubernetes    = 8
+	exitRebootFailed  = 9
+	exitRolloutHalted = 10
+	exitDrift         = 11
+	exitCommandFailed = 12
+)
+
 func main() {
 	flag.Parse()
 	if len(cfg.cluster) == 0 {
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 
 	command := os.Args[1]
 	if !utils.Contains(command, getSupportedCommands()) {
-		log.Fatalf("argument must be one of: %s", getSupportedCommands())
-		os.Exit(1)
+		log.Errorf("argument must be one of: %s", getSupportedCommands())
+		os.Exit(exitUsage)
 	}
 
 	setupLogging()
 
 	log.Infof("nais ignition template resolver [operation: %s, cluster: %s]", command, cfg.cluster)
 
-	sshClient := ssh.New(cfg.user, cfg.identityFile)
+	if err := run(command); err != nil {
+		log.WithError(err).Errorf("%s failed", command)
+		os.Exit(exitCode(err))
+	}
+}
 
-	if command == "generate" {
-		generate.ClusterIgnitionFiles(sshClient, cfg.cluster, cfg.hosts)
+func run(command string) error {
+	clusterDef, err := vars.ParseCluster("clusters/" + cfg.cluster + ".yaml")
+	if err != nil {
+		return err
 	}
+	family, err := vars.ParseFamily(cfg.ipFamily)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	resolver := vars.NewResolver(vars.ResolverConfig{
+		Family:    family,
+		DNSServer: cfg.dnsServer,
+		JumpHost:  cfg.jumphostDNS,
+	}, clusterDef)
+
+	sshClient, err := ssh.New(cfg.user, cfg.identityFile, ssh.HostKeys{
+		KnownHostsFile: cfg.knownHosts,
+		TofuStore:      cfg.knownHostsTofu,
+	}, resolver)
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+
+	switch command {
+	case "generate":
+		return generate.ClusterIgnitionFiles(sshClient, cfg.cluster, cfg.hosts)
 
-	if command == "analyze" {
-		clusterFile := vars.ParseSliceYAML("clusters/" + cfg.cluster + ".yaml")
-		roleHosts := calculateHosts(clusterFile, sshClient, "output")
-		changes := []string{fmt.Sprintf("## %s\n", cfg.cluster)}
-		for role, hosts := range roleHosts {
-			for _, host := range hosts {
-				diff := analyze.Analyze(sshClient, host)
-				changes = append(changes, fmt.Sprintf("### %s - %s\n%s\n", role, host, diff))
+	case "sync-labels":
+		return generate.SyncLabels(cfg.cluster, cfg.hosts)
+
+	case "vars":
+		layers, err := generate.NodeVars(sshClient, cfg.cluster, cfg.host)
+		if err != nil {
+			return err
+		}
+		out, err := vars.Annotate(vars.Flatten(layers))
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(out))
+		return nil
+
+	case "analyze":
+		format, err := analyze.ParseFormat(cfg.format)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errUsage, err)
+		}
+		// nodes that could not be checked for changes are analyzed, and
+		// reported with their error if that fails too
+		roleHosts, err := calculateHosts(clusterDef, sshClient, "output")
+		if err != nil {
+			log.WithError(err).Warn("analyzing nodes that could not be checked for changes as changed")
+		}
+		analysis := analyze.CheckHosts(cfg.cluster, roleHosts, cfg.checkParallelism, func(host string) (*analyze.Report, error) {
+			return analyze.Analyze(sshClient, host)
+		})
+		return writeAnalysis("analysis", analysis, format)
+
+	case "drift":
+		format, err := analyze.ParseFormat(cfg.format)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errUsage, err)
+		}
+		roleHosts := clusterDef.Active(clusterDef.Hosts())
+		if cfg.hosts != nil {
+			roleHosts = clusterDef.Active(utils.FilterHosts(clusterDef.Hosts(), cfg.hosts))
+		}
+		analysis := analyze.CheckHosts(cfg.cluster, roleHosts, cfg.checkParallelism, func(host string) (*analyze.Report, error) {
+			return analyze.Drift(sshClient, host)
+		})
+		return writeAnalysis("drift", analysis, format)
+
+	case "provision":
+		hosts, err := calculateHosts(clusterDef, sshClient, "output")
+		if err != nil {
+			return err
+		}
+		if hosts == nil && !cfg.resume {
+			log.Infof("no hosts to provision. exiting")
+			return nil
+		}
+
+		opts, err := provisionOptions()
+		if err != nil {
+			return err
+		}
+
+		if cfg.plan {
+			plan, err := generate.Plan(sshClient, cfg.cluster, hosts, opts)
+			if err != nil {
+				return err
 			}
+			out := plan.Markdown()
+			if err := os.WriteFile("output/plan.out", []byte(out), 0o644); err != nil {
+				return fmt.Errorf("write plan.out: %w", err)
+			}
+			fmt.Print(out)
+			return nil
 		}
-		diffBytes := []byte(strings.Join(changes, ""))
-		err := os.WriteFile("output/analysis.out", diffBytes, 0o644)
+
+		return generate.Provision(sshClient, cfg.cluster, hosts, opts)
+
+	case "migrate-apiserver":
+		if cfg.from == "" || cfg.to == "" || cfg.from == cfg.to {
+			return fmt.Errorf("%w: migrate-apiserver requires distinct --from and --to hosts", errUsage)
+		}
+		opts, err := provisionOptions()
 		if err != nil {
-			log.WithError(err).Fatal("write analysis.out")
+			return err
 		}
-	}
+		opts.NewCluster = false
 
-	if command == "provision" {
-		clusterFile := vars.ParseSliceYAML("clusters/" + cfg.cluster + ".yaml")
-		hosts := calculateHosts(clusterFile, sshClient, "output")
+		if err := generate.MigrateApiserver(sshClient, cfg.cluster, cfg.from, cfg.to); err != nil {
+			return err
+		}
+
+		// the migration changed the cluster file
+		clusterDef, err = vars.ParseCluster("clusters/" + cfg.cluster + ".yaml")
+		if err != nil {
+			return err
+		}
+		hosts, err := calculateHosts(clusterDef, sshClient, "output")
+		if err != nil {
+			return err
+		}
 		if hosts == nil {
 			log.Infof("no hosts to provision. exiting")
-			os.Exit(0)
+			return nil
+		}
+
+		return generate.Provision(sshClient, cfg.cluster, hosts, opts)
+	}
+
+	return nil
+}
+
+func provisionOptions() (generate.ProvisionOptions, error) {
+	emptyDir, err := kubernetes.ParseEmptyDirPolicy(cfg.emptyDirPolicy)
+	if err != nil {
+		return generate.ProvisionOptions{}, fmt.Errorf("%w: %w", errUsage, err)
+	}
+	rollout := generate.RolloutOptions{
+		BatchSize:   cfg.maxParallelism,
+		Stagger:     cfg.stagger,
+		GateTimeout: cfg.gateTimeout,
+		Settle:      cfg.gateSettle,
+	}
+	if cfg.batchSize != "" {
+		rollout.BatchSize, rollout.BatchPercent, err = generate.ParseBatchSize(cfg.batchSize)
+		if err != nil {
+			return generate.ProvisionOptions{}, fmt.Errorf("%w: %w", errUsage, err)
 		}
+	}
+	return generate.ProvisionOptions{
+		SkipDrain:     cfg.skipDrain,
+		NewCluster:    cfg.newCluster,
+		Rollout:       rollout,
+		RebootTimeout: cfg.rebootTimeout,
+		Drain: kubernetes.DrainOptions{
+			EmptyDir: emptyDir,
+			Timeout:  cfg.drainTimeout,
+			Force:    cfg.forceDrain,
+		},
+		Resume: cfg.resume,
+	}, nil
+}
+
+// analysisExtensions are the extensions of the files analyze and drift
+// write to, by format.
+var analysisExtensions = map[analyze.Format]string{
+	analyze.Markdown: "out",
+	analyze.JSON:     "json",
+	analyze.GitHub:   "md",
+}
 
-		generate.Provision(sshClient, cfg.cluster, hosts, cfg.skipDrain, cfg.newCluster, cfg.maxParallelism)
+// writeAnalysis writes the analysis to output/<name>.<ext>. It then fails
+// with the errors of the nodes that could not be checked, and with errDrift
+// if any node differs and --fail-on-drift is set.
+func writeAnalysis(name string, analysis *analyze.Analysis, format analyze.Format) error {
+	out, err := analysis.Render(format)
+	if err != nil {
+		return err
+	}
+	file := fmt.Sprintf("output/%s.%s", name, analysisExtensions[format])
+	if err := os.WriteFile(file, out, 0o644); err != nil {
+		return fmt.Errorf("write %s: %w", file, err)
+	}
+	log.Infof("%s written to %s", name, file)
+	errs := []error{analysis.Err()}
+	if drifted := analysis.Drifted(); cfg.failOnDrift && len(drifted) > 0 {
+		errs = append(errs, fmt.Errorf("%w: %s", errDrift, strings.Join(drifted, ", ")))
+	}
+	return errors.Join(errs...)
+}
+
+var (
+	errUsage = errors.New("invalid usage")
+	errDrift = errors.New("nodes differ from the generated config")
+)
+
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.Is(err, vars.ErrInvalidConfig):
+		return exitInvalidConfig
+	case errors.Is(err, templating.ErrTemplate), errors.Is(err, templating.ErrUnresolvedVariable), errors.Is(err, templating.ErrCollision), errors.Is(err, transpile.ErrTranspile):
+		return exitTemplate
+	case errors.Is(err, cert.ErrCertificate):
+		return exitCertificate
+	case errors.Is(err, ssh.ErrHostUnreachable), errors.Is(err, ssh.ErrHostKeyMismatch), errors.Is(err, vars.ErrUnresolvedHost):
+		return exitUnreachable
+	case errors.Is(err, generate.ErrEtcdUnhealthy):
+		return exitEtcdUnhealthy
+	case errors.Is(err, generate.ErrRebootFailed):
+		return exitRebootFailed
+	case errors.Is(err, kubernetes.ErrTimeout), errors.Is(err, kubernetes.ErrDrainBlocked):
+		return exitKubernetes
+	case errors.Is(err, generate.ErrRolloutHalted):
+		return exitRolloutHalted
+	case errors.Is(err, errDrift):
+		return exitDrift
+	case errors.Is(err, ssh.ErrCommandFailed):
+		return exitCommandFailed
 	}
+	return exitFailure
 }
 
-func calculateHosts(clusterFile map[string][]string, sshClient *ssh.Client, outputDir string) map[string][]string {
+// calculateHosts returns the hosts given with --hosts, or else the hosts whose
+// generated config differs from the one on the node. Nodes in maintenance are
+// left out. Nodes are checked concurrently, --checkParallelism at a time. A
+// node that could not be checked, such as an unreachable one, is returned
+// with its error, so provision stops and analyze reports it with the error.
+func calculateHosts(clusterDef *vars.Cluster, sshClient *ssh.Client, outputDir string) (map[string][]string, error) {
 	log.Infof("checking which nodes has changes...")
 	if cfg.hosts != nil {
-		return utils.FilterHosts(clusterFile, cfg.hosts)
+		return clusterDef.Active(utils.FilterHosts(clusterDef.Hosts(), cfg.hosts)), nil
 	}
 
-	var nodes []string
-	for _, host := range utils.Hostnames(clusterFile) {
-		remoteSum := ""
-		localSum := sha256sum(outputDir + "/" + host + "/config.ign")
+	clusterFile := clusterDef.Active(clusterDef.Hosts())
+	for _, host := range utils.Hostnames(clusterDef.Hosts()) {
+		if node, _, _ := clusterDef.Node(host); node.Maintenance {
+			log.Infof("skipping %s, it is in maintenance", host)
+		}
+	}
 
-		ret, _ := sshClient.ExecuteCommandWithOutput(host, "sudo test -f /usr/share/oem/config.ign && echo -n 'true' || echo -n 'false'")
-		if ret == "true" {
-			current, err := sshClient.ExecuteCommandWithOutput(host, "sudo sha256sum /usr/share/oem/config.ign")
+	hosts := utils.Hostnames(clusterFile)
+	changed := make([]bool, len(hosts))
+	errs := make([]error, len(hosts))
+	p := pool.New().WithMaxGoroutines(max(cfg.checkParallelism, 1))
+	for i, host := range hosts {
+		p.Go(func() {
+			var err error
+			changed[i], err = configChanged(sshClient, outputDir, host)
 			if err != nil {
-				log.WithError(err).Fatalf("getting checksum of current ignition file for host %s@%s", sshClient.User(), host)
+				log.WithField("node", host).WithError(err).Warn("could not check for changes")
+				changed[i] = true
+				errs[i] = fmt.Errorf("node %s: %w", host, err)
 			}
-			remoteSum = strings.Split(current, " ")[0]
-		}
+		})
+	}
+	p.Wait()
 
-		if remoteSum != localSum {
+	var nodes []string
+	for i, host := range hosts {
+		if changed[i] {
 			nodes = append(nodes, host)
 		}
 	}
 	if len(nodes) == 0 {
-		return nil
+		return nil, nil
 	}
 
-	return utils.FilterHosts(clusterFile, nodes)
+	return utils.FilterHosts(clusterFile, nodes), errors.Join(errs...)
 }
 
-func sha256sum(path string) string {
-	f, err := os.Open(path)
+// checksummer returns the sha256 sum of a file on a host.
+type checksummer interface {
+	Sha256sum(host, path string) (string, error)
+}
+
+// configChanged returns whether the generated config of the host differs
+// from the one on it.
+func configChanged(sshClient checksummer, outputDir, host string) (bool, error) {
+	localSum, err := utils.Sha256sum(outputDir + "/" + host + "/config.ign")
 	if err != nil {
-		log.Fatal(err)
+		return false, err
 	}
-	defer func(f *os.File) {
-		err := f.Close()
-		if err != nil {
-			log.WithError(err).Fatal("sha256sum")
-		}
-	}(f)
 
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
-		log.Fatal(err)
+	remoteSum, err := sshClient.Sha256sum(host, "/usr/share/oem/config.ign")
+	if err != nil {
+		return false, err
 	}
 
-	return hex.EncodeToString(h.Sum(nil))
+	return remoteSum != localSum, nil
 }
 
 func setupLogging() {
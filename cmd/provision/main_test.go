@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nais/onprem/nitro/pkg/generate"
+	"github.com/nais/onprem/nitro/pkg/ssh"
+	"github.com/nais/onprem/nitro/pkg/vars"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestExitCode(t *testing.T) {
+	// as returned by ssh.Client.ExecuteCommand for a remote non-zero exit
+	commandFailed := fmt.Errorf("%w: deployer@node1: %w, output: ''", ssh.ErrCommandFailed, &gossh.ExitError{})
+
+	for want, err := range map[int]error{
+		exitFailure:       errors.New("other"),
+		exitUsage:         fmt.Errorf("%w: --from", errUsage),
+		exitInvalidConfig: fmt.Errorf("cluster: %w", vars.ErrInvalidConfig),
+		exitUnreachable:   fmt.Errorf("node node1: %w", ssh.ErrHostUnreachable),
+		exitEtcdUnhealthy: fmt.Errorf("%w: %w", generate.ErrEtcdUnhealthy, commandFailed),
+		exitRebootFailed:  fmt.Errorf("%w: node1: %w", generate.ErrRebootFailed, commandFailed),
+		exitDrift:         fmt.Errorf("%w: node1", errDrift),
+		exitCommandFailed: fmt.Errorf("installing pki on node1: %w", commandFailed),
+	} {
+		assert.Equal(t, want, exitCode(err), err.Error())
+	}
+}
+
+type fakeChecksummer map[string]string
+
+func (f fakeChecksummer) Sha256sum(host, _ string) (string, error) {
+	sum, ok := f[host]
+	if !ok {
+		return "", fmt.Errorf("%w: deployer@%s: dial tcp: i/o timeout", ssh.ErrHostUnreachable, host)
+	}
+	return sum, nil
+}
+
+func TestConfigChanged(t *testing.T) {
+	dir := t.TempDir()
+	for _, host := range []string{"node1", "node2", "node3"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, host), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, host, "config.ign"), []byte("config"), 0o644))
+	}
+	// sha256 of "config"
+	sums := fakeChecksummer{
+		"node1": "b79606fb3afea5bd1609ed40b622142f1c98125abcfe89a76a661b0e8e343910",
+		"node2": "other",
+	}
+
+	changed, err := configChanged(sums, dir, "node1")
+	require.NoError(t, err)
+	assert.False(t, changed)
+	changed, err = configChanged(sums, dir, "node2")
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	// an unreachable node is not taken as changed, its error is returned
+	_, err = configChanged(sums, dir, "node3")
+	assert.ErrorIs(t, err, ssh.ErrHostUnreachable)
+	assert.Equal(t, exitUnreachable, exitCode(err))
+}
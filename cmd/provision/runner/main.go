@@ -18,6 +18,8 @@ type cfg struct {
 	githubToken  string
 	user         string
 	identityFile string
+	knownHosts   string
+	jumphostDNS  string
 }
 
 func parseFlags() *cfg {
@@ -29,6 +31,8 @@ func parseFlags() *cfg {
 	flag.StringVar(&cfg.githubToken, "github-token", "", "provide github for provisioning github runners")
 	flag.StringVar(&cfg.user, "user", "deployer", "user to use for ssh")
 	flag.StringVar(&cfg.identityFile, "identity-file", "./id_deployer_rsa", "identity file for nodes")
+	flag.StringVar(&cfg.knownHosts, "known-hosts", "", "known_hosts file to verify host keys against")
+	flag.StringVar(&cfg.jumphostDNS, "jumphost-dns", "", "ssh host to resolve hosts on with dig, for names only its DNS knows")
 	flag.Parse()
 
 	required := []string{"node", "cluster", "repository", "github-token"}
@@ -51,14 +55,24 @@ func main() {
 		FullTimestamp: true,
 	})
 
-	sshClient := ssh.New(flags.user, flags.identityFile)
+	clusterDef, err := vars.ParseCluster("clusters/" + flags.cluster + ".yaml")
+	if err != nil {
+		log.WithError(err).Fatal("parsing cluster file")
+	}
 
-	nodesFile := vars.ParseSliceYAML("clusters/" + flags.cluster + ".yaml")
-	apiServer := nodesFile["apiserver"][0]
+	resolver := vars.NewResolver(vars.ResolverConfig{JumpHost: flags.jumphostDNS}, clusterDef)
+	sshClient, err := ssh.New(flags.user, flags.identityFile, ssh.HostKeys{KnownHostsFile: flags.knownHosts}, resolver)
+	if err != nil {
+		log.WithError(err).Fatal("new ssh client")
+	}
+	defer sshClient.Close()
+	apiServer := clusterDef.Apiserver[0].Hostname
 
-	generate.RunnerConfig(flags.node, flags.cluster, apiServer, sshClient, flags.githubToken, flags.repository)
+	if err := generate.RunnerConfig(flags.node, flags.cluster, apiServer, sshClient, flags.githubToken, flags.repository); err != nil {
+		log.WithError(err).Fatal("generate runner config")
+	}
 
-	err := provision(sshClient, flags.node)
+	err = provision(sshClient, flags.node)
 	if err != nil {
 		log.Errorf("provision failed: %s", err)
 		os.Exit(9)
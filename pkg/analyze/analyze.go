@@ -2,86 +2,140 @@ package analyze
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path"
-	"strings"
 
 	"github.com/flatcar/ignition/config/v2_3/types"
 	"github.com/nais/onprem/nitro/pkg/ssh"
 	"github.com/r3labs/diff/v2"
-	log "github.com/sirupsen/logrus"
 )
 
 const (
 	remoteIgnitionFile = "config.ign.remote.yaml"
 )
 
-func Analyze(sshClient *ssh.Client, host string) string {
-	localIgnitionFile := readFileBytes(fmt.Sprintf("output/%s/config.ign", host))
+// Analyze compares the generated config of the host with the one on it.
+func Analyze(sshClient *ssh.Client, host string) (*Report, error) {
+	localIgnitionFile, err := os.ReadFile(fmt.Sprintf("output/%s/config.ign", host))
+	if err != nil {
+		return nil, fmt.Errorf("reading local ignition file: %w", err)
+	}
 
-	sshClient.DownloadFile(host, path.Join("output", host, remoteIgnitionFile), "/usr/share/oem/config.ign")
+	// a config left from an earlier run must not pass for the live one
+	remotePath := path.Join("output", host, remoteIgnitionFile)
+	if err := os.Remove(remotePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := sshClient.FetchFile(host, remotePath, "/usr/share/oem/config.ign"); err != nil {
+		return nil, err
+	}
 
-	remoteIgnitionFile := readFileBytes(fmt.Sprintf("output/%s/%s", host, remoteIgnitionFile))
+	remoteIgnitionFile, err := os.ReadFile(remotePath)
+	if err != nil {
+		return nil, fmt.Errorf("reading remote ignition file: %w", err)
+	}
 
-	var localIgnitionConfig types.Config
-	err := json.Unmarshal(localIgnitionFile, &localIgnitionConfig)
+	return Diff(remoteIgnitionFile, localIgnitionFile)
+}
+
+// Diff returns the changes from the remote config to the local one. Configs
+// are compared as 3.x configs: files by path, units and users by name, with
+// the text of files and units diffed. A 2.x remote config is migrated to the
+// 3.x version of a local config first.
+func Diff(remote, local []byte) (*Report, error) {
+	localVersion, localSpec, err := specVersion(local)
 	if err != nil {
-		log.WithError(err).Fatal("unmarshal local ignition file")
+		return nil, fmt.Errorf("local ignition file: %w", err)
 	}
-	var remoteIgnitionConfig types.Config
-	err = json.Unmarshal(remoteIgnitionFile, &remoteIgnitionConfig)
+	remoteVersion, remoteSpec, err := specVersion(remote)
 	if err != nil {
-		log.WithError(err).Fatal("unmarshal remote ignition file")
+		return nil, fmt.Errorf("remote ignition file: %w", err)
 	}
 
-	differ, err := diff.NewDiffer(diff.TagName("json"))
+	report := &Report{}
+	switch {
+	case localVersion == 2 && remoteVersion == 2:
+		migratedRemote, remoteErr := migrateV2(remote, migrateSpec)
+		migratedLocal, localErr := migrateV2(local, migrateSpec)
+		if err := errors.Join(remoteErr, localErr); err != nil {
+			report.Note = fmt.Sprintf("Compared as is: %v.", err)
+			changelog, err := diffV2(remote, local)
+			if err != nil {
+				return nil, err
+			}
+			report.Changes = otherChanges(changelog)
+			return report, nil
+		}
+		remote, local = migratedRemote, migratedLocal
+	case localVersion == 3 && remoteVersion == 3:
+	case localVersion == 3 && remoteVersion == 2:
+		remote, err = migrateV2(remote, localSpec)
+		if err != nil {
+			return nil, fmt.Errorf("migrating remote ignition file: %w", err)
+		}
+		report.Note = fmt.Sprintf("Remote config is ignition %s, compared after migrating it to %s.", remoteSpec, localSpec)
+	default:
+		return nil, fmt.Errorf("%w: local config is ignition %s, remote is %s", ErrSpecVersion, localSpec, remoteSpec)
+	}
+
+	remoteConfig, err := parseConfig(remote)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal remote ignition file: %w", err)
+	}
+	localConfig, err := parseConfig(local)
 	if err != nil {
-		log.WithError(err).Fatal("new differ")
+		return nil, fmt.Errorf("unmarshal local ignition file: %w", err)
 	}
-	changelog, err := differ.Diff(remoteIgnitionConfig, localIgnitionConfig)
+	report.Changes, err = compare(remoteConfig, localConfig)
 	if err != nil {
-		return ""
+		return nil, err
 	}
-	stringBuilder := buildMarkdownTable(changelog)
-	return stringBuilder
+	return report, nil
 }
 
-func buildMarkdownTable(changelog diff.Changelog) string {
-	var stringBuilder strings.Builder
-	stringBuilder.WriteString("| Type | Path | Change |\n")
-	stringBuilder.WriteString("| :---: | :--- | :--- |\n")
-
-	for _, change := range changelog {
-		switch change.Type {
-		case diff.DELETE:
-			stringBuilder.WriteString(fmt.Sprintf("| %s | %s | %s |\n", change.Type, strings.Join(change.Path, "."), change.From))
-		case diff.CREATE:
-			stringBuilder.WriteString(fmt.Sprintf("| %s | %s | %s |\n", change.Type, strings.Join(change.Path, "."), change.To))
-		default:
-			stringBuilder.WriteString(fmt.Sprintf("| %s | %s | %s |\n| | | %s |\n", change.Type, strings.Join(change.Path, "."), change.From, change.To))
-		}
+func diffV2(remote, local []byte) (diff.Changelog, error) {
+	var localIgnitionConfig types.Config
+	err := json.Unmarshal(local, &localIgnitionConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal local ignition file: %w", err)
+	}
+	var remoteIgnitionConfig types.Config
+	err = json.Unmarshal(remote, &remoteIgnitionConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal remote ignition file: %w", err)
 	}
-	return stringBuilder.String()
-}
 
-func readFileBytes(filePath string) []byte {
-	file, err := os.Open(filePath)
+	differ, err := diff.NewDiffer(diff.TagName("json"))
 	if err != nil {
-		log.WithError(err).Fatal("open file")
+		return nil, fmt.Errorf("new differ: %w", err)
 	}
+	return differ.Diff(remoteIgnitionConfig, localIgnitionConfig)
+}
 
-	defer func(file *os.File) {
-		err := file.Close()
-		if err != nil {
-			log.WithError(err).Fatal("close file")
+// prune leaves out empty objects and lists, as they mean the same as no
+// value.
+func prune(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if value = prune(value); value == nil {
+				delete(v, key)
+			} else {
+				v[key] = value
+			}
+		}
+		if len(v) == 0 {
+			return nil
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = prune(value)
+		}
+		if len(v) == 0 {
+			return nil
 		}
-	}(file)
-
-	byteSlice, err := io.ReadAll(file)
-	if err != nil {
-		log.WithError(err).Fatal("read file")
 	}
-	return byteSlice
+	return v
 }
@@ -0,0 +1,131 @@
+package analyze
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const remoteV2 = `{
+  "ignition": {"version": "2.3.0"},
+  "networkd": {"units": [{"name": "00-eth0.network", "contents": "[Match]"}]},
+  "storage": {"files": [{"filesystem": "root", "path": "/etc/motd", "mode": 420, "contents": {"source": "data:,hei", "verification": {}}}]},
+  "systemd": {"units": [{"name": "kubelet.service", "enable": true, "contents": "[Unit]"}]}
+}`
+
+func TestDiffSameVersion(t *testing.T) {
+	report, err := Diff([]byte(remoteV2), []byte(remoteV2))
+	require.NoError(t, err)
+	assert.Empty(t, report.Changes)
+	assert.Equal(t, "no changes\n", report.Markdown())
+
+	v3 := `{"ignition": {"version": "3.3.0"}, "storage": {"files": [{"path": "/etc/motd", "contents": {"source": "data:,hei"}}]}}`
+	changed := `{"ignition": {"version": "3.3.0"}, "storage": {"files": [{"path": "/etc/motd", "contents": {"source": "data:,hallo"}}]}, "passwd": {}}`
+	report, err = Diff([]byte(v3), []byte(changed))
+	require.NoError(t, err)
+	require.Len(t, report.Changes, 1)
+	assert.Equal(t, Change{Kind: KindFile, Name: "/etc/motd", Type: Changed, Diff: `--- remote /etc/motd
++++ local /etc/motd
+@@ -1 +1 @@
+-hei
++hallo
+`}, report.Changes[0])
+}
+
+func TestDiffMigratesV2(t *testing.T) {
+	local := `{
+  "ignition": {"version": "3.3.0"},
+  "storage": {"files": [
+    {"path": "/etc/motd", "overwrite": true, "mode": 420, "contents": {"source": "data:,hei"}},
+    {"path": "/etc/systemd/network/00-eth0.network", "overwrite": true, "mode": 420, "contents": {"source": "data:,%5BMatch%5D"}}
+  ]},
+  "systemd": {"units": [{"name": "kubelet.service", "enabled": true, "contents": "[Unit]"}]}
+}`
+	report, err := Diff([]byte(remoteV2), []byte(local))
+	require.NoError(t, err)
+	assert.Equal(t, "Remote config is ignition 2.3.0, compared after migrating it to 3.3.0.", report.Note)
+	assert.Empty(t, report.Changes)
+
+	_, err = Diff([]byte(local), []byte(remoteV2))
+	assert.ErrorIs(t, err, ErrSpecVersion)
+	_, err = Diff([]byte(`{"ignition": {"version": "1.0.0"}}`), []byte(local))
+	assert.ErrorIs(t, err, ErrSpecVersion)
+
+	// a migration that is not valid 3.x fails instead of being compared
+	relative := `{"ignition": {"version": "2.3.0"}, "storage": {"files": [{"filesystem": "root", "path": "etc/motd"}]}}`
+	_, err = Diff([]byte(relative), []byte(local))
+	assert.ErrorContains(t, err, "migrated config: config is not valid:\nerror at $.storage.files.0.path, line 1 col 61: path not absolute\n")
+
+	// a 2.x file without contents is an empty file
+	empty := `{"ignition": {"version": "2.3.0"}, "storage": {"files": [{"filesystem": "root", "path": "/etc/empty"}]}}`
+	report, err = Diff([]byte(empty), []byte(`{"ignition": {"version": "3.3.0"}, "storage": {"files": [{"path": "/etc/empty", "overwrite": true, "contents": {"source": "data:,"}}]}}`))
+	require.NoError(t, err)
+	assert.Empty(t, report.Changes)
+}
+
+func TestDiffMatchesByName(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, _ = w.Write([]byte("a\nb\nc\n"))
+	require.NoError(t, w.Close())
+	compressed := "data:;base64," + base64.StdEncoding.EncodeToString(gz.Bytes())
+
+	remote := `{
+  "ignition": {"version": "3.3.0", "timeouts": {"httpTotal": 10}},
+  "passwd": {"users": [{"name": "alice", "sshAuthorizedKeys": ["key1", "key2"], "passwordHash": "x"}, {"name": "bob"}]},
+  "storage": {"files": [
+    {"path": "/etc/b", "mode": 420, "contents": {"source": "data:,a%0Ab%0A"}},
+    {"path": "/etc/a", "mode": 420, "contents": {"source": "data:,a"}}
+  ]},
+  "systemd": {"units": [
+    {"name": "kubelet.service", "enabled": true, "contents": "[Unit]\nA=1\n", "dropins": [{"name": "10-env.conf", "contents": "x"}]}
+  ]}
+}`
+	// the files are reordered, which is not a change
+	local := `{
+  "ignition": {"version": "3.3.0", "timeouts": {"httpTotal": 20}},
+  "passwd": {"users": [{"name": "alice", "sshAuthorizedKeys": ["key2", "key3"], "passwordHash": "y"}]},
+  "storage": {"files": [
+    {"path": "/etc/a", "mode": 384, "contents": {"source": "data:,a"}},
+    {"path": "/etc/b", "mode": 420, "contents": {"source": "` + compressed + `", "compression": "gzip"}},
+    {"path": "/etc/c", "contents": {"source": "https://example.com/c"}}
+  ]},
+  "systemd": {"units": [
+    {"name": "kubelet.service", "enabled": false, "contents": "[Unit]\nA=2\n", "dropins": [{"name": "10-env.conf", "contents": "x"}]},
+    {"name": "new.service", "contents": "[Unit]\n"}
+  ]}
+}`
+	report, err := Diff([]byte(remote), []byte(local))
+	require.NoError(t, err)
+	assert.Equal(t, []Change{
+		{Kind: KindFile, Name: "/etc/a", Type: Changed, Details: []string{"mode: 0644 -> 0600"}},
+		{Kind: KindFile, Name: "/etc/b", Type: Changed, Details: []string{"compression:  -> gzip"}, Diff: `--- remote /etc/b
++++ local /etc/b
+@@ -1,2 +1,3 @@
+ a
+ b
++c
+`},
+		{Kind: KindFile, Name: "/etc/c", Type: Added},
+		{Kind: KindUnit, Name: "kubelet.service", Type: Changed, Details: []string{"enabled: true -> false"}, Diff: `--- remote kubelet.service
++++ local kubelet.service
+@@ -1,2 +1,2 @@
+ [Unit]
+-A=1
++A=2
+`},
+		{Kind: KindUnit, Name: "new.service", Type: Added, Diff: `--- remote new.service
++++ local new.service
+@@ -0,0 +1 @@
++[Unit]
+`},
+		{Kind: KindUser, Name: "alice", Type: Changed, Details: []string{"passwordHash changed", "sshAuthorizedKeys: + key3", "sshAuthorizedKeys: - key1"}},
+		{Kind: KindUser, Name: "bob", Type: Removed},
+		{Kind: KindOther, Name: "ignition.timeouts.httpTotal", Type: Changed, Details: []string{"value: 10 -> 20"}},
+	}, report.Changes)
+	assert.Equal(t, "2 files changed, 1 file added, 1 unit changed, 1 unit added, 1 user changed, 1 user removed, 1 setting changed", report.Summary())
+}
@@ -0,0 +1,248 @@
+package analyze
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nais/onprem/nitro/pkg/ssh"
+)
+
+// Drift compares the files, units and users the generated config of the host
+// declares with the live system on it: files by mode, owner and sha256,
+// units by contents and enabled state, and users by their authorized keys.
+func Drift(sshClient *ssh.Client, host string) (*Report, error) {
+	data, err := os.ReadFile(fmt.Sprintf("output/%s/config.ign", host))
+	if err != nil {
+		return nil, fmt.Errorf("reading local ignition file: %w", err)
+	}
+	cfg, err := declared(data)
+	if err != nil {
+		return nil, err
+	}
+	out, err := sshClient.ExecuteCommandWithOutput(host, liveScript(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("inspecting %s: %w", host, err)
+	}
+	return &Report{Changes: driftChanges(cfg, parseLive(out))}, nil
+}
+
+// declared parses a config, migrating a 2.x one to 3.x.
+func declared(data []byte) (*config, error) {
+	version, spec, err := specVersion(data)
+	if err != nil {
+		return nil, fmt.Errorf("local ignition file: %w", err)
+	}
+	if version == 2 {
+		if data, err = migrateV2(data, migrateSpec); err != nil {
+			return nil, fmt.Errorf("migrating ignition %s file: %w", spec, err)
+		}
+	}
+	cfg, err := parseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal local ignition file: %w", err)
+	}
+	return cfg, nil
+}
+
+// liveScript returns a shell script printing a line per declared item, with
+// an id of the kind and index of the item, and what is on the node or - if
+// it is missing:
+//
+//	f<i> <mode> <uid> <gid> <user> <group> <sha256>  file
+//	s<i> <state>                                     unit enabled state
+//	c<i> <base64>                                    unit contents
+//	d<i> <base64>                                    dropin contents
+//	k<i> <base64>                                    user authorized keys
+func liveScript(cfg *config) string {
+	var sb strings.Builder
+	for i, path := range slices.Sorted(maps.Keys(cfg.files)) {
+		p := shellQuote(path)
+		fmt.Fprintf(&sb, "if sudo test -e %[2]s; then echo \"f%[1]d $(sudo stat -c '%%a %%u %%g %%U %%G' %[2]s) $(sudo sha256sum %[2]s | cut -d' ' -f1)\"; else echo 'f%[1]d -'; fi\n", i, p)
+	}
+	for i, name := range slices.Sorted(maps.Keys(cfg.units)) {
+		fmt.Fprintf(&sb, "echo \"s%d $(systemctl is-enabled %s 2>/dev/null)\"\n", i, shellQuote(name))
+		fmt.Fprint(&sb, catBase64(fmt.Sprintf("c%d", i), "/etc/systemd/system/"+name))
+	}
+	for i, name := range slices.Sorted(maps.Keys(dropins(cfg.units))) {
+		unit, dropin, _ := strings.Cut(name, "/")
+		fmt.Fprint(&sb, catBase64(fmt.Sprintf("d%d", i), "/etc/systemd/system/"+unit+".d/"+dropin))
+	}
+	for i, name := range slices.Sorted(maps.Keys(cfg.users)) {
+		fmt.Fprintf(&sb, "h=$(getent passwd %s | cut -d: -f6); ", shellQuote(name))
+		fmt.Fprintf(&sb, "if [ -n \"$h\" ]; then echo \"k%[1]d $({ sudo cat \"$h/.ssh/authorized_keys\"; sudo find \"$h/.ssh/authorized_keys.d\" -type f -exec cat {} +; } 2>/dev/null | base64 -w0)\"; else echo 'k%[1]d -'; fi\n", i)
+	}
+	return sb.String()
+}
+
+func catBase64(id, path string) string {
+	p := shellQuote(path)
+	return fmt.Sprintf("if sudo test -f %[2]s; then echo \"%[1]s $(sudo base64 -w0 %[2]s)\"; else echo '%[1]s -'; fi\n", id, p)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// missing is what liveScript prints for an item that is not on the node.
+const missing = "-"
+
+// parseLive returns the output of liveScript by id.
+func parseLive(out string) map[string]string {
+	ret := make(map[string]string)
+	for line := range strings.Lines(out) {
+		id, value, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		ret[id] = value
+	}
+	return ret
+}
+
+// driftChanges compares the declared items with what liveScript found on
+// the node. Details are from what is on the node to what is declared.
+func driftChanges(cfg *config, live map[string]string) []Change {
+	var changes []Change
+	add := func(kind Kind, name string, found bool, details []string, diff string) {
+		switch {
+		case !found:
+			changes = append(changes, Change{Kind: kind, Name: name, Type: Missing})
+		case len(details) > 0 || diff != "":
+			changes = append(changes, Change{Kind: kind, Name: name, Type: Changed, Details: details, Diff: diff})
+		}
+	}
+
+	for i, path := range slices.Sorted(maps.Keys(cfg.files)) {
+		value, ok := live[fmt.Sprintf("f%d", i)]
+		if !ok || value == missing {
+			add(KindFile, path, false, nil, "")
+			continue
+		}
+		add(KindFile, path, true, fileDrift(cfg.files[path], strings.Fields(value)), "")
+	}
+
+	for i, name := range slices.Sorted(maps.Keys(cfg.units)) {
+		unit := cfg.units[name]
+		state := live[fmt.Sprintf("s%d", i)]
+		if state == "" {
+			state = "not-found"
+		}
+		var details []string
+		switch {
+		case unit.Mask:
+			details = attr("state", state, "masked")
+		case unit.Enabled != nil && *unit.Enabled:
+			details = attr("state", state, "enabled")
+		case unit.Enabled != nil && state == "enabled":
+			details = attr("state", state, "disabled")
+		}
+		if unit.Contents == "" || unit.Mask {
+			add(KindUnit, name, true, details, "")
+			continue
+		}
+		text, found := liveText(live[fmt.Sprintf("c%d", i)])
+		add(KindUnit, name, found, details, textDiff(name, text, unit.Contents))
+	}
+
+	declaredDropins := dropins(cfg.units)
+	for i, name := range slices.Sorted(maps.Keys(declaredDropins)) {
+		text, found := liveText(live[fmt.Sprintf("d%d", i)])
+		add(KindDropin, name, found, nil, textDiff(name, text, declaredDropins[name].Contents))
+	}
+
+	for i, name := range slices.Sorted(maps.Keys(cfg.users)) {
+		value, ok := live[fmt.Sprintf("k%d", i)]
+		if !ok || value == missing {
+			add(KindUser, name, false, nil, "")
+			continue
+		}
+		text, _ := liveText(value)
+		add(KindUser, name, true, keyDrift(text, listStrings(cfg.users[name]["sshAuthorizedKeys"])), "")
+	}
+	return changes
+}
+
+// fileDrift compares a file with the mode, owner and sha256 on the node.
+// Owners default to root and are compared by id if the config has one.
+func fileDrift(f file3, fields []string) []string {
+	if len(fields) < 5 {
+		return []string{"could not stat: " + strings.Join(fields, " ")}
+	}
+	liveMode, uid, gid, userName, groupName := fields[0], fields[1], fields[2], fields[3], fields[4]
+
+	var details []string
+	if f.Mode != nil {
+		if m, err := strconv.ParseInt(liveMode, 8, 32); err == nil {
+			liveMode = fmt.Sprintf("%#o", m)
+		}
+		details = append(details, attr("mode", liveMode, mode(f.Mode))...)
+	}
+	switch {
+	case f.User == nil:
+		details = append(details, attr("user", uid, "0")...)
+	case f.User.ID != nil:
+		details = append(details, attr("user", uid, owner(f.User))...)
+	default:
+		details = append(details, attr("user", userName, owner(f.User))...)
+	}
+	switch {
+	case f.Group == nil:
+		details = append(details, attr("group", gid, "0")...)
+	case f.Group.ID != nil:
+		details = append(details, attr("group", gid, group(f.Group))...)
+	default:
+		details = append(details, attr("group", groupName, group(f.Group))...)
+	}
+
+	// only inline contents are known without fetching them, and appended
+	// files are not whole
+	if text, ok := contents(f.Contents); ok && f.Contents != nil && f.Contents.Source != "" && len(f.Append) == 0 {
+		sum := sha256.Sum256([]byte(text))
+		liveSum := ""
+		if len(fields) > 5 {
+			liveSum = fields[5]
+		}
+		details = append(details, attr("sha256", liveSum, hex.EncodeToString(sum[:]))...)
+	}
+	return details
+}
+
+// keyDrift compares the declared keys of a user with the authorized keys on
+// the node.
+func keyDrift(authorized string, keys []string) []string {
+	var liveKeys []string
+	for line := range strings.Lines(authorized) {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			liveKeys = append(liveKeys, line)
+		}
+	}
+	var details []string
+	for _, key := range keys {
+		if !slices.Contains(liveKeys, strings.TrimSpace(key)) {
+			details = append(details, "authorized key missing on node: "+key)
+		}
+	}
+	for _, key := range slices.Compact(slices.Sorted(slices.Values(liveKeys))) {
+		if !slices.ContainsFunc(keys, func(k string) bool { return strings.TrimSpace(k) == key }) {
+			details = append(details, "authorized key not in config: "+key)
+		}
+	}
+	return details
+}
+
+// liveText decodes base64 contents printed by liveScript, and whether they
+// were found.
+func liveText(value string) (string, bool) {
+	if value == missing {
+		return "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
@@ -0,0 +1,78 @@
+package analyze
+
+import (
+	"encoding/base64"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const driftConfig = `{
+  "ignition": {"version": "3.3.0"},
+  "passwd": {"users": [{"name": "core", "sshAuthorizedKeys": ["ssh-ed25519 a", "ssh-ed25519 b"]}, {"name": "gone"}]},
+  "storage": {"files": [
+    {"path": "/etc/kubernetes/kubelet.env", "mode": 420, "contents": {"source": "data:,A%3D1"}},
+    {"path": "/etc/it's", "mode": 384, "user": {"name": "etcd"}, "contents": {"source": "data:,x"}},
+    {"path": "/etc/missing"}
+  ]},
+  "systemd": {"units": [
+    {"name": "kubelet.service", "enabled": true, "contents": "[Unit]\nA=1\n", "dropins": [{"name": "10-env.conf", "contents": "[Service]\n"}]},
+    {"name": "docker.service", "mask": true}
+  ]}
+}`
+
+func TestLiveScript(t *testing.T) {
+	cfg, err := declared([]byte(driftConfig))
+	require.NoError(t, err)
+	script := liveScript(cfg)
+	assert.Contains(t, script, `sudo test -e '/etc/it'\''s'`)
+	assert.Contains(t, script, "echo \"s1 $(systemctl is-enabled 'kubelet.service' 2>/dev/null)\"\n")
+	assert.Contains(t, script, "'/etc/systemd/system/kubelet.service.d/10-env.conf'")
+	assert.Contains(t, script, "getent passwd 'gone'")
+
+	if sh, err := exec.LookPath("sh"); err == nil {
+		out, err := exec.Command(sh, "-n", "-c", script).CombinedOutput()
+		assert.NoError(t, err, string(out))
+	}
+}
+
+func TestDriftChanges(t *testing.T) {
+	cfg, err := declared([]byte(driftConfig))
+	require.NoError(t, err)
+
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	// files, units and users by the index of their sorted names
+	live := parseLive("f0 600 0 0 root root 2d711642b726b04401627ca9fbac32f5c8530fb1903cc4db02258717921a4881\n" +
+		"f1 644 0 0 root root 0000\n" +
+		"f2 -\n" +
+		"s0 masked\n" +
+		"c0 -\n" +
+		"s1 disabled\n" +
+		"c1 " + b64("[Unit]\nA=2\n") + "\n" +
+		"d0 -\n" +
+		"k0 " + b64("# auto-generated\nssh-ed25519 a\nssh-ed25519 c\nssh-ed25519 a\n") + "\n" +
+		"k1 -\n")
+
+	assert.Equal(t, []Change{
+		{Kind: KindFile, Name: "/etc/it's", Type: Changed, Details: []string{"user: root -> etcd"}},
+		{Kind: KindFile, Name: "/etc/kubernetes/kubelet.env", Type: Changed, Details: []string{
+			"sha256: 0000 -> f1d316d330440dea46d96ad43f6562ff9411c1b84700794dcd584f18146a18f6",
+		}},
+		{Kind: KindFile, Name: "/etc/missing", Type: Missing},
+		{Kind: KindUnit, Name: "kubelet.service", Type: Changed, Details: []string{"state: disabled -> enabled"}, Diff: `--- remote kubelet.service
++++ local kubelet.service
+@@ -1,2 +1,2 @@
+ [Unit]
+-A=2
++A=1
+`},
+		{Kind: KindDropin, Name: "kubelet.service/10-env.conf", Type: Missing},
+		{Kind: KindUser, Name: "core", Type: Changed, Details: []string{
+			"authorized key missing on node: ssh-ed25519 b",
+			"authorized key not in config: ssh-ed25519 c",
+		}},
+		{Kind: KindUser, Name: "gone", Type: Missing},
+	}, driftChanges(cfg, live))
+}
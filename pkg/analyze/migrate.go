@@ -0,0 +1,225 @@
+package analyze
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/flatcar/ignition/config/v2_3/types"
+	"github.com/nais/onprem/nitro/pkg/transpile"
+	"github.com/vincent-petithory/dataurl"
+)
+
+// ErrSpecVersion is returned for configs of an ignition spec version that
+// cannot be compared.
+var ErrSpecVersion = errors.New("unsupported ignition spec version")
+
+// specVersion returns the major version of the ignition spec of a config.
+func specVersion(data []byte) (int, string, error) {
+	var cfg struct {
+		Ignition struct {
+			Version string `json:"version"`
+		} `json:"ignition"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return 0, "", err
+	}
+	major, _, _ := strings.Cut(cfg.Ignition.Version, ".")
+	n, err := strconv.Atoi(major)
+	if err != nil || n < 2 || n > 3 {
+		return 0, "", fmt.Errorf("%w: %q", ErrSpecVersion, cfg.Ignition.Version)
+	}
+	return n, cfg.Ignition.Version, nil
+}
+
+// migrateSpec is the 3.x version 2.x configs are migrated to when there is
+// no 3.x config to take the version from.
+const migrateSpec = "3.3.0"
+
+// The parts of the Ignition 3.x spec a 2.x config is migrated to.
+type (
+	config3 struct {
+		Ignition ignition3 `json:"ignition"`
+		Passwd   *passwd3  `json:"passwd,omitempty"`
+		Storage  *storage3 `json:"storage,omitempty"`
+		Systemd  *systemd3 `json:"systemd,omitempty"`
+	}
+	ignition3 struct {
+		Version  string          `json:"version"`
+		Config   *ignitionConfig `json:"config,omitempty"`
+		Timeouts *types.Timeouts `json:"timeouts,omitempty"`
+		Security *types.Security `json:"security,omitempty"`
+	}
+	ignitionConfig struct {
+		Merge   []types.ConfigReference `json:"merge,omitempty"`
+		Replace *types.ConfigReference  `json:"replace,omitempty"`
+	}
+	passwd3 struct {
+		Users  []types.PasswdUser  `json:"users,omitempty"`
+		Groups []types.PasswdGroup `json:"groups,omitempty"`
+	}
+	storage3 struct {
+		Files       []file3      `json:"files,omitempty"`
+		Directories []directory3 `json:"directories,omitempty"`
+		Links       []link3      `json:"links,omitempty"`
+	}
+	node3 struct {
+		Path      string           `json:"path"`
+		Overwrite *bool            `json:"overwrite,omitempty"`
+		User      *types.NodeUser  `json:"user,omitempty"`
+		Group     *types.NodeGroup `json:"group,omitempty"`
+	}
+	file3 struct {
+		node3
+		Mode     *int                 `json:"mode,omitempty"`
+		Contents *types.FileContents  `json:"contents,omitempty"`
+		Append   []types.FileContents `json:"append,omitempty"`
+	}
+	directory3 struct {
+		node3
+		Mode *int `json:"mode,omitempty"`
+	}
+	link3 struct {
+		node3
+		Target string `json:"target"`
+		Hard   bool   `json:"hard,omitempty"`
+	}
+	systemd3 struct {
+		Units []unit3 `json:"units,omitempty"`
+	}
+	unit3 struct {
+		Name     string                `json:"name"`
+		Enabled  *bool                 `json:"enabled,omitempty"`
+		Mask     bool                  `json:"mask,omitempty"`
+		Contents string                `json:"contents,omitempty"`
+		Dropins  []types.SystemdDropin `json:"dropins,omitempty"`
+	}
+)
+
+// migrateV2 translates an Ignition 2.x config to the given 3.x version, the
+// way a config written for 3.x would do the same. Files without overwrite
+// were overwritten in 2.x and are so explicitly in 3.x, networkd units are
+// files in /etc/systemd/network, and enable is enabled. Disks, filesystems
+// and raids other than the root filesystem are not migrated. The result is
+// validated against the 3.x spec.
+func migrateV2(data []byte, version string) ([]byte, error) {
+	var cfg types.Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Storage.Disks) > 0 || len(cfg.Storage.Filesystems) > 0 || len(cfg.Storage.Raid) > 0 {
+		return nil, fmt.Errorf("%w: disks, filesystems and raids of a 2.x config cannot be migrated", ErrSpecVersion)
+	}
+
+	ret := config3{Ignition: ignition3{Version: version}}
+	if c := cfg.Ignition.Config; len(c.Append) > 0 || c.Replace != nil {
+		ret.Ignition.Config = &ignitionConfig{Merge: c.Append, Replace: c.Replace}
+	}
+	if t := cfg.Ignition.Timeouts; t.HTTPResponseHeaders != nil || t.HTTPTotal != nil {
+		ret.Ignition.Timeouts = &t
+	}
+	if s := cfg.Ignition.Security; len(s.TLS.CertificateAuthorities) > 0 {
+		ret.Ignition.Security = &s
+	}
+
+	if len(cfg.Passwd.Users) > 0 || len(cfg.Passwd.Groups) > 0 {
+		ret.Passwd = &passwd3{Users: cfg.Passwd.Users, Groups: cfg.Passwd.Groups}
+		for _, user := range ret.Passwd.Users {
+			if user.Create != nil {
+				return nil, fmt.Errorf("%w: user %s: passwd.users.create cannot be migrated", ErrSpecVersion, user.Name)
+			}
+		}
+	}
+
+	storage := &storage3{}
+	for _, f := range cfg.Storage.Files {
+		node, err := migrateNode(f.Node)
+		if err != nil {
+			return nil, err
+		}
+		file := file3{node3: node, Mode: f.Mode}
+		contents := f.Contents
+		switch {
+		case f.Append:
+			file.Append = []types.FileContents{contents}
+		case contents.Source != "" || contents.Compression != "" || contents.Verification.Hash != nil:
+			file.Contents = &contents
+		}
+		if file.Overwrite == nil && !f.Append {
+			file.Overwrite = boolPtr(true)
+		}
+		if file.Contents == nil && !f.Append && *file.Overwrite {
+			// 2.x writes an empty file, 3.x can only overwrite with a source
+			file.Contents = &types.FileContents{Source: "data:,"}
+		}
+		storage.Files = append(storage.Files, file)
+	}
+	for _, d := range cfg.Storage.Directories {
+		node, err := migrateNode(d.Node)
+		if err != nil {
+			return nil, err
+		}
+		storage.Directories = append(storage.Directories, directory3{node3: node, Mode: d.Mode})
+	}
+	for _, l := range cfg.Storage.Links {
+		node, err := migrateNode(l.Node)
+		if err != nil {
+			return nil, err
+		}
+		storage.Links = append(storage.Links, link3{node3: node, Target: l.Target, Hard: l.Hard})
+	}
+	for _, unit := range cfg.Networkd.Units {
+		dir := "/etc/systemd/network"
+		if unit.Contents != "" {
+			storage.Files = append(storage.Files, networkdFile(path.Join(dir, unit.Name), unit.Contents))
+		}
+		for _, dropin := range unit.Dropins {
+			storage.Files = append(storage.Files, networkdFile(path.Join(dir, unit.Name+".d", dropin.Name), dropin.Contents))
+		}
+	}
+	if len(storage.Files) > 0 || len(storage.Directories) > 0 || len(storage.Links) > 0 {
+		ret.Storage = storage
+	}
+
+	if len(cfg.Systemd.Units) > 0 {
+		ret.Systemd = &systemd3{}
+		for _, u := range cfg.Systemd.Units {
+			unit := unit3{Name: u.Name, Enabled: u.Enabled, Mask: u.Mask, Contents: u.Contents, Dropins: u.Dropins}
+			if u.Enable {
+				unit.Enabled = boolPtr(true)
+			}
+			ret.Systemd.Units = append(ret.Systemd.Units, unit)
+		}
+	}
+	out, err := json.Marshal(ret)
+	if err != nil {
+		return nil, err
+	}
+	if err := transpile.Validate(out); err != nil {
+		return nil, fmt.Errorf("migrated config: %w", err)
+	}
+	return out, nil
+}
+
+func migrateNode(node types.Node) (node3, error) {
+	if node.Filesystem != "" && node.Filesystem != "root" {
+		return node3{}, fmt.Errorf("%w: %s is on filesystem %s, only root can be migrated", ErrSpecVersion, node.Path, node.Filesystem)
+	}
+	return node3{Path: node.Path, Overwrite: node.Overwrite, User: node.User, Group: node.Group}, nil
+}
+
+func networkdFile(path, contents string) file3 {
+	mode := 0o644
+	return file3{
+		node3:    node3{Path: path, Overwrite: boolPtr(true)},
+		Mode:     &mode,
+		Contents: &types.FileContents{Source: "data:," + dataurl.EscapeString(contents)},
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -0,0 +1,252 @@
+package analyze
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/nais/onprem/nitro/pkg/vars"
+	log "github.com/sirupsen/logrus"
+	"github.com/sourcegraph/conc/pool"
+)
+
+// Format is the output format of an analysis.
+type Format string
+
+const (
+	// Markdown has a section per host with its report.
+	Markdown Format = "markdown"
+	// JSON lists the changes of every host.
+	JSON Format = "json"
+	// GitHub is markdown with a table of the hosts and a collapsible section
+	// per host that differs, cut to fit a PR comment or job summary.
+	GitHub Format = "github"
+)
+
+// ParseFormat returns the format with the name, Markdown if it is empty.
+func ParseFormat(name string) (Format, error) {
+	switch Format(name) {
+	case "", Markdown:
+		return Markdown, nil
+	case JSON, GitHub:
+		return Format(name), nil
+	}
+	return "", fmt.Errorf("unknown format %q, must be %s, %s or %s", name, Markdown, JSON, GitHub)
+}
+
+// githubMaxLength is the max length of a PR comment, the smaller of it and a
+// job summary.
+const githubMaxLength = 65536
+
+// HostReport is the report of a single host, or why it could not be made.
+type HostReport struct {
+	Role   string
+	Host   string
+	Report *Report
+	Err    error
+}
+
+// Analysis is the reports of the analyzed hosts of a cluster.
+type Analysis struct {
+	Cluster string
+	Hosts   []HostReport
+}
+
+// CheckHosts checks the hosts concurrently, at most parallelism at a time.
+// The reports are in the order of the roles, and by hostname within a role.
+// A host that could not be checked has its error in its report, and does not
+// stop the others.
+func CheckHosts(cluster string, roleHosts map[string][]string, parallelism int, check func(host string) (*Report, error)) *Analysis {
+	a := &Analysis{Cluster: cluster}
+	for _, role := range vars.Roles {
+		for _, host := range slices.Sorted(slices.Values(roleHosts[role])) {
+			a.Hosts = append(a.Hosts, HostReport{Role: role, Host: host})
+		}
+	}
+	p := pool.New().WithMaxGoroutines(max(parallelism, 1))
+	for i := range a.Hosts {
+		h := &a.Hosts[i]
+		p.Go(func() {
+			h.Report, h.Err = check(h.Host)
+			if h.Err != nil {
+				log.WithField("node", h.Host).WithError(h.Err).Error("check failed")
+			}
+		})
+	}
+	p.Wait()
+	return a
+}
+
+// Drifted returns the hosts whose config differs from the generated one.
+func (a *Analysis) Drifted() []string {
+	var ret []string
+	for _, h := range a.Hosts {
+		if h.Err == nil && len(h.Report.Changes) > 0 {
+			ret = append(ret, h.Host)
+		}
+	}
+	return ret
+}
+
+// Err returns the errors of the hosts that could not be checked.
+func (a *Analysis) Err() error {
+	var errs []error
+	for _, h := range a.Hosts {
+		if h.Err != nil {
+			errs = append(errs, fmt.Errorf("node %s: %w", h.Host, h.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// summary is the summary of the report of a host, or its error.
+func (h HostReport) summary() string {
+	if h.Err != nil {
+		return "error: " + h.Err.Error()
+	}
+	return h.Report.Summary()
+}
+
+// Render renders the analysis in the format.
+func (a *Analysis) Render(format Format) ([]byte, error) {
+	switch format {
+	case JSON:
+		return a.json()
+	case GitHub:
+		return []byte(a.github(githubMaxLength)), nil
+	}
+	return []byte(a.markdown()), nil
+}
+
+func (a *Analysis) markdown() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "## %s\n", a.Cluster)
+	for _, h := range a.Hosts {
+		if h.Err != nil {
+			fmt.Fprintf(&sb, "### %s - %s\n%s\n\n", h.Role, h.Host, h.summary())
+			continue
+		}
+		fmt.Fprintf(&sb, "### %s - %s\n%s\n", h.Role, h.Host, h.Report.Markdown())
+	}
+	return sb.String()
+}
+
+type jsonHost struct {
+	Host    string   `json:"host"`
+	Role    string   `json:"role"`
+	Drift   bool     `json:"drift"`
+	Summary string   `json:"summary,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Note    string   `json:"note,omitempty"`
+	Changes []Change `json:"changes"`
+}
+
+func (a *Analysis) json() ([]byte, error) {
+	out := struct {
+		Cluster string     `json:"cluster"`
+		Drift   bool       `json:"drift"`
+		Hosts   []jsonHost `json:"hosts"`
+	}{
+		Cluster: a.Cluster,
+		Drift:   len(a.Drifted()) > 0,
+		Hosts:   []jsonHost{},
+	}
+	for _, h := range a.Hosts {
+		if h.Err != nil {
+			out.Hosts = append(out.Hosts, jsonHost{Host: h.Host, Role: h.Role, Error: h.Err.Error(), Changes: []Change{}})
+			continue
+		}
+		changes := h.Report.Changes
+		if changes == nil {
+			changes = []Change{}
+		}
+		out.Hosts = append(out.Hosts, jsonHost{
+			Host:    h.Host,
+			Role:    h.Role,
+			Drift:   len(changes) > 0,
+			Summary: h.Report.Summary(),
+			Note:    h.Report.Note,
+			Changes: changes,
+		})
+	}
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// github renders a table of the hosts and a collapsible section per host
+// that differs, within limit bytes. Sections that do not fit are shown
+// without their diffs, or left out if even that does not fit.
+func (a *Analysis) github(limit int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "## %s\n\n", a.Cluster)
+	drifted := a.Drifted()
+	failed := 0
+	for _, h := range a.Hosts {
+		if h.Err != nil {
+			failed++
+		}
+	}
+	switch {
+	case len(drifted) == 0 && failed == 0:
+		fmt.Fprintf(&sb, "All %d analyzed nodes match the generated config.\n", len(a.Hosts))
+		return sb.String()
+	case failed == 0:
+		fmt.Fprintf(&sb, "%d of %d analyzed nodes differ from the generated config.\n\n", len(drifted), len(a.Hosts))
+	default:
+		fmt.Fprintf(&sb, "%d of %d analyzed nodes differ from the generated config, %d could not be analyzed.\n\n", len(drifted), len(a.Hosts), failed)
+	}
+	sb.WriteString("| role | host | changes |\n| --- | --- | --- |\n")
+	for _, h := range a.Hosts {
+		fmt.Fprintf(&sb, "| %s | %s | %s |\n", h.Role, h.Host, tableCell.Replace(h.summary()))
+	}
+
+	// room for the line on what was cut
+	const footer = 200
+	var withoutDiff, leftOut int
+	for _, h := range a.Hosts {
+		if h.Err != nil || len(h.Report.Changes) == 0 {
+			continue
+		}
+		section := githubSection(h, h.Report.Markdown())
+		if sb.Len()+len(section)+footer > limit {
+			withoutDiff++
+			section = githubSection(h, h.Report.list())
+		}
+		if sb.Len()+len(section)+footer > limit {
+			withoutDiff--
+			leftOut++
+			continue
+		}
+		sb.WriteString(section)
+	}
+	var cut []string
+	if withoutDiff > 0 {
+		cut = append(cut, "the diffs of "+nodes(withoutDiff))
+	}
+	if leftOut > 0 {
+		cut = append(cut, nodes(leftOut)+" entirely")
+	}
+	if len(cut) > 0 {
+		fmt.Fprintf(&sb, "\n_Left out to fit a comment: %s. Run analyze with `--format markdown` for the whole analysis._\n", strings.Join(cut, " and "))
+	}
+	return sb.String()
+}
+
+// tableCell escapes text for a markdown table cell.
+var tableCell = strings.NewReplacer("|", `\|`, "\n", " ")
+
+func nodes(n int) string {
+	if n == 1 {
+		return "1 node"
+	}
+	return fmt.Sprintf("%d nodes", n)
+}
+
+func githubSection(h HostReport, body string) string {
+	return fmt.Sprintf("\n<details>\n<summary><b>%s - %s</b>: %s</summary>\n\n%s\n</details>\n", h.Role, h.Host, h.Report.Summary(), body)
+}
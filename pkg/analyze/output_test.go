@@ -0,0 +1,129 @@
+package analyze
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testAnalysis() *Analysis {
+	return &Analysis{Cluster: "dev", Hosts: []HostReport{
+		{Role: "etcd", Host: "etcd1", Report: &Report{}},
+		{Role: "worker", Host: "worker1", Report: &Report{Changes: []Change{
+			{Kind: KindFile, Name: "/etc/motd", Type: Changed, Diff: "--- remote /etc/motd\n+++ local /etc/motd\n@@ -1 +1 @@\n-hei\n+hallo\n"},
+			{Kind: KindUnit, Name: "new.service", Type: Added},
+		}}},
+		{Role: "worker", Host: "worker2", Report: &Report{Changes: []Change{
+			{Kind: KindUser, Name: "bob", Type: Removed},
+		}}},
+	}}
+}
+
+func TestRenderJSON(t *testing.T) {
+	out, err := testAnalysis().Render(JSON)
+	require.NoError(t, err)
+
+	var got struct {
+		Drift bool
+		Hosts []struct {
+			Host    string
+			Role    string
+			Drift   bool
+			Changes []map[string]any
+		}
+	}
+	require.NoError(t, json.Unmarshal(out, &got))
+	assert.True(t, got.Drift)
+	require.Len(t, got.Hosts, 3)
+	assert.Equal(t, "etcd1", got.Hosts[0].Host)
+	assert.False(t, got.Hosts[0].Drift)
+	assert.NotNil(t, got.Hosts[0].Changes)
+	assert.Equal(t, "worker", got.Hosts[1].Role)
+	assert.Equal(t, map[string]any{"kind": "unit", "name": "new.service", "type": "added"}, got.Hosts[1].Changes[1])
+}
+
+func TestRenderGitHub(t *testing.T) {
+	a := testAnalysis()
+	assert.Equal(t, []string{"worker1", "worker2"}, a.Drifted())
+
+	out := a.github(githubMaxLength)
+	assert.Contains(t, out, "2 of 3 analyzed nodes differ")
+	assert.Contains(t, out, "| etcd | etcd1 | no changes |\n")
+	assert.Contains(t, out, "<summary><b>worker - worker1</b>: 1 file changed, 1 unit added</summary>")
+	assert.Contains(t, out, "+hallo")
+	assert.NotContains(t, out, "<b>etcd - etcd1</b>")
+	assert.NotContains(t, out, "Left out")
+
+	// a diff too big for the limit is left out, and then the whole section
+	a.Hosts[1].Report.Changes[0].Diff = strings.Repeat("+line\n", 1000)
+	out = a.github(3000)
+	assert.LessOrEqual(t, len(out), 3000)
+	assert.Contains(t, out, "- changed file `/etc/motd`\n- added unit `new.service`\n")
+	assert.NotContains(t, out, "+line")
+	assert.Contains(t, out, "#### removed user `bob`")
+	assert.Contains(t, out, "_Left out to fit a comment: the diffs of 1 node. ")
+
+	limit := strings.Index(out, "<details>") + 250
+	out = a.github(limit)
+	assert.LessOrEqual(t, len(out), limit)
+	assert.NotContains(t, out, "<details>")
+	assert.Contains(t, out, "_Left out to fit a comment: 2 nodes entirely. ")
+
+	out = (&Analysis{Cluster: "dev", Hosts: testAnalysis().Hosts[:1]}).github(githubMaxLength)
+	assert.Equal(t, "## dev\n\nAll 1 analyzed nodes match the generated config.\n", out)
+}
+
+func TestParseAnalysisFormat(t *testing.T) {
+	for name, want := range map[string]Format{"": Markdown, "markdown": Markdown, "json": JSON, "github": GitHub} {
+		format, err := ParseFormat(name)
+		require.NoError(t, err)
+		assert.Equal(t, want, format)
+	}
+	_, err := ParseFormat("html")
+	assert.Error(t, err)
+}
+
+func TestCheckHosts(t *testing.T) {
+	roleHosts := map[string][]string{
+		"worker":    {"worker2", "worker1", "worker3"},
+		"etcd":      {"etcd1"},
+		"apiserver": {"apiserver1"},
+	}
+	var running, maxRunning atomic.Int32
+	a := CheckHosts("dev", roleHosts, 2, func(host string) (*Report, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for m := maxRunning.Load(); n > m && !maxRunning.CompareAndSwap(m, n); m = maxRunning.Load() {
+		}
+		time.Sleep(10 * time.Millisecond)
+		if host == "worker2" {
+			return nil, errors.New("unreachable")
+		}
+		return &Report{Changes: []Change{{Kind: KindFile, Name: "/etc/" + host, Type: Changed}}}, nil
+	})
+	assert.LessOrEqual(t, maxRunning.Load(), int32(2))
+
+	var hosts []string
+	for _, h := range a.Hosts {
+		hosts = append(hosts, h.Role+"/"+h.Host)
+	}
+	assert.Equal(t, []string{"etcd/etcd1", "apiserver/apiserver1", "worker/worker1", "worker/worker2", "worker/worker3"}, hosts)
+	assert.Equal(t, []string{"etcd1", "apiserver1", "worker1", "worker3"}, a.Drifted())
+	assert.EqualError(t, a.Err(), "node worker2: unreachable")
+
+	out, err := a.Render(JSON)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), `"error": "unreachable"`)
+	md, err := a.Render(Markdown)
+	require.NoError(t, err)
+	assert.Contains(t, string(md), "### worker - worker2\nerror: unreachable\n")
+	gh := a.github(githubMaxLength)
+	assert.Contains(t, gh, "4 of 5 analyzed nodes differ from the generated config, 1 could not be analyzed.")
+	assert.Contains(t, gh, "| worker | worker2 | error: unreachable |")
+}
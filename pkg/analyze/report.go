@@ -0,0 +1,121 @@
+package analyze
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Kind is what a change is to.
+type Kind string
+
+const (
+	KindFile      Kind = "file"
+	KindDirectory Kind = "directory"
+	KindLink      Kind = "link"
+	KindUnit      Kind = "unit"
+	KindDropin    Kind = "dropin"
+	KindUser      Kind = "user"
+	// KindOther is a change to anything else in the config, by its json path.
+	KindOther Kind = "setting"
+)
+
+var kinds = []Kind{KindFile, KindDirectory, KindLink, KindUnit, KindDropin, KindUser, KindOther}
+
+func (k Kind) plural(n int) string {
+	switch {
+	case n == 1:
+		return string(k)
+	case k == KindDirectory:
+		return "directories"
+	}
+	return string(k) + "s"
+}
+
+// ChangeType is whether something was added, removed or changed, or is
+// missing on the node.
+type ChangeType string
+
+const (
+	Added   ChangeType = "added"
+	Removed ChangeType = "removed"
+	Changed ChangeType = "changed"
+	// Missing is something the config declares that is not on the node.
+	Missing ChangeType = "missing"
+)
+
+var changeTypes = []ChangeType{Changed, Added, Removed, Missing}
+
+// Change is a file, unit, user or other part of the config that differs
+// between the node and the generated config.
+type Change struct {
+	Kind Kind `json:"kind"`
+	// Name is the path of a file, directory or link, the name of a unit or
+	// user, unit/dropin for a dropin, or the json path of a setting.
+	Name string     `json:"name"`
+	Type ChangeType `json:"type"`
+	// Details are the changed attributes, e.g. "mode: 0644 -> 0600".
+	Details []string `json:"details,omitempty"`
+	// Diff is a unified diff of the text of a file, unit or dropin.
+	Diff string `json:"diff,omitempty"`
+}
+
+// Report is the difference between the config on a node and the generated
+// one.
+type Report struct {
+	// Note says how the configs were compared, if not as they are.
+	Note    string   `json:"note,omitempty"`
+	Changes []Change `json:"changes"`
+}
+
+// Summary counts the changes, e.g. "3 files changed, 1 unit added".
+func (r *Report) Summary() string {
+	if len(r.Changes) == 0 {
+		return "no changes"
+	}
+	var parts []string
+	for _, kind := range kinds {
+		for _, changeType := range changeTypes {
+			n := 0
+			for _, c := range r.Changes {
+				if c.Kind == kind && c.Type == changeType {
+					n++
+				}
+			}
+			if n > 0 {
+				parts = append(parts, fmt.Sprintf("%d %s %s", n, kind.plural(n), changeType))
+			}
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Markdown renders the report with a section per change.
+func (r *Report) Markdown() string {
+	var sb strings.Builder
+	if r.Note != "" {
+		fmt.Fprintf(&sb, "%s\n\n", r.Note)
+	}
+	fmt.Fprintf(&sb, "%s\n", r.Summary())
+	for _, c := range r.Changes {
+		fmt.Fprintf(&sb, "\n#### %s %s `%s`\n", c.Type, c.Kind, c.Name)
+		for _, detail := range c.Details {
+			fmt.Fprintf(&sb, "- %s\n", detail)
+		}
+		if c.Diff != "" {
+			fmt.Fprintf(&sb, "\n```diff\n%s```\n", c.Diff)
+		}
+	}
+	return sb.String()
+}
+
+// list renders the report with a line per change and no diffs.
+func (r *Report) list() string {
+	var sb strings.Builder
+	if r.Note != "" {
+		fmt.Fprintf(&sb, "%s\n\n", r.Note)
+	}
+	for _, c := range r.Changes {
+		fmt.Fprintf(&sb, "- %s %s `%s`\n", c.Type, c.Kind, c.Name)
+	}
+	return sb.String()
+}
@@ -0,0 +1,411 @@
+package analyze
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/flatcar/ignition/config/v2_3/types"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/r3labs/diff/v2"
+	"github.com/vincent-petithory/dataurl"
+)
+
+// config is a 3.x config with its files, directories and links by path, its
+// units and users by name, and the rest as is.
+type config struct {
+	files       map[string]file3
+	directories map[string]directory3
+	links       map[string]link3
+	units       map[string]unit3
+	users       map[string]map[string]any
+	other       map[string]any
+}
+
+func parseConfig(data []byte) (*config, error) {
+	var typed struct {
+		Passwd struct {
+			Users []map[string]any `json:"users"`
+		} `json:"passwd"`
+		Storage storage3 `json:"storage"`
+		Systemd systemd3 `json:"systemd"`
+	}
+	if err := json.Unmarshal(data, &typed); err != nil {
+		return nil, err
+	}
+	var other map[string]any
+	if err := json.Unmarshal(data, &other); err != nil {
+		return nil, err
+	}
+
+	c := &config{
+		files:       make(map[string]file3),
+		directories: make(map[string]directory3),
+		links:       make(map[string]link3),
+		units:       make(map[string]unit3),
+		users:       make(map[string]map[string]any),
+	}
+	for _, f := range typed.Storage.Files {
+		c.files[f.Path] = f
+	}
+	for _, d := range typed.Storage.Directories {
+		c.directories[d.Path] = d
+	}
+	for _, l := range typed.Storage.Links {
+		c.links[l.Path] = l
+	}
+	for _, u := range typed.Systemd.Units {
+		c.units[u.Name] = u
+	}
+	for _, u := range typed.Passwd.Users {
+		c.users[fmt.Sprint(u["name"])] = u
+	}
+
+	for section, keys := range map[string][]string{
+		"storage": {"files", "directories", "links"},
+		"systemd": {"units"},
+		"passwd":  {"users"},
+	} {
+		if m, ok := other[section].(map[string]any); ok {
+			for _, key := range keys {
+				delete(m, key)
+			}
+		}
+	}
+	c.other, _ = prune(other).(map[string]any)
+	return c, nil
+}
+
+// compare returns the changes from the remote config to the local one.
+func compare(remote, local *config) ([]Change, error) {
+	var changes []Change
+	changes = append(changes, compareNamed(KindFile, remote.files, local.files, compareFiles)...)
+	changes = append(changes, compareNamed(KindDirectory, remote.directories, local.directories, func(r, l directory3) ([]string, string) {
+		return append(compareNode(r.node3, l.node3), attr("mode", mode(r.Mode), mode(l.Mode))...), ""
+	})...)
+	changes = append(changes, compareNamed(KindLink, remote.links, local.links, func(r, l link3) ([]string, string) {
+		details := compareNode(r.node3, l.node3)
+		details = append(details, attr("target", r.Target, l.Target)...)
+		return append(details, attr("hard", fmt.Sprint(r.Hard), fmt.Sprint(l.Hard))...), ""
+	})...)
+	changes = append(changes, compareNamed(KindUnit, remote.units, local.units, func(r, l unit3) ([]string, string) {
+		details := attr("enabled", boolString(r.Enabled), boolString(l.Enabled))
+		details = append(details, attr("mask", fmt.Sprint(r.Mask), fmt.Sprint(l.Mask))...)
+		return details, textDiff(l.Name, r.Contents, l.Contents)
+	})...)
+	changes = append(changes, compareNamed(KindDropin, dropins(remote.units), dropins(local.units), func(r, l types.SystemdDropin) ([]string, string) {
+		return nil, textDiff(l.Name, r.Contents, l.Contents)
+	})...)
+	changes = append(changes, compareNamed(KindUser, remote.users, local.users, compareUsers)...)
+
+	other, err := compareOther(remote.other, local.other)
+	if err != nil {
+		return nil, err
+	}
+	return append(changes, other...), nil
+}
+
+// compareNamed returns the items added, removed and changed from remote to
+// local, sorted by name. Added items are compared with their zero value, so
+// their contents are shown.
+func compareNamed[T any](kind Kind, remote, local map[string]T, compare func(r, l T) ([]string, string)) []Change {
+	var changes []Change
+	for _, name := range slices.Sorted(maps.Keys(union(remote, local))) {
+		r, inRemote := remote[name]
+		l, inLocal := local[name]
+		change := Change{Kind: kind, Name: name}
+		switch {
+		case !inRemote:
+			change.Type = Added
+			var zero T
+			_, change.Diff = compare(zero, l)
+		case !inLocal:
+			change.Type = Removed
+		default:
+			change.Details, change.Diff = compare(r, l)
+			if len(change.Details) == 0 && change.Diff == "" {
+				continue
+			}
+			change.Type = Changed
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func compareFiles(r, l file3) ([]string, string) {
+	details := compareNode(r.node3, l.node3)
+	details = append(details, attr("mode", mode(r.Mode), mode(l.Mode))...)
+
+	var diffs []string
+	from, fromData := contents(r.Contents)
+	to, toData := contents(l.Contents)
+	if fromData && toData {
+		diffs = append(diffs, textDiff(l.Path, from, to))
+	} else {
+		details = append(details, attr("source", source(r.Contents), source(l.Contents))...)
+	}
+	if r.Contents != nil && l.Contents != nil {
+		details = append(details, attr("compression", r.Contents.Compression, l.Contents.Compression)...)
+		details = append(details, attr("verification", hash(r.Contents), hash(l.Contents))...)
+	}
+
+	var fromAppend, toAppend []string
+	for _, c := range r.Append {
+		text, _ := contents(&c)
+		fromAppend = append(fromAppend, text)
+	}
+	for _, c := range l.Append {
+		text, _ := contents(&c)
+		toAppend = append(toAppend, text)
+	}
+	diffs = append(diffs, textDiff(l.Path+" (append)", strings.Join(fromAppend, ""), strings.Join(toAppend, "")))
+
+	return details, strings.Join(slices.DeleteFunc(diffs, func(d string) bool { return d == "" }), "")
+}
+
+func compareNode(r, l node3) []string {
+	details := attr("overwrite", boolString(r.Overwrite), boolString(l.Overwrite))
+	details = append(details, attr("user", owner(r.User), owner(l.User))...)
+	return append(details, attr("group", group(r.Group), group(l.Group))...)
+}
+
+// compareUsers lists the changed fields of a user; keys and groups by the
+// items added and removed, the password hash only as changed.
+func compareUsers(r, l map[string]any) ([]string, string) {
+	var details []string
+	for _, key := range slices.Sorted(maps.Keys(union(r, l))) {
+		from, to := r[key], l[key]
+		switch {
+		case key == "name":
+		case key == "passwordHash":
+			if fmt.Sprint(from) != fmt.Sprint(to) {
+				details = append(details, "passwordHash changed")
+			}
+		case isList(from) || isList(to):
+			fromItems, toItems := listStrings(from), listStrings(to)
+			for _, item := range toItems {
+				if !slices.Contains(fromItems, item) {
+					details = append(details, fmt.Sprintf("%s: + %s", key, item))
+				}
+			}
+			for _, item := range fromItems {
+				if !slices.Contains(toItems, item) {
+					details = append(details, fmt.Sprintf("%s: - %s", key, item))
+				}
+			}
+		default:
+			details = append(details, attr(key, value(from), value(to))...)
+		}
+	}
+	return details, ""
+}
+
+// compareOther compares what is not matched by path or name as is.
+func compareOther(remote, local map[string]any) ([]Change, error) {
+	differ, err := diff.NewDiffer()
+	if err != nil {
+		return nil, fmt.Errorf("new differ: %w", err)
+	}
+	changelog, err := differ.Diff(remote, local)
+	if err != nil {
+		return nil, err
+	}
+	return otherChanges(changelog), nil
+}
+
+// otherChanges returns the changes of a changelog by their json path.
+func otherChanges(changelog diff.Changelog) []Change {
+	var changes []Change
+	for _, c := range changelog {
+		change := Change{Kind: KindOther, Name: strings.Join(c.Path, ".")}
+		switch c.Type {
+		case diff.CREATE:
+			change.Type = Added
+			change.Details = []string{value(c.To)}
+		case diff.DELETE:
+			change.Type = Removed
+			change.Details = []string{value(c.From)}
+		default:
+			change.Type = Changed
+			change.Details = attr("value", value(c.From), value(c.To))
+		}
+		changes = append(changes, change)
+	}
+	slices.SortFunc(changes, func(a, b Change) int { return strings.Compare(a.Name, b.Name) })
+	return changes
+}
+
+func dropins(units map[string]unit3) map[string]types.SystemdDropin {
+	ret := make(map[string]types.SystemdDropin)
+	for name, unit := range units {
+		for _, dropin := range unit.Dropins {
+			ret[name+"/"+dropin.Name] = dropin
+		}
+	}
+	return ret
+}
+
+// contents returns the text of file contents and whether it is the data of a
+// data url, decompressed. Other sources have no text.
+func contents(c *types.FileContents) (string, bool) {
+	if c == nil || c.Source == "" {
+		return "", true
+	}
+	if !strings.HasPrefix(c.Source, "data:") {
+		return "", false
+	}
+	d, err := dataurl.DecodeString(c.Source)
+	if err != nil {
+		return "", false
+	}
+	data := d.Data
+	if c.Compression == "gzip" {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", false
+		}
+		if data, err = io.ReadAll(r); err != nil {
+			return "", false
+		}
+	}
+	return string(data), true
+}
+
+// textDiff returns a unified diff of two texts, or a line with their sizes if
+// either is binary.
+func textDiff(name, from, to string) string {
+	if from == to {
+		return ""
+	}
+	if isBinary(from) || isBinary(to) {
+		return fmt.Sprintf("binary contents differ, %d -> %d bytes\n", len(from), len(to))
+	}
+	text, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        lines(from),
+		B:        lines(to),
+		FromFile: "remote " + name,
+		ToFile:   "local " + name,
+		Context:  3,
+	})
+	return text
+}
+
+// lines splits a text into lines that all end with a newline.
+func lines(s string) []string {
+	var ret []string
+	for line := range strings.Lines(s) {
+		if !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+		ret = append(ret, line)
+	}
+	return ret
+}
+
+func isBinary(s string) bool {
+	return !utf8.ValidString(s) || strings.ContainsRune(s, 0)
+}
+
+// attr returns a detail line for an attribute that differs.
+func attr(name, from, to string) []string {
+	if from == to {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s: %s -> %s", name, from, to)}
+}
+
+func mode(m *int) string {
+	if m == nil {
+		return "unset"
+	}
+	return fmt.Sprintf("%#o", *m)
+}
+
+func owner(u *types.NodeUser) string {
+	if u == nil {
+		return "unset"
+	}
+	return idOrName(u.ID, u.Name)
+}
+
+func group(g *types.NodeGroup) string {
+	if g == nil {
+		return "unset"
+	}
+	return idOrName(g.ID, g.Name)
+}
+
+func idOrName(id *int, name string) string {
+	if id != nil {
+		return fmt.Sprint(*id)
+	}
+	return name
+}
+
+func boolString(b *bool) string {
+	if b == nil {
+		return "unset"
+	}
+	return fmt.Sprint(*b)
+}
+
+func source(c *types.FileContents) string {
+	if c == nil || c.Source == "" {
+		return "unset"
+	}
+	if strings.HasPrefix(c.Source, "data:") {
+		return "inline data"
+	}
+	return c.Source
+}
+
+func hash(c *types.FileContents) string {
+	if c.Verification.Hash == nil {
+		return "unset"
+	}
+	return *c.Verification.Hash
+}
+
+func value(v any) string {
+	if v == nil {
+		return "unset"
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+func isList(v any) bool {
+	_, ok := v.([]any)
+	return ok
+}
+
+func listStrings(v any) []string {
+	items, _ := v.([]any)
+	var ret []string
+	for _, item := range items {
+		ret = append(ret, value(item))
+	}
+	return ret
+}
+
+func union[V any](a, b map[string]V) map[string]V {
+	ret := maps.Clone(a)
+	if ret == nil {
+		ret = make(map[string]V)
+	}
+	maps.Copy(ret, b)
+	return ret
+}
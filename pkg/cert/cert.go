@@ -1,97 +1,277 @@
 package cert
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
-	"io"
+	"math/big"
 	"net"
+	"net/mail"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func writeCertificate(filePath string, cmd *exec.Cmd) error {
-	reader, err := cmd.StdoutPipe()
+type keyPair struct {
+	cert   *x509.Certificate
+	signer crypto.Signer
+}
+
+// ErrCertificate is returned when a certificate or key pair cannot be issued.
+var ErrCertificate = errors.New("certificate error")
+
+func GenerateCaCert(outputDir, csrPath, name string) error {
+	err := generateCaCert(filepath.Join(outputDir, name), csrPath)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: generating ca certificate from %s: %w", ErrCertificate, csrPath, err)
+	}
+	log.Infof("generated CA cert: %s/%s{,-key}.pem", outputDir, name)
+	return nil
+}
+
+func GenerateCertWithConfig(csrPath, caConfig, caPublic, caKey, outputDir, name, profile string) error {
+	err := generateCert(outputDir+"/"+name, csrPath, caConfig, caPublic, caKey, profile)
+	if err != nil {
+		return fmt.Errorf("%w: generating %s certificate: %s from csr: %s using CA file pair [%s:%s] with CA-config %s: %w", ErrCertificate, profile, outputDir+"/"+name+"{,-key.pem}", csrPath, caPublic, caKey, caConfig, err)
 	}
+	log.Infof("generated cert: %s/%s{,-key}.pem (%s)", outputDir, name, profile)
+	return nil
+}
+
+func GenerateCert(csrPath, caDir, outputDir, name, profile string) error {
+	return GenerateCertWithConfig(csrPath, caDir+"/ca-config.json", caDir+"/ca.pem", caDir+"/ca-key.pem", outputDir, name, profile)
+}
 
-	err = cmd.Start()
+func generateCaCert(base, csrPath string) error {
+	req, err := readCertificateRequest(csrPath)
 	if err != nil {
 		return err
 	}
 
-	certPem := exec.Command("cfssljson", "-bare", filePath)
-	writer, err := certPem.StdinPipe()
+	expiry := ""
+	template := newTemplate(req)
+	template.IsCA = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	if req.CA != nil {
+		expiry = req.CA.Expiry
+		template.MaxPathLen = req.CA.PathLen
+		template.MaxPathLenZero = req.CA.PathLenZero
+	}
+
+	validity, err := parseExpiry(expiry, defaultCaExpiry)
+	if err != nil {
+		return fmt.Errorf("parsing ca expiry: %w", err)
+	}
+	template.NotAfter = template.NotBefore.Add(validity)
+
+	key, err := generateKey(req.Key)
 	if err != nil {
 		return err
 	}
 
-	err = certPem.Start()
+	return issue(base, req, template, &keyPair{cert: template, signer: key}, key)
+}
+
+func generateCert(base, csrPath, caConfig, caPublic, caKey, profileName string) error {
+	req, err := readCertificateRequest(csrPath)
 	if err != nil {
 		return err
 	}
 
-	_, err = io.Copy(writer, reader)
+	profile, err := readSigningProfile(caConfig, profileName)
 	if err != nil {
 		return err
 	}
 
-	err = writer.Close()
+	ca, err := loadKeyPair(caPublic, caKey)
 	if err != nil {
 		return err
 	}
 
-	err = cmd.Wait()
+	validity, err := parseExpiry(profile.Expiry, defaultExpiry)
+	if err != nil {
+		return fmt.Errorf("parsing expiry of profile %s: %w", profileName, err)
+	}
+
+	template := newTemplate(req)
+	template.NotAfter = template.NotBefore.Add(validity)
+	template.KeyUsage, template.ExtKeyUsage, err = profile.usages()
 	if err != nil {
 		return err
 	}
+	if profile.CAConstraint.IsCA {
+		template.IsCA = true
+	}
 
-	err = certPem.Wait()
+	key, err := generateKey(req.Key)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	return issue(base, req, template, ca, key)
 }
 
-func GenerateCaCert(outputDir, csrPath, name string) {
-	cmd := exec.Command("cfssl", "gencert", "-initca", csrPath)
+// newTemplate fills in the fields shared by CA and leaf certificates. Hosts
+// are sorted into DNS, IP, email and URI SANs the same way cfssl does.
+func newTemplate(req *CertificateRequest) *x509.Certificate {
+	template := &x509.Certificate{
+		Subject:               req.subject(),
+		NotBefore:             time.Now().Add(-5 * time.Minute).UTC(),
+		BasicConstraintsValid: true,
+	}
 
-	err := writeCertificate(filepath.Join(outputDir, name), cmd)
-	if err != nil {
-		log.WithError(err).Fatalf("generating ca certificate from %s", csrPath)
+	for _, host := range req.Hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if email, err := mail.ParseAddress(host); err == nil && email.Address == host {
+			template.EmailAddresses = append(template.EmailAddresses, host)
+		} else if uri, err := url.ParseRequestURI(host); err == nil && uri.Scheme != "" && uri.Host != "" {
+			template.URIs = append(template.URIs, uri)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
 	}
-	log.Infof("generated CA cert: %s/%s{,-key}.pem", outputDir, name)
+	return template
 }
 
-func GenerateCertWithConfig(csrPath, caConfig, caPublic, caKey, outputDir, name, profile string) {
-	cmd := exec.Command("cfssl",
-		"gencert",
-		"-ca="+caPublic,
-		"-ca-key="+caKey,
-		"-config="+caConfig,
-		"-profile="+profile,
-		csrPath)
+func issue(base string, req *CertificateRequest, template *x509.Certificate, ca *keyPair, key crypto.Signer) error {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 159))
+	if err != nil {
+		return err
+	}
+	template.SerialNumber = serial
+
+	pubBytes, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return err
+	}
+	ski := sha1.Sum(pubBytes)
+	template.SubjectKeyId = ski[:]
 
-	err := writeCertificate(outputDir+"/"+name, cmd)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.signer)
 	if err != nil {
-		log.WithError(err).Fatalf("generating %s certificate: %s from csr: %s using CA file pair [%s:%s] with CA-config %s", profile, outputDir+"/"+name+"{,-key.pem}", csrPath, caPublic, caKey, caConfig)
+		return fmt.Errorf("signing certificate: %w", err)
 	}
-	log.Infof("generated cert: %s/%s{,-key}.pem (%s)", outputDir, name, profile)
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:        template.Subject,
+		DNSNames:       template.DNSNames,
+		IPAddresses:    template.IPAddresses,
+		EmailAddresses: template.EmailAddresses,
+		URIs:           template.URIs,
+	}, key)
+	if err != nil {
+		return fmt.Errorf("creating certificate request for %s: %w", req.CN, err)
+	}
+
+	keyBlock, err := marshalKey(key)
+	if err != nil {
+		return err
+	}
+
+	// Same layout as `cfssljson -bare <base>`.
+	if err := os.WriteFile(base+".pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(base+"-key.pem", pem.EncodeToMemory(keyBlock), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(base+".csr", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}), 0o644)
+}
+
+func generateKey(req KeyRequest) (crypto.Signer, error) {
+	switch req.Algo {
+	case "rsa":
+		size := req.Size
+		if size == 0 {
+			size = 2048
+		}
+		return rsa.GenerateKey(rand.Reader, size)
+	case "ecdsa", "":
+		switch req.Size {
+		case 0, 256:
+			return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		case 384:
+			return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		case 521:
+			return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+		}
+		return nil, fmt.Errorf("unsupported ecdsa key size: %d", req.Size)
+	}
+	return nil, fmt.Errorf("unsupported key algorithm: %s", req.Algo)
 }
-func GenerateCert(csrPath, caDir, outputDir, name, profile string) {
-	GenerateCertWithConfig(csrPath, caDir+"/ca-config.json", caDir+"/ca.pem", caDir+"/ca-key.pem", outputDir, name, profile)
+
+func marshalKey(key crypto.Signer) (*pem.Block, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}, nil
+	case *ecdsa.PrivateKey:
+		b, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", key)
 }
 
-func GenerateKeyPair(outputDir, name string, bitSize int) {
+func loadKeyPair(certPath, keyPath string) (*keyPair, error) {
+	certFile, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certFile)
+	if block == nil {
+		return nil, fmt.Errorf("decoding certificate PEM %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate %s: %w", certPath, err)
+	}
+
+	keyFile, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ = pem.Decode(keyFile)
+	if block == nil {
+		return nil, fmt.Errorf("decoding key PEM %s", keyPath)
+	}
+
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing key %s: %w", keyPath, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type in %s", keyPath)
+	}
+	return &keyPair{cert: cert, signer: signer}, nil
+}
+
+func GenerateKeyPair(outputDir, name string, bitSize int) error {
 	key, err := rsa.GenerateKey(rand.Reader, bitSize)
 	if err != nil {
-		log.WithError(err).Fatalf("generating private key %s", name)
+		return fmt.Errorf("%w: generating private key %s: %w", ErrCertificate, name, err)
 	}
 
 	keyPEM := pem.EncodeToMemory(
@@ -103,7 +283,7 @@ func GenerateKeyPair(outputDir, name string, bitSize int) {
 
 	pubBytes, err := x509.MarshalPKIXPublicKey(key.Public())
 	if err != nil {
-		log.WithError(err).Fatalf("generating public key %s", name)
+		return fmt.Errorf("%w: generating public key %s: %w", ErrCertificate, name, err)
 	}
 
 	pubPEM := pem.EncodeToMemory(
@@ -115,15 +295,16 @@ func GenerateKeyPair(outputDir, name string, bitSize int) {
 
 	// Write private key to file.
 	if err := os.WriteFile(filepath.Join(outputDir, name+".key"), keyPEM, 0600); err != nil {
-		log.WithError(err).Fatalf("writing private key %s to file", name)
+		return fmt.Errorf("writing private key %s to file: %w", name, err)
 	}
 
 	// Write public key to file.
 	if err := os.WriteFile(filepath.Join(outputDir, name+".pub"), pubPEM, 0644); err != nil {
-		log.WithError(err).Fatalf("writing public key %s to file", name)
+		return fmt.Errorf("writing public key %s to file: %w", name, err)
 	}
 
 	log.Infof("generated keypair: %s/%s.{pub,key}", outputDir, name)
+	return nil
 }
 
 func GetSubjectAlternativeNames(certName string) ([]string, []net.IP, error) {
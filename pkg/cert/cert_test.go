@@ -0,0 +1,90 @@
+package cert
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nais/onprem/nitro/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const caConfig = `{
+  "signing": {
+    "default": {"expiry": "8760h"},
+    "profiles": {
+      "server": {"usages": ["signing", "key encipherment", "server auth"]},
+      "peer": {"usages": ["signing", "key encipherment", "server auth", "client auth"], "expiry": "720h"}
+    }
+  }
+}`
+
+func TestGenerateCertWithConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "ca-csr.json", `{"CN": "kubernetes", "key": {"algo": "rsa", "size": 2048}, "names": [{"O": "nais"}]}`)
+	writeFile(t, dir, "etcd-csr.json", `{"CN": "etcd", "hosts": ["etcd1.domain.local", "10.0.0.1"], "key": {"algo": "ecdsa", "size": 256}}`)
+	writeFile(t, dir, "ca-config.json", caConfig)
+
+	require.NoError(t, GenerateCaCert(dir, filepath.Join(dir, "ca-csr.json"), "ca"))
+	assert.True(t, utils.CertificatePairExists("ca", dir))
+
+	require.NoError(t, GenerateCert(filepath.Join(dir, "etcd-csr.json"), dir, dir, "peer-etcd1", "peer"))
+	assert.True(t, utils.CertificatePairExists("peer-etcd1", dir))
+
+	dns, ips, err := GetSubjectAlternativeNames(filepath.Join(dir, "peer-etcd1.pem"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"etcd1.domain.local"}, dns)
+	assert.Equal(t, "10.0.0.1", ips[0].String())
+
+	ca, err := loadKeyPair(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	require.NoError(t, err)
+	assert.True(t, ca.cert.IsCA)
+
+	peer, err := loadKeyPair(filepath.Join(dir, "peer-etcd1.pem"), filepath.Join(dir, "peer-etcd1-key.pem"))
+	require.NoError(t, err)
+	assert.NoError(t, peer.cert.CheckSignatureFrom(ca.cert))
+	assert.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}, peer.cert.ExtKeyUsage)
+	assert.Equal(t, float64(720), peer.cert.NotAfter.Sub(peer.cert.NotBefore).Hours())
+}
+
+func TestGenerateCaCertPathLen(t *testing.T) {
+	for name, tc := range map[string]struct {
+		ca             string
+		maxPathLen     int
+		maxPathLenZero bool
+	}{
+		"no pathlen":  {ca: `{"expiry": "87600h"}`, maxPathLen: -1},
+		"pathlen":     {ca: `{"pathlen": 1}`, maxPathLen: 1},
+		"pathlenzero": {ca: `{"pathlen": 0, "pathlenzero": true}`, maxPathLen: 0, maxPathLenZero: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, dir, "ca-csr.json", `{"CN": "kubernetes", "key": {"algo": "ecdsa", "size": 256}, "ca": `+tc.ca+`}`)
+
+			require.NoError(t, GenerateCaCert(dir, filepath.Join(dir, "ca-csr.json"), "ca"))
+			ca, err := loadKeyPair(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.maxPathLen, ca.cert.MaxPathLen)
+			assert.Equal(t, tc.maxPathLenZero, ca.cert.MaxPathLenZero)
+		})
+	}
+}
+
+func TestReadSigningProfileDefaults(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "ca-config.json", caConfig)
+
+	profile, err := readSigningProfile(filepath.Join(dir, "ca-config.json"), "server")
+	require.NoError(t, err)
+	assert.Equal(t, "8760h", profile.Expiry)
+
+	_, err = readSigningProfile(filepath.Join(dir, "ca-config.json"), "client")
+	assert.Error(t, err)
+}
+
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+}
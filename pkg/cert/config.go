@@ -0,0 +1,172 @@
+package cert
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// defaultCaExpiry and defaultExpiry mirror the defaults used by cfssl, so
+// certificates issued from existing csr/ca-config files keep their lifetime.
+const (
+	defaultCaExpiry = 43800 * time.Hour
+	defaultExpiry   = 168 * time.Hour
+)
+
+// CertificateRequest is the cfssl csr json format, e.g. ca-csr.json.
+type CertificateRequest struct {
+	CN    string        `json:"CN"`
+	Hosts []string      `json:"hosts"`
+	Key   KeyRequest    `json:"key"`
+	Names []Name        `json:"names"`
+	CA    *CAConstraint `json:"ca,omitempty"`
+}
+
+type KeyRequest struct {
+	Algo string `json:"algo"`
+	Size int    `json:"size"`
+}
+
+type Name struct {
+	C  string `json:"C"`
+	ST string `json:"ST"`
+	L  string `json:"L"`
+	O  string `json:"O"`
+	OU string `json:"OU"`
+}
+
+type CAConstraint struct {
+	Expiry      string `json:"expiry"`
+	PathLen     int    `json:"pathlen"`
+	PathLenZero bool   `json:"pathlenzero"`
+}
+
+// SigningConfig is the cfssl ca-config json format.
+type SigningConfig struct {
+	Signing struct {
+		Default  *Profile           `json:"default"`
+		Profiles map[string]Profile `json:"profiles"`
+	} `json:"signing"`
+}
+
+type Profile struct {
+	Usages       []string `json:"usages"`
+	Expiry       string   `json:"expiry"`
+	CAConstraint struct {
+		IsCA bool `json:"is_ca"`
+	} `json:"ca_constraint"`
+}
+
+var keyUsages = map[string]x509.KeyUsage{
+	"signing":            x509.KeyUsageDigitalSignature,
+	"digital signature":  x509.KeyUsageDigitalSignature,
+	"content commitment": x509.KeyUsageContentCommitment,
+	"key encipherment":   x509.KeyUsageKeyEncipherment,
+	"key agreement":      x509.KeyUsageKeyAgreement,
+	"data encipherment":  x509.KeyUsageDataEncipherment,
+	"cert sign":          x509.KeyUsageCertSign,
+	"crl sign":           x509.KeyUsageCRLSign,
+	"encipher only":      x509.KeyUsageEncipherOnly,
+	"decipher only":      x509.KeyUsageDecipherOnly,
+}
+
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"any":              x509.ExtKeyUsageAny,
+	"server auth":      x509.ExtKeyUsageServerAuth,
+	"client auth":      x509.ExtKeyUsageClientAuth,
+	"code signing":     x509.ExtKeyUsageCodeSigning,
+	"email protection": x509.ExtKeyUsageEmailProtection,
+	"s/mime":           x509.ExtKeyUsageEmailProtection,
+	"ipsec end system": x509.ExtKeyUsageIPSECEndSystem,
+	"ipsec tunnel":     x509.ExtKeyUsageIPSECTunnel,
+	"ipsec user":       x509.ExtKeyUsageIPSECUser,
+	"timestamping":     x509.ExtKeyUsageTimeStamping,
+	"ocsp signing":     x509.ExtKeyUsageOCSPSigning,
+	"microsoft sgc":    x509.ExtKeyUsageMicrosoftServerGatedCrypto,
+	"netscape sgc":     x509.ExtKeyUsageNetscapeServerGatedCrypto,
+}
+
+func readCertificateRequest(path string) (*CertificateRequest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &CertificateRequest{}
+	if err := json.Unmarshal(b, req); err != nil {
+		return nil, fmt.Errorf("parsing csr %s: %w", path, err)
+	}
+	return req, nil
+}
+
+func readSigningProfile(path, name string) (*Profile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &SigningConfig{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("parsing ca config %s: %w", path, err)
+	}
+
+	profile, ok := cfg.Signing.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("profile %s not found in %s", name, path)
+	}
+
+	if cfg.Signing.Default != nil {
+		if profile.Expiry == "" {
+			profile.Expiry = cfg.Signing.Default.Expiry
+		}
+		if len(profile.Usages) == 0 {
+			profile.Usages = cfg.Signing.Default.Usages
+		}
+	}
+	return &profile, nil
+}
+
+func (r *CertificateRequest) subject() pkix.Name {
+	name := pkix.Name{CommonName: r.CN}
+	for _, n := range r.Names {
+		appendIfSet(&name.Country, n.C)
+		appendIfSet(&name.Province, n.ST)
+		appendIfSet(&name.Locality, n.L)
+		appendIfSet(&name.Organization, n.O)
+		appendIfSet(&name.OrganizationalUnit, n.OU)
+	}
+	return name
+}
+
+func (p *Profile) usages() (x509.KeyUsage, []x509.ExtKeyUsage, error) {
+	var ku x509.KeyUsage
+	var eku []x509.ExtKeyUsage
+	for _, usage := range p.Usages {
+		if u, ok := keyUsages[usage]; ok {
+			ku |= u
+			continue
+		}
+		if u, ok := extKeyUsages[usage]; ok {
+			eku = append(eku, u)
+			continue
+		}
+		return 0, nil, fmt.Errorf("unknown key usage: %s", usage)
+	}
+	return ku, eku, nil
+}
+
+func parseExpiry(expiry string, fallback time.Duration) (time.Duration, error) {
+	if expiry == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(expiry)
+}
+
+func appendIfSet(s *[]string, v string) {
+	if v != "" {
+		*s = append(*s, v)
+	}
+}
@@ -12,26 +12,115 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func ensureKubeletCerts(hosts []string, caDir string, ssh *ssh.Client) {
+// certRequest is a certificate or key pair that must exist in dir, and how to
+// issue it when it does not.
+type certRequest struct {
+	dir     string
+	name    string
+	keyPair bool
+	// valid is an optional extra check of an existing certificate, e.g. its SANs.
+	valid func() bool
+	issue func() error
+}
+
+func (r certRequest) needed() bool {
+	if r.keyPair {
+		return !utils.KeyPairExists(r.name, r.dir)
+	}
+	if !utils.CertificatePairExists(r.name, r.dir) {
+		return true
+	}
+	return r.valid != nil && !r.valid()
+}
+
+func issueNeeded(requests []certRequest) error {
+	for _, r := range requests {
+		if r.needed() {
+			if err := r.issue(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func neededNames(requests []certRequest) []string {
+	var names []string
+	for _, r := range requests {
+		if r.needed() {
+			names = append(names, r.name)
+		}
+	}
+	return names
+}
+
+func ensureKubeletCerts(hosts []string, caDir string, ssh *ssh.Client) error {
 	log.Info("ensuring kubelet certs")
 	for _, host := range hosts {
-		ensureKubeletCert(host, caDir, ssh)
+		if err := ensureKubeletCert(host, caDir, ssh); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func ensureKubeletCert(hostname, caDir string, ssh *ssh.Client) {
+func downloadKubeletCert(hostname, dir string, ssh *ssh.Client) error {
+	if err := ssh.DownloadFile(hostname, filepath.Join(dir, "kubelet.pem"), "/etc/kubernetes/pki/kubelet.pem"); err != nil {
+		return err
+	}
+	return ssh.DownloadFile(hostname, filepath.Join(dir, "kubelet-key.pem"), "/etc/kubernetes/pki/kubelet-key.pem")
+}
+
+func kubeletCertRequest(certDir, csrDir, caDir string) certRequest {
+	return certRequest{
+		dir:  certDir,
+		name: "kubelet",
+		issue: func() error {
+			return cert.GenerateCert(csrDir+"/kubelet-csr.json", caDir, certDir, "kubelet", "client")
+		},
+	}
+}
+
+func ensureKubeletCert(hostname, caDir string, ssh *ssh.Client) error {
 	hostDir := fmt.Sprintf("output/%s", hostname)
-	ssh.DownloadFile(hostname, filepath.Join(hostDir, "kubelet.pem"), "/etc/kubernetes/pki/kubelet.pem")
-	ssh.DownloadFile(hostname, filepath.Join(hostDir, "kubelet-key.pem"), "/etc/kubernetes/pki/kubelet-key.pem")
+	if err := downloadKubeletCert(hostname, hostDir, ssh); err != nil {
+		return err
+	}
 
-	if !utils.CertificatePairExists("kubelet", hostDir) {
-		cert.GenerateCert(hostDir+"/kubelet-csr.json", caDir, hostDir, "kubelet", "client")
+	if err := issueNeeded([]certRequest{kubeletCertRequest(hostDir, hostDir, caDir)}); err != nil {
+		return err
 	}
 
 	log.Infof("ensured kubelet certificate for node %s", hostname)
+	return nil
+}
+
+// etcdCertRequests are the certificates of an etcd node. They are all kept in
+// the apiserver dir, and reissued when the server certificate does not have
+// every etcd host as SAN.
+func etcdCertRequests(host string, hosts []string, certDir, csrDir string) []certRequest {
+	shortname := strings.Split(host, ".")[0]
+	valid := func() bool { return verifySubjectAltNames(hosts, "server", certDir) }
+
+	var requests []certRequest
+	for _, c := range []struct{ name, profile string }{
+		{"peer-" + shortname, "peer"},
+		{"server", "server"},
+		{"etcd-client", "client"},
+	} {
+		requests = append(requests, certRequest{
+			dir:   certDir,
+			name:  c.name,
+			valid: valid,
+			issue: func() error {
+				return cert.GenerateCertWithConfig(csrDir+"/etcd-csr.json", csrDir+"/ca-config.json", certDir+"/ca.pem", certDir+"/ca-key.pem", certDir, c.name, c.profile)
+			},
+		})
+	}
+	return requests
 }
 
-func ensureEtcdCerts(hosts []string, apiServerDir string, ssh *ssh.Client) {
+func ensureEtcdCerts(hosts []string, apiServerDir string, ssh *ssh.Client) error {
 
 	for _, host := range hosts {
 		workingDir := "output/" + host
@@ -39,27 +128,25 @@ func ensureEtcdCerts(hosts []string, apiServerDir string, ssh *ssh.Client) {
 			log.Infof("could not download files from apiserver: %v", err)
 		}
 
-		shortname := strings.Split(host, ".")[0]
-		if !utils.CertificatePairExists("peer-"+shortname, apiServerDir) || !verifySubjectAltNames(hosts, "server", apiServerDir) {
-			cert.GenerateCertWithConfig(workingDir+"/etcd-csr.json", workingDir+"/ca-config.json", apiServerDir+"/ca.pem", apiServerDir+"/ca-key.pem", apiServerDir, "peer-"+shortname, "peer")
-		}
-		if !utils.CertificatePairExists("server", apiServerDir) || !verifySubjectAltNames(hosts, "server", apiServerDir) {
-			cert.GenerateCertWithConfig(workingDir+"/etcd-csr.json", workingDir+"/ca-config.json", apiServerDir+"/ca.pem", apiServerDir+"/ca-key.pem", apiServerDir, "server", "server")
-		}
-		if !utils.CertificatePairExists("etcd-client", apiServerDir) || !verifySubjectAltNames(hosts, "server", apiServerDir) {
-			cert.GenerateCertWithConfig(workingDir+"/etcd-csr.json", workingDir+"/ca-config.json", apiServerDir+"/ca.pem", apiServerDir+"/ca-key.pem", apiServerDir, "etcd-client", "client")
+		if err := issueNeeded(etcdCertRequests(host, hosts, apiServerDir, workingDir)); err != nil {
+			return err
 		}
 		log.Infof("ensured certs for etcd node %s", host)
 	}
+	return nil
 }
 
+// verifySubjectAltNames reports whether the certificate has exactly the given
+// hosts as SAN. A certificate that cannot be read does not match, so it is
+// reissued.
 func verifySubjectAltNames(hosts []string, name, apiServerDir string) bool {
 	// Retrieve X509v3 Subject Alternative Name from certificate
 	// Check if all nodes are present in SAN
 	certName := fmt.Sprintf("%s/%s.pem", apiServerDir, name)
 	dns, _, err := cert.GetSubjectAlternativeNames(certName)
 	if err != nil {
-		log.WithError(err).Fatalf("could not get SAN from %s", certName)
+		log.WithError(err).Warnf("could not get SAN from %s", certName)
+		return false
 	}
 
 	if len(dns) != len(hosts) {
@@ -77,37 +164,45 @@ func verifySubjectAltNames(hosts []string, name, apiServerDir string) bool {
 	return true
 }
 
-func ensureApiserverCerts(hostname string, ssh *ssh.Client) {
+func apiserverCertRequests(certDir, csrDir string) []certRequest {
+	requests := []certRequest{
+		{dir: certDir, name: "ca", issue: func() error {
+			return cert.GenerateCaCert(certDir, "output/ca-csr.json", "ca")
+		}},
+		{dir: certDir, name: "sa", keyPair: true, issue: func() error {
+			return cert.GenerateKeyPair(certDir, "sa", 2048)
+		}},
+		{dir: certDir, name: "front-proxy-ca", issue: func() error {
+			return cert.GenerateCaCert(certDir, csrDir+"/front-proxy-ca-csr.json", "front-proxy-ca")
+		}},
+		{dir: certDir, name: "front-proxy-client", issue: func() error {
+			return cert.GenerateCertWithConfig(csrDir+"/front-proxy-client-csr.json", csrDir+"/ca-config.json", certDir+"/front-proxy-ca.pem", certDir+"/front-proxy-ca-key.pem", certDir, "front-proxy-client", "client")
+		}},
+	}
+	for _, c := range []struct{ name, profile string }{
+		{"kubelet", "client"},
+		{"admin", "client"},
+		{"kube-proxy", "client"},
+		{"kube-apiserver-server", "server"},
+	} {
+		requests = append(requests, certRequest{dir: certDir, name: c.name, issue: func() error {
+			return cert.GenerateCert(csrDir+"/"+c.name+"-csr.json", certDir, certDir, c.name, c.profile)
+		}})
+	}
+	return requests
+}
+
+func ensureApiserverCerts(hostname string, ssh *ssh.Client) error {
 	log.Info("ensuring certificates for apiserver")
 	workingDir := fmt.Sprintf("output/%s", hostname)
 	if err := ssh.DownloadDir(hostname, workingDir, "/etc/kubernetes/pki"); err != nil {
 		log.Infof("could not download files from apiserver: %v", err)
 	}
 
-	if !utils.CertificatePairExists("ca", workingDir) {
-		cert.GenerateCaCert(workingDir, "output/ca-csr.json", "ca")
-	}
-	if !utils.KeyPairExists("sa", workingDir) {
-		cert.GenerateKeyPair(workingDir, "sa", 2048)
-	}
-	if !utils.CertificatePairExists("front-proxy-ca", workingDir) {
-		cert.GenerateCaCert(workingDir, workingDir+"/front-proxy-ca-csr.json", "front-proxy-ca")
-	}
-	if !utils.CertificatePairExists("front-proxy-client", workingDir) {
-		cert.GenerateCertWithConfig(workingDir+"/front-proxy-client-csr.json", workingDir+"/ca-config.json", workingDir+"/front-proxy-ca.pem", workingDir+"/front-proxy-ca-key.pem", workingDir, "front-proxy-client", "client")
-	}
-	if !utils.CertificatePairExists("kubelet", workingDir) {
-		cert.GenerateCert(workingDir+"/kubelet-csr.json", workingDir, workingDir, "kubelet", "client")
-	}
-	if !utils.CertificatePairExists("admin", workingDir) {
-		cert.GenerateCert(workingDir+"/admin-csr.json", workingDir, workingDir, "admin", "client")
-	}
-	if !utils.CertificatePairExists("kube-proxy", workingDir) {
-		cert.GenerateCert(workingDir+"/kube-proxy-csr.json", workingDir, workingDir, "kube-proxy", "client")
-	}
-	if !utils.CertificatePairExists("kube-apiserver-server", workingDir) {
-		cert.GenerateCert(workingDir+"/kube-apiserver-server-csr.json", workingDir, workingDir, "kube-apiserver-server", "server")
+	if err := issueNeeded(apiserverCertRequests(workingDir, workingDir)); err != nil {
+		return err
 	}
 
 	log.Info("ensured certificates for apiserver")
+	return nil
 }
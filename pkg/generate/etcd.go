@@ -0,0 +1,344 @@
+package generate
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/nais/onprem/nitro/pkg/ssh"
+	"github.com/nais/onprem/nitro/pkg/vars"
+	log "github.com/sirupsen/logrus"
+)
+
+const etcdctl = "/opt/etcd/bin/etcdctl --key=/etc/ssl/etcd/etcd-client-key.pem --cacert=/etc/ssl/etcd/ca.pem --cert=/etc/ssl/etcd/etcd-client.pem --endpoints=https://%s:2379 "
+
+type EtcdMember struct {
+	ID       uint64   `json:"ID"`
+	Name     string   `json:"name"`
+	PeerURLs []string `json:"peerURLs"`
+}
+
+// matches reports whether the member belongs to the given host. Members that
+// have been added but not started yet have no name, so the peer url is used
+// as a fallback.
+func (m EtcdMember) matches(hostname, ip string) bool {
+	if m.Name != "" {
+		return m.Name == strings.Split(hostname, ".")[0]
+	}
+	return slices.Contains(m.PeerURLs, etcdPeerURL(ip))
+}
+
+func etcdPeerURL(ip string) string {
+	return fmt.Sprintf("https://%s:2380", ip)
+}
+
+func EtcdMembers(host string, client *ssh.Client) ([]EtcdMember, error) {
+	list, err := etcdMemberListOf(host, client)
+	return list.Members, err
+}
+
+// etcdMemberList is the member list a member answers with: the cluster it is
+// a member of, itself, and the members.
+type etcdMemberList struct {
+	Header struct {
+		ClusterID uint64 `json:"cluster_id"`
+		MemberID  uint64 `json:"member_id"`
+	} `json:"header"`
+	Members []EtcdMember `json:"members"`
+}
+
+// self reports whether the host answered as a started member in its own list.
+func (l etcdMemberList) self(host string) bool {
+	return slices.ContainsFunc(l.Members, func(m EtcdMember) bool {
+		return m.ID == l.Header.MemberID && m.Name != "" && m.matches(host, "")
+	})
+}
+
+func etcdMemberListOf(host string, client *ssh.Client) (etcdMemberList, error) {
+	ip, err := client.Resolver().Resolve(host)
+	if err != nil {
+		return etcdMemberList{}, err
+	}
+	out, err := client.ExecuteCommandWithOutput(host, fmt.Sprintf(etcdctl, ip)+"member list --write-out=json")
+	if err != nil {
+		return etcdMemberList{}, err
+	}
+
+	var list etcdMemberList
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		return etcdMemberList{}, fmt.Errorf("parsing etcd member list from %s: %w", host, err)
+	}
+	return list, nil
+}
+
+// liveEtcdMembers returns the member list of the etcd cluster and the host it
+// was taken from, see trustedEtcdMembers.
+func liveEtcdMembers(hosts []string, client *ssh.Client) ([]EtcdMember, string, error) {
+	return trustedEtcdMembers(hosts, func(host string) (etcdMemberList, error) {
+		return etcdMemberListOf(host, client)
+	})
+}
+
+// trustedEtcdMembers asks every etcd host for its member list, and returns
+// the one of the first host that is a started member in it. A host that has
+// not joined yet is not, while one that bootstrapped a cluster of its own
+// answers for another cluster, so the hosts that answer must agree on the
+// cluster. It returns nil if no host answers, e.g. for a cluster that has not
+// been bootstrapped yet.
+func trustedEtcdMembers(hosts []string, list func(host string) (etcdMemberList, error)) ([]EtcdMember, string, error) {
+	var members []EtcdMember
+	var memberHost string
+	clusters := make(map[uint64][]string)
+	for _, host := range hosts {
+		l, err := list(host)
+		if err != nil {
+			log.WithError(err).Debugf("could not list etcd members from %s", host)
+			continue
+		}
+		clusters[l.Header.ClusterID] = append(clusters[l.Header.ClusterID], host)
+		if !l.self(host) {
+			log.Debugf("%s is not a started member of the etcd members it lists", host)
+			continue
+		}
+		if memberHost == "" {
+			members, memberHost = l.Members, host
+		}
+	}
+	if len(clusters) > 1 {
+		var answers []string
+		for _, id := range slices.Sorted(maps.Keys(clusters)) {
+			answers = append(answers, fmt.Sprintf("%s in cluster %x", strings.Join(clusters[id], ", "), id))
+		}
+		return nil, "", fmt.Errorf("%w: etcd hosts are members of different clusters: %s", ErrEtcdUnhealthy, strings.Join(answers, "; "))
+	}
+	if memberHost == "" && len(clusters) > 0 {
+		return nil, "", fmt.Errorf("%w: no etcd host is a started member of the cluster it answers for", ErrEtcdUnhealthy)
+	}
+	return members, memberHost, nil
+}
+
+// etcdMembershipChanges compares the live members with the etcd hosts in the
+// cluster file and returns the hosts that must be added and the members that
+// must be removed.
+func etcdMembershipChanges(members []EtcdMember, hosts []string, resolveIp func(string) (string, error)) ([]string, []EtcdMember, error) {
+	ips := make(map[string]string)
+	for _, host := range hosts {
+		ip, err := resolveIp(host)
+		if err != nil {
+			return nil, nil, err
+		}
+		ips[host] = ip
+	}
+
+	var joining []string
+	for _, host := range hosts {
+		if !slices.ContainsFunc(members, func(m EtcdMember) bool { return m.matches(host, ips[host]) }) {
+			joining = append(joining, host)
+		}
+	}
+
+	var leaving []EtcdMember
+	for _, member := range members {
+		if !slices.ContainsFunc(hosts, func(host string) bool { return member.matches(host, ips[host]) }) {
+			leaving = append(leaving, member)
+		}
+	}
+
+	return joining, leaving, nil
+}
+
+// etcdMembersAPI is the members api of an etcd cluster.
+type etcdMembersAPI interface {
+	Members() ([]EtcdMember, error)
+	AddMember(name, peerURL string) error
+	RemoveMember(member EtcdMember) error
+}
+
+// sshEtcdMembers is the members api of the etcd cluster, used with etcdctl
+// over ssh on a member.
+type sshEtcdMembers struct {
+	client *ssh.Client
+	host   string
+}
+
+func (e sshEtcdMembers) Members() ([]EtcdMember, error) {
+	return EtcdMembers(e.host, e.client)
+}
+
+func (e sshEtcdMembers) AddMember(name, peerURL string) error {
+	return e.etcdctl(fmt.Sprintf("member add %s --peer-urls=%s", name, peerURL))
+}
+
+func (e sshEtcdMembers) RemoveMember(member EtcdMember) error {
+	return e.etcdctl(fmt.Sprintf("member remove %x", member.ID))
+}
+
+func (e sshEtcdMembers) etcdctl(command string) error {
+	ip, err := e.client.Resolver().Resolve(e.host)
+	if err != nil {
+		return err
+	}
+	return e.client.ExecuteCommand(e.host, fmt.Sprintf(etcdctl, ip)+command)
+}
+
+// reconcileEtcdMembers makes the etcd members match the cluster file, see
+// changeEtcdMembers. Joining hosts are started with start, which must return
+// once etcd on the host is healthy. When the members changed, the returned
+// nodes contain every etcd host, so the existing members get the new config.
+func reconcileEtcdMembers(sshClient *ssh.Client, cluster string, nodes map[string][]string, start func(host string) error) (map[string][]string, error) {
+	clusterDef, err := vars.ParseCluster("clusters/" + cluster + ".yaml")
+	if err != nil {
+		return nil, err
+	}
+	etcdHosts := clusterDef.Hosts()["etcd"]
+	members, memberHost, err := liveEtcdMembers(etcdHosts, sshClient)
+	if err != nil {
+		return nil, err
+	}
+	if members == nil {
+		log.Warn("could not get etcd member list from any etcd node, skipping membership check")
+		return nodes, nil
+	}
+
+	configure := func(initialCluster string) error {
+		return regenerateEtcdConfigs(sshClient, cluster, initialCluster)
+	}
+	startMember := func(host string) error {
+		// a joining node may already have bootstrapped a single member cluster of its own
+		if err := sshClient.ExecuteCommand(host, "sudo systemctl stop etcd; sudo rm -rf /var/lib/etcd/member"); err != nil {
+			log.WithError(err).Warnf("cleaning etcd data dir on %s", host)
+		}
+		return start(host)
+	}
+	changed, err := changeEtcdMembers(sshEtcdMembers{client: sshClient, host: memberHost}, etcdHosts, sshClient.Resolver().Resolve, configure, startMember)
+	if err != nil || !changed {
+		return nodes, err
+	}
+	return joiningFirst(nodes, etcdHosts, nil), nil
+}
+
+// changeEtcdMembers makes the members match the hosts one member at a time,
+// so the cluster keeps its quorum: a joining host is added, configured to
+// join the live members and started, and must be a started member before the
+// next one is added. Only then are the leaving members removed, and the hosts
+// configured for the final members. Hosts that were added but not started by
+// an earlier run are started first. configure is given the initial cluster a
+// joining host must have, or "" for the one of the hosts. It reports whether
+// the members changed.
+func changeEtcdMembers(api etcdMembersAPI, hosts []string, resolveIp func(string) (string, error), configure func(initialCluster string) error, start func(host string) error) (bool, error) {
+	members, err := api.Members()
+	if err != nil {
+		return false, fmt.Errorf("listing etcd members: %w", err)
+	}
+	joining, leaving, err := etcdMembershipChanges(members, hosts, resolveIp)
+	if err != nil {
+		return false, err
+	}
+	unstarted, err := unstartedEtcdHosts(members, hosts, resolveIp)
+	if err != nil {
+		return false, err
+	}
+	if len(joining) == 0 && len(leaving) == 0 && len(unstarted) == 0 {
+		log.Info("etcd members match cluster file")
+		return false, nil
+	}
+
+	for _, host := range slices.Concat(unstarted, joining) {
+		shortname := strings.Split(host, ".")[0]
+		ip, err := resolveIp(host)
+		if err != nil {
+			return false, err
+		}
+		if !slices.Contains(unstarted, host) {
+			log.Infof("adding etcd member %s", shortname)
+			if err := api.AddMember(shortname, etcdPeerURL(ip)); err != nil {
+				return false, fmt.Errorf("adding etcd member %s: %w", shortname, err)
+			}
+		}
+
+		members, err := api.Members()
+		if err != nil {
+			return false, fmt.Errorf("listing etcd members: %w", err)
+		}
+		initialCluster, err := joiningInitialCluster(members, host, ip)
+		if err != nil {
+			return false, err
+		}
+		if err := configure(initialCluster); err != nil {
+			return false, err
+		}
+		log.Infof("starting etcd member %s", shortname)
+		if err := start(host); err != nil {
+			return false, fmt.Errorf("starting etcd member %s: %w", shortname, err)
+		}
+
+		members, err = api.Members()
+		if err != nil {
+			return false, fmt.Errorf("listing etcd members: %w", err)
+		}
+		if !slices.ContainsFunc(members, func(m EtcdMember) bool { return m.Name != "" && m.matches(host, ip) }) {
+			return false, fmt.Errorf("%w: etcd member %s has not started", ErrEtcdUnhealthy, shortname)
+		}
+	}
+
+	for _, member := range leaving {
+		log.Infof("removing etcd member %s (%x)", member.Name, member.ID)
+		if err := api.RemoveMember(member); err != nil {
+			return false, fmt.Errorf("removing etcd member %s: %w", member.Name, err)
+		}
+	}
+	return true, configure("")
+}
+
+// unstartedEtcdHosts returns the hosts that are members, but have not been
+// started.
+func unstartedEtcdHosts(members []EtcdMember, hosts []string, resolveIp func(string) (string, error)) ([]string, error) {
+	var ret []string
+	for _, host := range hosts {
+		ip, err := resolveIp(host)
+		if err != nil {
+			return nil, err
+		}
+		if slices.ContainsFunc(members, func(m EtcdMember) bool { return m.Name == "" && m.matches(host, ip) }) {
+			ret = append(ret, host)
+		}
+	}
+	return ret, nil
+}
+
+// joiningInitialCluster returns the --initial-cluster of a joining host: the
+// live members, with the host that has not started yet by its short name.
+// etcd refuses to join a cluster whose members differ from it.
+func joiningInitialCluster(members []EtcdMember, host, ip string) (string, error) {
+	var ret []string
+	for _, m := range members {
+		name := m.Name
+		if name == "" {
+			if !m.matches(host, ip) {
+				return "", fmt.Errorf("%w: etcd member %x has not started", ErrEtcdUnhealthy, m.ID)
+			}
+			name = strings.Split(host, ".")[0]
+		}
+		for _, url := range m.PeerURLs {
+			ret = append(ret, name+"="+url)
+		}
+	}
+	return strings.Join(ret, ","), nil
+}
+
+// joiningFirst returns the nodes with every etcd host, the joining ones first.
+func joiningFirst(nodes map[string][]string, etcdHosts, joining []string) map[string][]string {
+	ret := make(map[string][]string)
+	for role, hosts := range nodes {
+		ret[role] = hosts
+	}
+	ret["etcd"] = slices.Clone(joining)
+	for _, host := range etcdHosts {
+		if !slices.Contains(joining, host) {
+			ret["etcd"] = append(ret["etcd"], host)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,204 @@
+package generate
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEtcdMembershipChanges(t *testing.T) {
+	ips := map[string]string{
+		"etcd1.domain.local": "10.0.0.1",
+		"etcd2.domain.local": "10.0.0.2",
+		"etcd4.domain.local": "10.0.0.4",
+	}
+	resolveIp := func(host string) (string, error) { return ips[host], nil }
+
+	members := []EtcdMember{
+		{ID: 1, Name: "etcd1", PeerURLs: []string{"https://10.0.0.1:2380"}},
+		{ID: 2, Name: "etcd2", PeerURLs: []string{"https://10.0.0.2:2380"}},
+		{ID: 3, Name: "etcd3", PeerURLs: []string{"https://10.0.0.3:2380"}},
+	}
+
+	joining, leaving, err := etcdMembershipChanges(members, []string{"etcd1.domain.local", "etcd2.domain.local", "etcd4.domain.local"}, resolveIp)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"etcd4.domain.local"}, joining)
+	assert.Equal(t, []EtcdMember{members[2]}, leaving)
+
+	// a member that has been added but not started yet has no name
+	members[2] = EtcdMember{ID: 4, PeerURLs: []string{"https://10.0.0.4:2380"}}
+	joining, leaving, err = etcdMembershipChanges(members, []string{"etcd1.domain.local", "etcd2.domain.local", "etcd4.domain.local"}, resolveIp)
+	assert.NoError(t, err)
+	assert.Empty(t, joining)
+	assert.Empty(t, leaving)
+}
+
+func memberList(cluster, self uint64, members []EtcdMember) etcdMemberList {
+	var l etcdMemberList
+	l.Header.ClusterID = cluster
+	l.Header.MemberID = self
+	l.Members = members
+	return l
+}
+
+func TestTrustedEtcdMembers(t *testing.T) {
+	cluster := etcdMembers("etcd1", "etcd2", "etcd3")
+	joined := append(slices.Clone(cluster), EtcdMember{ID: 4, PeerURLs: []string{etcdPeerURL(etcdIPs["etcd4"])}})
+	foreign := []EtcdMember{{ID: 40, Name: "etcd4", PeerURLs: []string{etcdPeerURL(etcdIPs["etcd4"])}}}
+
+	for name, tc := range map[string]struct {
+		lists   map[string]etcdMemberList
+		members []EtcdMember
+		host    string
+		err     string
+	}{
+		"first that answers": {
+			lists:   map[string]etcdMemberList{"etcd2": memberList(0xa, 2, cluster), "etcd3": memberList(0xa, 3, cluster)},
+			members: cluster,
+			host:    "etcd2",
+		},
+		"not joined yet": {
+			lists:   map[string]etcdMemberList{"etcd4": memberList(0xa, 4, joined), "etcd1": memberList(0xa, 1, joined)},
+			members: joined,
+			host:    "etcd1",
+		},
+		"foreign single member cluster": {
+			lists: map[string]etcdMemberList{"etcd4": memberList(0xf, 40, foreign), "etcd1": memberList(0xa, 1, cluster), "etcd2": memberList(0xa, 2, cluster)},
+			err:   "etcd hosts are members of different clusters: etcd1, etcd2 in cluster a; etcd4 in cluster f",
+		},
+		"no started member": {
+			lists: map[string]etcdMemberList{"etcd4": memberList(0xa, 4, joined)},
+			err:   "no etcd host is a started member",
+		},
+		"none answer": {},
+	} {
+		t.Run(name, func(t *testing.T) {
+			members, host, err := trustedEtcdMembers([]string{"etcd4", "etcd1", "etcd2", "etcd3"}, func(host string) (etcdMemberList, error) {
+				l, ok := tc.lists[host]
+				if !ok {
+					return etcdMemberList{}, errors.New("connection refused")
+				}
+				return l, nil
+			})
+			if tc.err != "" {
+				assert.ErrorIs(t, err, ErrEtcdUnhealthy)
+				assert.ErrorContains(t, err, tc.err)
+				assert.Nil(t, members)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.members, members)
+			assert.Equal(t, tc.host, host)
+		})
+	}
+}
+
+// fakeEtcd is an etcd cluster whose members are started by start, and that
+// records the calls made to it and to configure and start.
+type fakeEtcd struct {
+	members []EtcdMember
+	calls   []string
+	nextID  uint64
+	// broken is a host that does not start
+	broken string
+}
+
+func (f *fakeEtcd) Members() ([]EtcdMember, error) {
+	return slices.Clone(f.members), nil
+}
+
+func (f *fakeEtcd) AddMember(name, peerURL string) error {
+	f.calls = append(f.calls, "add "+name)
+	f.nextID++
+	f.members = append(f.members, EtcdMember{ID: 100 + f.nextID, PeerURLs: []string{peerURL}})
+	return nil
+}
+
+func (f *fakeEtcd) RemoveMember(member EtcdMember) error {
+	f.calls = append(f.calls, "remove "+member.Name)
+	f.members = slices.DeleteFunc(f.members, func(m EtcdMember) bool { return m.ID == member.ID })
+	return nil
+}
+
+func (f *fakeEtcd) configure(initialCluster string) error {
+	f.calls = append(f.calls, "configure "+initialCluster)
+	return nil
+}
+
+func (f *fakeEtcd) start(host string) error {
+	f.calls = append(f.calls, "start "+host)
+	if host == f.broken {
+		return nil
+	}
+	for i, m := range f.members {
+		if m.Name == "" && slices.Contains(m.PeerURLs, etcdPeerURL(etcdIPs[host])) {
+			f.members[i].Name = host
+		}
+	}
+	return nil
+}
+
+var etcdIPs = map[string]string{"etcd1": "10.0.0.1", "etcd2": "10.0.0.2", "etcd3": "10.0.0.3", "etcd4": "10.0.0.4", "etcd5": "10.0.0.5"}
+
+func resolveEtcdIP(host string) (string, error) { return etcdIPs[host], nil }
+
+func etcdMembers(hosts ...string) []EtcdMember {
+	var ret []EtcdMember
+	for i, host := range hosts {
+		ret = append(ret, EtcdMember{ID: uint64(i + 1), Name: host, PeerURLs: []string{etcdPeerURL(etcdIPs[host])}})
+	}
+	return ret
+}
+
+func TestChangeEtcdMembers(t *testing.T) {
+	etcd := &fakeEtcd{members: etcdMembers("etcd1", "etcd2", "etcd3")}
+	changed, err := changeEtcdMembers(etcd, []string{"etcd1", "etcd4", "etcd5"}, resolveEtcdIP, etcd.configure, etcd.start)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []string{
+		"add etcd4",
+		"configure etcd1=https://10.0.0.1:2380,etcd2=https://10.0.0.2:2380,etcd3=https://10.0.0.3:2380,etcd4=https://10.0.0.4:2380",
+		"start etcd4",
+		"add etcd5",
+		"configure etcd1=https://10.0.0.1:2380,etcd2=https://10.0.0.2:2380,etcd3=https://10.0.0.3:2380,etcd4=https://10.0.0.4:2380,etcd5=https://10.0.0.5:2380",
+		"start etcd5",
+		"remove etcd2",
+		"remove etcd3",
+		"configure ",
+	}, etcd.calls)
+
+	etcd.calls = nil
+	changed, err = changeEtcdMembers(etcd, []string{"etcd1", "etcd4", "etcd5"}, resolveEtcdIP, etcd.configure, etcd.start)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Empty(t, etcd.calls)
+}
+
+func TestChangeEtcdMembersStopsOnUnstartedMember(t *testing.T) {
+	etcd := &fakeEtcd{members: etcdMembers("etcd1", "etcd2", "etcd3"), broken: "etcd4"}
+	_, err := changeEtcdMembers(etcd, []string{"etcd1", "etcd2", "etcd4", "etcd5"}, resolveEtcdIP, etcd.configure, etcd.start)
+	assert.ErrorIs(t, err, ErrEtcdUnhealthy)
+	assert.Equal(t, []string{
+		"add etcd4",
+		"configure etcd1=https://10.0.0.1:2380,etcd2=https://10.0.0.2:2380,etcd3=https://10.0.0.3:2380,etcd4=https://10.0.0.4:2380",
+		"start etcd4",
+	}, etcd.calls, "no member added or removed after one that did not start")
+
+	// the next run starts the member that was added, before adding another
+	etcd.broken = ""
+	etcd.calls = nil
+	_, err = changeEtcdMembers(etcd, []string{"etcd1", "etcd2", "etcd4", "etcd5"}, resolveEtcdIP, etcd.configure, etcd.start)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"configure etcd1=https://10.0.0.1:2380,etcd2=https://10.0.0.2:2380,etcd3=https://10.0.0.3:2380,etcd4=https://10.0.0.4:2380",
+		"start etcd4",
+		"add etcd5",
+		"configure etcd1=https://10.0.0.1:2380,etcd2=https://10.0.0.2:2380,etcd3=https://10.0.0.3:2380,etcd4=https://10.0.0.4:2380,etcd5=https://10.0.0.5:2380",
+		"start etcd5",
+		"remove etcd3",
+		"configure ",
+	}, etcd.calls)
+}
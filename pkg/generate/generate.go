@@ -1,13 +1,13 @@
 package generate
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
-	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
-	"strings"
+	"runtime"
+	"slices"
 
 	"github.com/nais/onprem/nitro/pkg/ssh"
 	"github.com/nais/onprem/nitro/pkg/templating"
@@ -15,118 +15,273 @@ import (
 	"github.com/nais/onprem/nitro/pkg/utils"
 	"github.com/nais/onprem/nitro/pkg/vars"
 	log "github.com/sirupsen/logrus"
+	"github.com/sourcegraph/conc/pool"
 )
 
 const OutputDir = "./output"
 
-func ClusterIgnitionFiles(sshClient *ssh.Client, cluster string, hosts []string) {
-	err := os.RemoveAll(OutputDir)
+func ClusterIgnitionFiles(sshClient *ssh.Client, cluster string, hosts []string) error {
+	err := cleanOutputDir(OutputDir)
 	if err != nil {
-		log.WithError(err).Fatal("deleting output dir")
+		return fmt.Errorf("cleaning output dir: %w", err)
 	}
-	log.Infof("deleted dir: %s", OutputDir)
+	log.Infof("cleaned dir: %s", OutputDir)
 
-	clusterFile := vars.ParseSliceYAML("clusters/" + cluster + ".yaml")
-	clusterWithLocation := vars.ParseClusterYAML("clusters/" + cluster + ".yaml")
+	clusterDef, err := vars.ParseCluster("clusters/" + cluster + ".yaml")
+	if err != nil {
+		return err
+	}
+	clusterFile := clusterDef.Hosts()
 
-	variables := vars.ParseVars(cluster, sshClient.IdentityFile(), clusterFile)
-	variables["hosts"] = utils.GenerateHosts(clusterWithLocation, nil)
+	layers, err := clusterVariables(sshClient, cluster, clusterDef)
+	if err != nil {
+		return err
+	}
+	state, err := etcdInitialClusterState(clusterFile["etcd"], sshClient)
+	if err != nil {
+		return err
+	}
+	layers.Set("etcd_initial_cluster_state", state)
+
+	renderer, err := templating.NewRenderer("templates")
+	if err != nil {
+		return err
+	}
+	checkOverlays(clusterDef)
 
-	templating.TemplateFiles("templates", "output", variables, false)
-	for role, roleNodes := range clusterWithLocation {
+	// keep rendering on unresolved variables, to report them all at once
+	var unresolved []error
+	variables, _ := vars.Flatten(layers.Cluster())
+	if err := renderer.TemplateFiles("templates", "output", variables, false); err != nil {
+		if !errors.Is(err, templating.ErrUnresolvedVariable) {
+			return err
+		}
+		unresolved = append(unresolved, err)
+	}
+	for role, roleNodes := range clusterDef.ByRole() {
 		for _, node := range roleNodes {
-			log.Infof("templating files for %s node %s\n", role, node)
-			nodeDir := "output/" + node.Hostname
-			variables["role"] = role
-			variables["hostname"] = node.Hostname
-			variables["hostname_short"] = strings.Split(node.Hostname, ".")[0]
-			variables["hostname_ip"] = vars.ResolveIP(node.Hostname)
-
-			variables["azure"] = "false"
-			if node.Location == "azure" {
-				variables["azure"] = "true"
+			if err := templateNode(renderer, role, node, layers, sshClient.Resolver()); err != nil {
+				if !errors.Is(err, templating.ErrUnresolvedVariable) {
+					return err
+				}
+				unresolved = append(unresolved, err)
 			}
-
-			templateDir := role
-			templating.TemplateFiles(path.Join("templates", templateDir), nodeDir, variables, true)
 		}
 	}
 	log.Info("finished templating")
 
-	if hits := recursiveGrep("./output", "<no value>"); hits != nil {
-		log.Errorf("found %d unresolved variables:", len(hits))
-		for _, hit := range hits {
-
-			log.Errorf("%s", hit)
+	if len(unresolved) > 0 {
+		messages := unresolvedVariables(unresolved)
+		log.Errorf("found %d unresolved variables:", len(messages))
+		for _, msg := range messages {
+			log.Error(msg)
 		}
-		os.Exit(1)
+		return fmt.Errorf("%w: found %d unresolved variables", templating.ErrUnresolvedVariable, len(messages))
 	}
 	log.Info("all variables resolved")
 
+	if err := reportUnusedVars(renderer, layers, clusterDef); err != nil {
+		return err
+	}
+
 	log.Infof("ensuring certificates")
 	filtered := utils.FilterHosts(clusterFile, hosts)
+	if len(filtered["apiserver"]) == 0 {
+		return fmt.Errorf("%w: apiserver must be included in hosts", vars.ErrInvalidConfig)
+	}
 	apiServerHost := filtered["apiserver"][0]
 	caDir := "output/" + apiServerHost
-	ensureApiserverCerts(apiServerHost, sshClient)
-	ensureKubeletCerts(filtered["worker"], caDir, sshClient)
-	ensureEtcdCerts(filtered["etcd"], caDir, sshClient)
+	if err := ensureApiserverCerts(apiServerHost, sshClient); err != nil {
+		return err
+	}
+	if err := ensureKubeletCerts(filtered["worker"], caDir, sshClient); err != nil {
+		return err
+	}
+	if err := ensureEtcdCerts(filtered["etcd"], caDir, sshClient); err != nil {
+		return err
+	}
 	log.Info("finished ensuring certificates")
 
 	log.Info("transpiling ignition files")
-	for _, host := range utils.Hostnames(filtered) {
-		log.Infof("processing node %s", host)
-		nodeDir := "output/" + host
-		src := filepath.Join(nodeDir, "config.ign.yaml")
-		dst := filepath.Join(nodeDir, "config.ign")
-		transpile.Run(src, dst, nodeDir)
-	}
+	return transpileNodes(clusterDef.ConfigFormat(), utils.Hostnames(filtered))
 }
 
-func recursiveGrep(root string, str string) []string {
-	var ret []string
-	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			log.WithError(err).Fatal("walking file tree")
-		}
-		if d != nil && !d.IsDir() {
-			if hits := search(path, str); hits != nil {
-				for _, hit := range hits {
-					ret = append(ret, fmt.Sprintf("line %d in file %s", hit, path))
-				}
-			}
+// regenerateEtcdConfigs renders, certifies and transpiles the etcd nodes again
+// after the etcd membership has been changed. All members are templated with
+// initial cluster state "existing"; running members ignore it and joining
+// members need it to avoid bootstrapping a cluster of their own. A non-empty
+// initialCluster replaces etcd_initial_cluster, for a member joining before
+// the members match the cluster file.
+func regenerateEtcdConfigs(sshClient *ssh.Client, cluster, initialCluster string) error {
+	log.Info("regenerating etcd configs")
+	clusterDef, err := vars.ParseCluster("clusters/" + cluster + ".yaml")
+	if err != nil {
+		return err
+	}
+	clusterFile := clusterDef.Hosts()
+
+	layers, err := clusterVariables(sshClient, cluster, clusterDef)
+	if err != nil {
+		return err
+	}
+	layers.Set("etcd_initial_cluster_state", "existing")
+	if initialCluster != "" {
+		layers.Set("etcd_initial_cluster", initialCluster)
+	}
+	renderer, err := templating.NewRenderer("templates")
+	if err != nil {
+		return err
+	}
+	for _, node := range clusterDef.Etcd {
+		if err := templateNode(renderer, "etcd", node, layers, sshClient.Resolver()); err != nil {
+			return err
 		}
-		return nil
-	})
+	}
+
+	caDir := "output/" + clusterFile["apiserver"][0]
+	if err := ensureEtcdCerts(clusterFile["etcd"], caDir, sshClient); err != nil {
+		return err
+	}
+	return transpileNodes(clusterDef.ConfigFormat(), clusterFile["etcd"])
+}
+
+func clusterVariables(sshClient *ssh.Client, cluster string, clusterDef *vars.Cluster) (*vars.Layers, error) {
+	layers, err := vars.ParseVars(cluster, sshClient.IdentityFile(), clusterDef, sshClient.Resolver())
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := utils.GenerateHosts(clusterDef.ByRole(), sshClient.Resolver().Resolve)
 	if err != nil {
-		log.WithError(err).Fatal("walking file tree")
+		return nil, err
 	}
+	layers.Set("hosts", hosts)
+	return layers, nil
+}
 
-	return ret
+// etcdInitialClusterState is "existing" once the etcd cluster has been
+// bootstrapped, "new" until then.
+func etcdInitialClusterState(etcdHosts []string, sshClient *ssh.Client) (string, error) {
+	members, _, err := liveEtcdMembers(etcdHosts, sshClient)
+	if err != nil {
+		return "", err
+	}
+	if members != nil {
+		return "existing", nil
+	}
+	return "new", nil
 }
 
-func search(file string, s string) (hits []int) {
-	f, err := os.Open(file)
+// NodeVars returns the layers of template vars of a node, as generate renders
+// its templates with.
+func NodeVars(sshClient *ssh.Client, cluster, hostname string) ([]vars.Layer, error) {
+	clusterDef, err := vars.ParseCluster("clusters/" + cluster + ".yaml")
 	if err != nil {
-		log.WithError(err).Fatal("opening file")
+		return nil, err
 	}
-	defer func(f *os.File) {
-		err := f.Close()
-		if err != nil {
-			log.WithError(err).Fatal("closing file")
-		}
-	}(f)
+	layers, err := clusterVariables(sshClient, cluster, clusterDef)
+	if err != nil {
+		return nil, err
+	}
+	state, err := etcdInitialClusterState(clusterDef.Hosts()["etcd"], sshClient)
+	if err != nil {
+		return nil, err
+	}
+	layers.Set("etcd_initial_cluster_state", state)
+	if hostname == "" {
+		return layers.Cluster(), nil
+	}
+	node, role, ok := clusterDef.Node(hostname)
+	if !ok {
+		return nil, fmt.Errorf("%w: host %s is not in the cluster file", vars.ErrInvalidConfig, hostname)
+	}
+	return nodeLayers(layers, role, node, sshClient.Resolver())
+}
 
-	scanner := bufio.NewScanner(f)
-	lineNum := 1
-	for scanner.Scan() {
-		if strings.Contains(scanner.Text(), s) {
-			hits = append(hits, lineNum)
+// nodeLayers returns the layers of the node followed by the vars describing
+// the node itself, which override them all.
+func nodeLayers(layers *vars.Layers, role string, node vars.Node, resolver vars.Resolver) ([]vars.Layer, error) {
+	ip, err := resolver.Resolve(node.Hostname)
+	if err != nil {
+		return nil, err
+	}
+	azure := "false"
+	if node.Location == "azure" {
+		azure = "true"
+	}
+	return append(layers.Node(role, node), vars.Layer{
+		Source:   vars.RuntimeSource,
+		Computed: true,
+		Vars: map[string]any{
+			"role":           role,
+			"hostname":       node.Hostname,
+			"hostname_short": node.ShortName(),
+			"hostname_ip":    ip,
+			"failure_domain": node.FailureDomain,
+			"location":       node.Location,
+			"azure":          azure,
+		},
+	}), nil
+}
+
+// templateNode renders the role templates for the node with its vars.
+func templateNode(renderer *templating.Renderer, role string, node vars.Node, layers *vars.Layers, resolver vars.Resolver) error {
+	log.Infof("templating files for %s node %s\n", role, node.Hostname)
+	nodeDir := "output/" + node.Hostname
+	nodeVars, err := nodeLayers(layers, role, node, resolver)
+	if err != nil {
+		return err
+	}
+	variables, _ := vars.Flatten(nodeVars)
+
+	roleDir := path.Join("templates", role)
+	var overlays []string
+	if node.Location != "" {
+		overlays = append(overlays, path.Join(roleDir, templating.LocationDir, node.Location))
+	}
+	overlays = append(overlays, path.Join(roleDir, templating.NodeDir, node.Hostname))
+	return renderer.TemplateLayers(nodeDir, variables, roleDir, overlays...)
+}
+
+// checkOverlays warns about overlays for locations and nodes of a role that
+// are not in the cluster, which are most likely misspelled.
+func checkOverlays(clusterDef *vars.Cluster) {
+	for _, role := range vars.Roles {
+		known := map[string][]string{}
+		for _, node := range clusterDef.Nodes(role) {
+			known[templating.LocationDir] = append(known[templating.LocationDir], node.Location)
+			known[templating.NodeDir] = append(known[templating.NodeDir], node.Hostname)
+		}
+		for _, dir := range []string{templating.LocationDir, templating.NodeDir} {
+			entries, err := os.ReadDir(path.Join("templates", role, dir))
+			if err != nil {
+				continue
+			}
+			for _, e := range entries {
+				if e.IsDir() && !slices.Contains(known[dir], e.Name()) {
+					log.Warnf("overlay templates/%s/%s/%s does not match any %s node", role, dir, e.Name(), role)
+				}
+			}
 		}
-		lineNum++
 	}
+}
 
-	if err := scanner.Err(); err != nil {
-		log.WithError(err).Fatal("scanning file")
+// transpileNodes transpiles the configs of the nodes concurrently. The errors
+// of all nodes that failed are returned, in the order of the hosts.
+func transpileNodes(format transpile.Format, hosts []string) error {
+	errs := make([]error, len(hosts))
+	p := pool.New().WithMaxGoroutines(runtime.GOMAXPROCS(0))
+	for i, host := range hosts {
+		p.Go(func() {
+			log.Infof("processing node %s", host)
+			nodeDir := "output/" + host
+			src := filepath.Join(nodeDir, "config.ign.yaml")
+			dst := filepath.Join(nodeDir, "config.ign")
+			if err := transpile.Run(format, src, dst, nodeDir); err != nil {
+				log.WithField("node", host).WithError(err).Error("transpiling failed")
+				errs[i] = fmt.Errorf("node %s: %w", host, err)
+			}
+		})
 	}
-	return hits
+	p.Wait()
+	return errors.Join(errs...)
 }
@@ -0,0 +1,231 @@
+package generate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Phase is how far provisioning of a node has come. Phases are recorded in
+// the order below, a phase that does not apply to the node is skipped.
+type Phase string
+
+const (
+	PhasePending  Phase = ""
+	PhaseDrained  Phase = "drained"
+	PhaseUploaded Phase = "uploaded"
+	PhaseRebooted Phase = "rebooted"
+	PhaseRejoined Phase = "rejoined"
+	PhaseLabelled Phase = "labelled"
+	PhaseDone     Phase = "done"
+)
+
+var phases = []Phase{PhasePending, PhaseDrained, PhaseUploaded, PhaseRebooted, PhaseRejoined, PhaseLabelled, PhaseDone}
+
+func (p Phase) before(q Phase) bool {
+	return slices.Index(phases, p) < slices.Index(phases, q)
+}
+
+// Journal records the phase of every node in a provision run, so that a run
+// that died half way can be resumed. It is written to output/run-<id>.json
+// after every change.
+type Journal struct {
+	ID       string         `json:"id"`
+	Cluster  string         `json:"cluster"`
+	Started  time.Time      `json:"started"`
+	Finished bool           `json:"finished"`
+	Nodes    []*JournalNode `json:"nodes"`
+
+	mu   sync.Mutex
+	path string
+}
+
+type JournalNode struct {
+	Host    string    `json:"host"`
+	Role    string    `json:"role"`
+	Phase   Phase     `json:"phase"`
+	Updated time.Time `json:"updated"`
+	// BootID is the boot id of the node before it was rebooted.
+	BootID string `json:"bootId,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func journalPath(dir, id string) string {
+	return filepath.Join(dir, "run-"+id+".json")
+}
+
+func newJournal(dir, cluster string, nodes map[string][]string) (*Journal, error) {
+	now := time.Now().UTC()
+	j := &Journal{
+		ID:      now.Format("20060102T150405Z"),
+		Cluster: cluster,
+		Started: now,
+	}
+	j.path = journalPath(dir, j.ID)
+	j.add(nodes)
+	return j, j.save()
+}
+
+// latestJournal returns the most recent unfinished journal of the cluster in
+// dir, or nil if there is none.
+func latestJournal(dir, cluster string) (*Journal, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "run-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	// ids are timestamps, so the names sort by start time
+	slices.Sort(files)
+	slices.Reverse(files)
+
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		j := &Journal{path: file}
+		if err := json.Unmarshal(b, j); err != nil {
+			return nil, fmt.Errorf("reading journal %s: %w", file, err)
+		}
+		if j.Cluster != cluster {
+			continue
+		}
+		if j.Finished {
+			return nil, nil
+		}
+		return j, nil
+	}
+	return nil, nil
+}
+
+// add adds nodes that are not in the journal yet.
+func (j *Journal) add(nodes map[string][]string) {
+	for _, role := range roleOrder() {
+		for _, host := range nodes[role] {
+			if j.node(host) == nil {
+				j.Nodes = append(j.Nodes, &JournalNode{Host: host, Role: role})
+			}
+		}
+	}
+}
+
+// nodes returns the nodes that are not done, by role in provisioning order.
+func (j *Journal) nodes() map[string][]string {
+	ret := make(map[string][]string)
+	for _, n := range j.Nodes {
+		if n.Phase != PhaseDone {
+			ret[n.Role] = append(ret[n.Role], n.Host)
+		}
+	}
+	return ret
+}
+
+func (j *Journal) node(host string) *JournalNode {
+	for _, n := range j.Nodes {
+		if n.Host == host {
+			return n
+		}
+	}
+	return nil
+}
+
+func (j *Journal) Phase(host string) Phase {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if n := j.node(host); n != nil {
+		return n.Phase
+	}
+	return PhasePending
+}
+
+func (j *Journal) BootID(host string) string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if n := j.node(host); n != nil {
+		return n.BootID
+	}
+	return ""
+}
+
+// Record sets the phase of the node and saves the journal.
+func (j *Journal) Record(host string, phase Phase) error {
+	return j.update(host, func(n *JournalNode) {
+		n.Phase = phase
+		n.Error = ""
+	})
+}
+
+func (j *Journal) RecordBootID(host, bootID string) error {
+	return j.update(host, func(n *JournalNode) { n.BootID = bootID })
+}
+
+func (j *Journal) RecordError(host string, err error) error {
+	return j.update(host, func(n *JournalNode) { n.Error = err.Error() })
+}
+
+func (j *Journal) update(host string, f func(n *JournalNode)) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	n := j.node(host)
+	if n == nil {
+		return fmt.Errorf("node %s is not in journal %s", host, j.path)
+	}
+	f(n)
+	n.Updated = time.Now().UTC()
+	return j.save()
+}
+
+// Finish marks the run as finished if every node is done.
+func (j *Journal) Finish() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, n := range j.Nodes {
+		if n.Phase != PhaseDone {
+			return nil
+		}
+	}
+	j.Finished = true
+	return j.save()
+}
+
+// save writes the journal to a temporary file that is renamed into place, so
+// the journal is never left half written. j.mu must be held.
+func (j *Journal) save() error {
+	b, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o755); err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// cleanOutputDir removes everything in the output dir except run journals.
+func cleanOutputDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), "run-") && strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package generate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournalResume(t *testing.T) {
+	dir := t.TempDir()
+	nodes := map[string][]string{
+		"worker": {"worker1", "worker2"},
+		"etcd":   {"etcd1"},
+	}
+
+	j, err := newJournal(dir, "dev", nodes)
+	require.NoError(t, err)
+	require.NoError(t, j.Record("etcd1", PhaseDone))
+	require.NoError(t, j.Record("worker1", PhaseDrained))
+	require.NoError(t, j.RecordBootID("worker1", "boot-1"))
+	require.NoError(t, j.Finish())
+
+	resumed, err := latestJournal(dir, "dev")
+	require.NoError(t, err)
+	require.NotNil(t, resumed)
+	assert.Equal(t, j.ID, resumed.ID)
+	assert.Equal(t, PhaseDrained, resumed.Phase("worker1"))
+	assert.Equal(t, "boot-1", resumed.BootID("worker1"))
+	assert.Equal(t, map[string][]string{"worker": {"worker1", "worker2"}}, resumed.nodes())
+
+	other, err := latestJournal(dir, "prod")
+	require.NoError(t, err)
+	assert.Nil(t, other, "journals of other clusters are not resumed")
+
+	for _, node := range []string{"worker1", "worker2"} {
+		require.NoError(t, resumed.Record(node, PhaseDone))
+	}
+	require.NoError(t, resumed.Finish())
+
+	finished, err := latestJournal(dir, "dev")
+	require.NoError(t, err)
+	assert.Nil(t, finished, "finished runs are not resumed")
+}
+
+func TestPhaseBefore(t *testing.T) {
+	assert.True(t, PhasePending.before(PhaseDrained))
+	assert.True(t, PhaseDrained.before(PhaseRebooted))
+	assert.False(t, PhaseRebooted.before(PhaseUploaded))
+	assert.False(t, PhaseDone.before(PhaseDone))
+}
+
+func TestCleanOutputDirKeepsJournals(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "worker1"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "worker1", "config.ign"), nil, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "analysis.out"), nil, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "run-20260101T000000Z.json"), nil, 0o644))
+
+	require.NoError(t, cleanOutputDir(dir))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "run-20260101T000000Z.json", entries[0].Name())
+}
@@ -0,0 +1,69 @@
+package generate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/nais/onprem/nitro/pkg/kubernetes"
+	"github.com/nais/onprem/nitro/pkg/utils"
+	"github.com/nais/onprem/nitro/pkg/vars"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// SyncLabels reconciles the labels and taints of the nodes with the cluster
+// file, without provisioning them. All nodes of the cluster are synced if
+// hosts is empty.
+func SyncLabels(clusterName string, hosts []string) error {
+	ctx := context.Background()
+	k, err := kubernetes.New(clusterName)
+	if err != nil {
+		return err
+	}
+	clusterDef, err := vars.ParseCluster("clusters/" + clusterName + ".yaml")
+	if err != nil {
+		return err
+	}
+
+	return syncLabels(ctx, k, clusterDef, utils.FilterHosts(clusterDef.Hosts(), hosts))
+}
+
+// syncLabels reconciles the labels and taints of the hosts that are
+// registered as kubernetes nodes. Other hosts, like etcd nodes that do not
+// run a kubelet, are skipped.
+func syncLabels(ctx context.Context, k *kubernetes.Client, clusterDef *vars.Cluster, nodes map[string][]string) error {
+	for _, role := range vars.Roles {
+		for _, host := range nodes[role] {
+			err := syncNodeLabels(kubernetes.WithName(ctx, host), k, clusterDef, host)
+			if errors.Is(err, kubernetes.ErrNodeNotFound) {
+				log.WithField("node", host).Debug("not a kubernetes node, skipping labels")
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func syncNodeLabels(ctx context.Context, k *kubernetes.Client, clusterDef *vars.Cluster, host string) error {
+	changed, err := k.ReconcileNode(ctx, host, clusterDef.NodeLabels(host), nodeTaints(clusterDef, host))
+	if err != nil {
+		return fmt.Errorf("reconciling labels and taints of %s: %w", host, err)
+	}
+	if !changed {
+		log.WithField("node", host).Info("labels and taints up to date")
+	}
+	return nil
+}
+
+// nodeTaints are the taints of the node in the cluster file.
+func nodeTaints(cluster *vars.Cluster, hostname string) []corev1.Taint {
+	var taints []corev1.Taint
+	for _, t := range cluster.NodeTaints(hostname) {
+		taints = append(taints, corev1.Taint{Key: t.Key, Value: t.Value, Effect: corev1.TaintEffect(t.Effect)})
+	}
+	return taints
+}
@@ -0,0 +1,187 @@
+package generate
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/nais/onprem/nitro/pkg/ssh"
+	"github.com/nais/onprem/nitro/pkg/vars"
+	log "github.com/sirupsen/logrus"
+)
+
+// migratedPkiExcludes are the apiserver certificates that are bound to the
+// apiserver host and must be reissued on the new node instead of copied.
+var migratedPkiExcludes = []string{"kube-apiserver-server", "kubelet"}
+
+// pkiDir is where the apiserver has its pki.
+const pkiDir = "/etc/kubernetes/pki"
+
+// remote is the part of the ssh client the migration uses.
+type remote interface {
+	User() string
+	ExecuteCommand(host, command string) error
+	Sha256sum(host, path string) (string, error)
+	UploadFile(host, src, dst string) error
+	DownloadDir(host, dstDir, srcDir string) error
+}
+
+// MigrateApiserver moves the apiserver role from one host to another. The
+// CA, SA and front-proxy material is copied to the new host and verified, the
+// kubelet certs on the workers are moved aside, and only then is the cluster
+// file rewritten and the cluster regenerated, so that the apiserver and
+// kubelet certs are reissued for the new host. A migration that fails before
+// the cluster file is rewritten can be run again as is. The old apiserver is
+// left running and must be removed by hand afterwards.
+func MigrateApiserver(sshClient *ssh.Client, cluster, from, to string) error {
+	return migrateApiserver(sshClient, "clusters/"+cluster+".yaml", from, to, func() error {
+		return ClusterIgnitionFiles(sshClient, cluster, nil)
+	})
+}
+
+func migrateApiserver(sshClient remote, clusterPath, from, to string, generate func() error) error {
+	clusterDef, err := vars.ParseCluster(clusterPath)
+	if err != nil {
+		return err
+	}
+	clusterFile := clusterDef.Hosts()
+	apiservers := clusterFile["apiserver"]
+	switch {
+	case slices.Contains(apiservers, from):
+	case len(apiservers) > 0 && apiservers[0] == to:
+		log.Infof("apiserver already set to %s in %s", to, clusterPath)
+	default:
+		return fmt.Errorf("%w: apiserver %s not found in %s", vars.ErrInvalidConfig, from, clusterPath)
+	}
+
+	if err := copyApiserverPki(sshClient, from, to); err != nil {
+		return err
+	}
+
+	for _, worker := range clusterFile["worker"] {
+		if err := moveKubeletCertsAside(worker, sshClient); err != nil {
+			return err
+		}
+	}
+
+	replaced, err := vars.ReplaceHostname(clusterPath, "apiserver", from, to)
+	if err != nil {
+		return err
+	}
+	if replaced {
+		log.Infof("replaced apiserver %s with %s in %s", from, to, clusterPath)
+	}
+
+	if err := generate(); err != nil {
+		return err
+	}
+	log.Infof("migrated apiserver from %s to %s", from, to)
+	return nil
+}
+
+// copyApiserverPki copies the pki of the apiserver, with its subdirs, and
+// checks every file on the new host against the one it was copied from.
+func copyApiserverPki(sshClient remote, from, to string) error {
+	log.Infof("copying pki from %s to %s", from, to)
+	tmpDir, err := os.MkdirTemp("", "nitro-pki")
+	if err != nil {
+		return fmt.Errorf("creating temp dir: %w", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			log.WithError(err).Warn("removing temp dir")
+		}
+	}()
+
+	if err := sshClient.DownloadDir(from, tmpDir, pkiDir); err != nil {
+		return fmt.Errorf("downloading pki from %s: %w", from, err)
+	}
+
+	var files, dirs []string
+	err = filepath.WalkDir(tmpDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == tmpDir {
+			return err
+		}
+		rel, err := filepath.Rel(tmpDir, p)
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			dirs = append(dirs, filepath.ToSlash(rel))
+		case excludedFromMigration(d.Name()):
+			log.Infof("not copying %s, it will be reissued for %s", rel, to)
+		default:
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("reading downloaded pki: %w", err)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no pki found on %s in %s", from, pkiDir)
+	}
+
+	stagingDir := "/home/" + sshClient.User() + "/nitro-pki"
+	mkdir := "rm -rf " + stagingDir + " && mkdir -p " + stagingDir
+	for _, dir := range dirs {
+		mkdir += " " + stagingDir + "/" + dir
+	}
+	if err := sshClient.ExecuteCommand(to, mkdir); err != nil {
+		return fmt.Errorf("creating %s on %s: %w", stagingDir, to, err)
+	}
+
+	for _, file := range files {
+		if err := sshClient.UploadFile(to, filepath.Join(tmpDir, file), stagingDir+"/"+file); err != nil {
+			return fmt.Errorf("uploading %s to %s: %w", file, to, err)
+		}
+	}
+
+	cmd := "sudo mkdir -p " + pkiDir + " && sudo cp -R " + stagingDir + "/. " + pkiDir + "/ && rm -rf " + stagingDir
+	if err := sshClient.ExecuteCommand(to, cmd); err != nil {
+		return fmt.Errorf("installing pki on %s: %w", to, err)
+	}
+
+	for _, file := range files {
+		want, err := sshClient.Sha256sum(from, pkiDir+"/"+file)
+		if err != nil {
+			return err
+		}
+		got, err := sshClient.Sha256sum(to, pkiDir+"/"+file)
+		if err != nil {
+			return err
+		}
+		if got == "" || got != want {
+			return fmt.Errorf("verifying pki on %s: %s/%s differs from %s", to, pkiDir, file, from)
+		}
+	}
+	log.Infof("copied and verified %d pki files on %s", len(files), to)
+	return nil
+}
+
+func excludedFromMigration(file string) bool {
+	for _, prefix := range migratedPkiExcludes {
+		if strings.HasPrefix(file, prefix+".") || strings.HasPrefix(file, prefix+"-key.") {
+			return true
+		}
+	}
+	return false
+}
+
+// moveKubeletCertsAside renames the kubelet certs on a worker so they are
+// reissued by ensureKubeletCerts, while keeping the old ones around for
+// rollback until the worker is reprovisioned.
+func moveKubeletCertsAside(host string, sshClient remote) error {
+	cmd := `for f in /etc/kubernetes/pki/kubelet.pem /etc/kubernetes/pki/kubelet-key.pem; do
+	if sudo test -f $f; then sudo mv -f $f $f.pre-migration; fi
+done`
+	if err := sshClient.ExecuteCommand(host, cmd); err != nil {
+		return fmt.Errorf("moving kubelet certs aside on %s: %w", host, err)
+	}
+	log.Infof("moved kubelet certs aside on %s", host)
+	return nil
+}
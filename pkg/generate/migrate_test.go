@@ -0,0 +1,218 @@
+package generate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRemote has the files of every host in memory, and records the calls
+// made to it as "<host> <op> <arg>".
+type fakeRemote struct {
+	files map[string]map[string]string
+	calls []string
+	// fail fails the calls it returns an error for
+	fail func(call string) error
+	// corrupt is a file that is changed when it is installed
+	corrupt string
+}
+
+func (f *fakeRemote) call(host, op, arg string) error {
+	call := host + " " + op + " " + arg
+	f.calls = append(f.calls, call)
+	if f.fail != nil {
+		return f.fail(call)
+	}
+	return nil
+}
+
+func (f *fakeRemote) User() string { return "deployer" }
+
+func (f *fakeRemote) ExecuteCommand(host, command string) error {
+	if err := f.call(host, "exec", command); err != nil {
+		return err
+	}
+	staging := "/home/deployer/nitro-pki/"
+	if strings.Contains(command, "cp -R "+staging) {
+		for p, contents := range f.files[host] {
+			if rel, ok := strings.CutPrefix(p, staging); ok {
+				if rel == f.corrupt {
+					contents += "corrupt"
+				}
+				f.files[host][pkiDir+"/"+rel] = contents
+				delete(f.files[host], p)
+			}
+		}
+	}
+	return nil
+}
+
+func (f *fakeRemote) Sha256sum(host, p string) (string, error) {
+	if err := f.call(host, "sha256sum", p); err != nil {
+		return "", err
+	}
+	contents, ok := f.files[host][p]
+	if !ok {
+		return "", nil
+	}
+	sum := sha256.Sum256([]byte(contents))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (f *fakeRemote) UploadFile(host, src, dst string) error {
+	if err := f.call(host, "upload", dst); err != nil {
+		return err
+	}
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	f.files[host][dst] = string(b)
+	return nil
+}
+
+func (f *fakeRemote) DownloadDir(host, dstDir, srcDir string) error {
+	if err := f.call(host, "download", srcDir); err != nil {
+		return err
+	}
+	for p, contents := range f.files[host] {
+		rel, ok := strings.CutPrefix(p, path.Clean(srcDir)+"/")
+		if !ok {
+			continue
+		}
+		dst := filepath.Join(dstDir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(dst, []byte(contents), 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// index returns the index of the first call with the prefix, -1 if there is
+// none.
+func (f *fakeRemote) index(prefix string) int {
+	return slices.IndexFunc(f.calls, func(call string) bool { return strings.HasPrefix(call, prefix) })
+}
+
+const migrateCluster = `version: 1
+etcd:
+  - hostname: etcd1
+apiserver:
+  - hostname: apiserver0
+    ip: 10.0.0.10
+worker:
+  - hostname: worker1
+  - hostname: worker2
+`
+
+func newMigration(t *testing.T) (*fakeRemote, string) {
+	t.Helper()
+	clusterPath := filepath.Join(t.TempDir(), "dev.yaml")
+	require.NoError(t, os.WriteFile(clusterPath, []byte(migrateCluster), 0o644))
+	return &fakeRemote{files: map[string]map[string]string{
+		"apiserver0": {
+			pkiDir + "/ca.pem":                    "ca",
+			pkiDir + "/ca-key.pem":                "ca key",
+			pkiDir + "/sa.key":                    "sa",
+			pkiDir + "/kube-apiserver-server.pem": "server",
+			pkiDir + "/kubelet-key.pem":           "kubelet key",
+			pkiDir + "/etcd/ca.pem":               "etcd ca",
+		},
+		"apiserver1": {},
+	}}, clusterPath
+}
+
+func TestMigrateApiserver(t *testing.T) {
+	remote, clusterPath := newMigration(t)
+	generated := false
+	err := migrateApiserver(remote, clusterPath, "apiserver0", "apiserver1", func() error {
+		b, err := os.ReadFile(clusterPath)
+		require.NoError(t, err)
+		assert.Contains(t, string(b), "hostname: apiserver1")
+		assert.NotContains(t, string(b), "10.0.0.10")
+		generated = true
+		return nil
+	})
+	require.NoError(t, err)
+	assert.True(t, generated)
+
+	assert.Equal(t, map[string]string{
+		pkiDir + "/ca.pem":      "ca",
+		pkiDir + "/ca-key.pem":  "ca key",
+		pkiDir + "/sa.key":      "sa",
+		pkiDir + "/etcd/ca.pem": "etcd ca",
+	}, remote.files["apiserver1"])
+	assert.Less(t, remote.index("apiserver1 sha256sum "+pkiDir+"/etcd/ca.pem"), remote.index("worker1 exec"))
+	assert.Positive(t, remote.index("worker2 exec"))
+	_, err = os.Stat(clusterPath + ".tmp")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// a migration that failed after the cluster file was rewritten is resumed
+	remote.calls = nil
+	require.NoError(t, migrateApiserver(remote, clusterPath, "apiserver0", "apiserver1", func() error { return nil }))
+	assert.Positive(t, remote.index("apiserver1 upload"))
+}
+
+func TestMigrateApiserverFailures(t *testing.T) {
+	failing := errors.New("failing")
+	for name, tc := range map[string]struct {
+		fail    string
+		corrupt string
+		workers bool
+	}{
+		"download":         {fail: "apiserver0 download"},
+		"upload":           {fail: "apiserver1 upload /home/deployer/nitro-pki/sa.key"},
+		"install":          {fail: "apiserver1 exec sudo"},
+		"verify":           {corrupt: "etcd/ca.pem"},
+		"kubelet certs":    {fail: "worker2 exec", workers: true},
+		"missing checksum": {fail: "apiserver0 sha256sum"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			remote, clusterPath := newMigration(t)
+			remote.corrupt = tc.corrupt
+			if tc.fail != "" {
+				remote.fail = func(call string) error {
+					if strings.HasPrefix(call, tc.fail) {
+						return failing
+					}
+					return nil
+				}
+			}
+
+			err := migrateApiserver(remote, clusterPath, "apiserver0", "apiserver1", func() error {
+				t.Fatal("generated after a failed migration")
+				return nil
+			})
+			require.Error(t, err)
+			if tc.corrupt != "" {
+				assert.ErrorContains(t, err, "verifying pki on apiserver1: "+pkiDir+"/etcd/ca.pem differs from apiserver0")
+			}
+
+			b, err := os.ReadFile(clusterPath)
+			require.NoError(t, err)
+			assert.Equal(t, migrateCluster, string(b), "cluster file rewritten")
+			if !tc.workers {
+				assert.Equal(t, -1, remote.index("worker1"), "kubelet certs moved aside")
+			}
+		})
+	}
+}
+
+func TestMigrateApiserverUnknownHost(t *testing.T) {
+	remote, clusterPath := newMigration(t)
+	err := migrateApiserver(remote, clusterPath, "apiserver9", "apiserver1", func() error { return nil })
+	assert.ErrorContains(t, err, "apiserver apiserver9 not found")
+	assert.Empty(t, remote.calls)
+}
@@ -0,0 +1,199 @@
+package generate
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/nais/onprem/nitro/pkg/analyze"
+	"github.com/nais/onprem/nitro/pkg/ssh"
+	"github.com/nais/onprem/nitro/pkg/vars"
+	log "github.com/sirupsen/logrus"
+)
+
+// ProvisionPlan is what Provision would do with the same nodes and options.
+type ProvisionPlan struct {
+	Cluster     string
+	EtcdJoining []string
+	EtcdLeaving []string
+	Nodes       []PlannedNode
+	// Certificates are the certificates that would be issued on the next
+	// generate, by the host whose output dir they are written to.
+	Certificates map[string][]string
+	Steps        []ProvisionStep
+}
+
+// PlannedNode is what would be done to a single node.
+type PlannedNode struct {
+	Role  string
+	Host  string
+	Drain bool
+	// Diff is the ignition diff against the config on the node, or why it
+	// could not be made.
+	Diff string
+}
+
+// Plan works out what Provision would do without changing anything on the
+// nodes or in the kubernetes api. Nodes and etcd are only read over ssh.
+func Plan(sshClient *ssh.Client, cluster string, nodes map[string][]string, opts ProvisionOptions) (*ProvisionPlan, error) {
+	clusterDef, err := vars.ParseCluster("clusters/" + cluster + ".yaml")
+	if err != nil {
+		return nil, err
+	}
+	clusterFile := clusterDef.Hosts()
+
+	plan := &ProvisionPlan{Cluster: cluster}
+
+	if !opts.NewCluster {
+		members, _, err := liveEtcdMembers(clusterFile["etcd"], sshClient)
+		if err != nil {
+			return nil, err
+		}
+		if members == nil {
+			log.Warn("could not get etcd member list from any etcd node, skipping membership check")
+		} else {
+			joining, leaving, err := etcdMembershipChanges(members, clusterFile["etcd"], sshClient.Resolver().Resolve)
+			if err != nil {
+				return nil, err
+			}
+			plan.EtcdJoining = joining
+			for _, member := range leaving {
+				plan.EtcdLeaving = append(plan.EtcdLeaving, member.Name)
+			}
+			if len(joining) > 0 || len(leaving) > 0 {
+				nodes = joiningFirst(nodes, clusterFile["etcd"], joining)
+			}
+		}
+	}
+
+	plan.Steps = provisionSteps(nodes, opts.Rollout)
+	for _, step := range plan.Steps {
+		for _, host := range step.Hosts {
+			var diff string
+			if report, err := analyze.Analyze(sshClient, host); err != nil {
+				diff = fmt.Sprintf("no diff: %v\n", err)
+			} else {
+				diff = report.Markdown()
+			}
+			plan.Nodes = append(plan.Nodes, PlannedNode{
+				Role:  step.Role,
+				Host:  host,
+				Drain: step.Role == "worker" && !opts.SkipDrain,
+				Diff:  diff,
+			})
+		}
+	}
+
+	plan.Certificates, err = plannedCertificates(sshClient, clusterFile, nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// plannedCertificates downloads the certificates on the nodes to a temporary
+// dir and checks which of them ensure*Certs would issue.
+func plannedCertificates(sshClient *ssh.Client, clusterFile, nodes map[string][]string) (map[string][]string, error) {
+	if len(clusterFile["apiserver"]) == 0 {
+		return nil, fmt.Errorf("%w: no apiserver in cluster file", vars.ErrInvalidConfig)
+	}
+
+	tmp, err := os.MkdirTemp("", "nitro-plan")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	ret := make(map[string][]string)
+
+	apiServerHost := clusterFile["apiserver"][0]
+	caDir := filepath.Join(tmp, apiServerHost)
+	if err := os.MkdirAll(caDir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := sshClient.DownloadDir(apiServerHost, caDir, "/etc/kubernetes/pki"); err != nil {
+		log.Infof("could not download files from apiserver: %v", err)
+	}
+	if names := neededNames(apiserverCertRequests(caDir, "output/"+apiServerHost)); len(names) > 0 {
+		ret[apiServerHost] = names
+	}
+
+	for _, host := range nodes["worker"] {
+		dir := filepath.Join(tmp, host)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		if err := downloadKubeletCert(host, dir, sshClient); err != nil {
+			return nil, err
+		}
+		if names := neededNames([]certRequest{kubeletCertRequest(dir, "output/"+host, caDir)}); len(names) > 0 {
+			ret[host] = names
+		}
+	}
+
+	for _, host := range clusterFile["etcd"] {
+		if err := sshClient.DownloadDir(host, caDir, "/etc/ssl/etcd/"); err != nil {
+			log.Infof("could not download files from %s: %v", host, err)
+		}
+	}
+	for _, host := range nodes["etcd"] {
+		if names := neededNames(etcdCertRequests(host, clusterFile["etcd"], caDir, "output/"+host)); len(names) > 0 {
+			ret[host] = append(ret[host], names...)
+		}
+	}
+
+	return ret, nil
+}
+
+// Markdown renders the plan in the same format as the analyze output.
+func (p *ProvisionPlan) Markdown() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "## %s provision plan\n", p.Cluster)
+
+	if len(p.EtcdJoining) > 0 || len(p.EtcdLeaving) > 0 {
+		sb.WriteString("### etcd membership\n")
+		for _, host := range p.EtcdJoining {
+			fmt.Fprintf(&sb, "- add member %s\n", host)
+		}
+		for _, name := range p.EtcdLeaving {
+			fmt.Fprintf(&sb, "- remove member %s\n", name)
+		}
+	}
+
+	sb.WriteString("### order\n")
+	for i, step := range p.Steps {
+		fmt.Fprintf(&sb, "%d. %s, %d at a time: %s\n", i+1, step.Role, step.Parallelism, strings.Join(step.Hosts, ", "))
+	}
+
+	sb.WriteString("### certificates\n")
+	if len(p.Certificates) == 0 {
+		sb.WriteString("no certificates would be issued\n")
+	}
+	for _, node := range p.Nodes {
+		if names, ok := p.Certificates[node.Host]; ok {
+			fmt.Fprintf(&sb, "- %s: %s\n", node.Host, strings.Join(names, ", "))
+		}
+	}
+	for _, host := range slices.Sorted(maps.Keys(p.Certificates)) {
+		if !p.planned(host) {
+			fmt.Fprintf(&sb, "- %s (not provisioned): %s\n", host, strings.Join(p.Certificates[host], ", "))
+		}
+	}
+
+	for _, node := range p.Nodes {
+		action := "reboot"
+		if node.Drain {
+			action = "drain and delete node if it is registered, reboot"
+		}
+		fmt.Fprintf(&sb, "### %s - %s\n%s\n%s\n", node.Role, node.Host, action, node.Diff)
+	}
+	return sb.String()
+}
+
+func (p *ProvisionPlan) planned(host string) bool {
+	return slices.ContainsFunc(p.Nodes, func(node PlannedNode) bool { return node.Host == host })
+}
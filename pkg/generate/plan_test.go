@@ -0,0 +1,36 @@
+package generate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProvisionSteps(t *testing.T) {
+	nodes := map[string][]string{
+		"worker":    {"worker1", "worker2", "worker3"},
+		"apiserver": {"apiserver1"},
+		"etcd":      {"etcd1", "etcd2"},
+	}
+
+	assert.Equal(t, []ProvisionStep{
+		{Role: "etcd", Hosts: []string{"etcd1"}, Parallelism: 1},
+		{Role: "etcd", Hosts: []string{"etcd2"}, Parallelism: 1},
+		{Role: "apiserver", Hosts: []string{"apiserver1"}, Parallelism: 1},
+		{Role: "worker", Hosts: []string{"worker1", "worker2"}, Parallelism: 2},
+		{Role: "worker", Hosts: []string{"worker3"}, Parallelism: 1},
+	}, provisionSteps(nodes, RolloutOptions{BatchSize: 2}))
+
+	assert.Equal(t, []ProvisionStep{
+		{Role: "worker", Hosts: []string{"worker1"}, Parallelism: 1},
+	}, provisionSteps(map[string][]string{"worker": {"worker1"}}, RolloutOptions{BatchSize: 5}), "parallelism is capped by the number of nodes")
+}
+
+func TestJoiningFirst(t *testing.T) {
+	nodes := map[string][]string{"worker": {"worker1"}, "etcd": {"etcd2"}}
+
+	assert.Equal(t, map[string][]string{
+		"worker": {"worker1"},
+		"etcd":   {"etcd3", "etcd1", "etcd2"},
+	}, joiningFirst(nodes, []string{"etcd1", "etcd2", "etcd3"}, []string{"etcd3"}))
+}
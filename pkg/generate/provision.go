@@ -2,6 +2,7 @@ package generate
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
@@ -16,84 +17,326 @@ import (
 	"github.com/sourcegraph/conc/pool"
 )
 
-func Provision(sshClient *ssh.Client, clusterName string, nodes map[string][]string, skipDrain bool, newCluster bool, maxConcurrency int) {
+// ErrEtcdUnhealthy is returned when an etcd node does not report healthy after being provisioned.
+var ErrEtcdUnhealthy = errors.New("etcd unhealthy")
+
+// ProvisionOptions controls how Provision rolls out new configs to the nodes.
+type ProvisionOptions struct {
+	SkipDrain  bool
+	NewCluster bool
+	Rollout    RolloutOptions
+	// RebootTimeout is how long a node may take to come back from a reboot
+	// with its config applied and its services active.
+	RebootTimeout time.Duration
+	Drain         kubernetes.DrainOptions
+	// Resume continues the last unfinished run of the cluster from the phase
+	// each node had reached. Nodes that are not in its journal are added.
+	Resume bool
+}
+
+func Provision(sshClient *ssh.Client, clusterName string, nodes map[string][]string, opts ProvisionOptions) error {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
-	k := kubernetes.New(clusterName)
+	k, err := kubernetes.New(clusterName)
+	if err != nil {
+		return err
+	}
 
-	wg := pool.New().WithMaxGoroutines(maxConcurrency).WithContext(ctx)
-	nodeCount := maxConcurrency
-	for _, role := range roleOrder() {
-		for _, node := range nodes[role] {
-			role, node := role, node
-			if role == "worker" {
-				if nodeCount > 0 {
-					if nodeCount != maxConcurrency {
-						time.Sleep(7 * time.Second)
-					}
-					nodeCount--
+	clusterDef, err := vars.ParseCluster("clusters/" + clusterName + ".yaml")
+	if err != nil {
+		return err
+	}
+
+	journal, err := openJournal(ctx, k, clusterName, nodes, opts)
+	if err != nil {
+		return err
+	}
+	log.Infof("recording provision run in %s", journal.path)
+
+	p := &provisioner{k: k, ssh: sshClient, cluster: clusterDef, opts: opts, journal: journal}
+	provisionNode := func(ctx context.Context, role, node string) error {
+		err := p.provision(ctx, role, node)
+		if err != nil {
+			if err := journal.RecordError(node, err); err != nil {
+				log.WithError(err).Warn("recording error in journal")
+			}
+		}
+		return err
+	}
+
+	// joining etcd members are provisioned one at a time while the members
+	// are reconciled, and are done before the steps below
+	if !opts.NewCluster {
+		nodes, err = reconcileEtcdMembers(sshClient, clusterName, nodes, func(host string) error {
+			journal.add(map[string][]string{"etcd": {host}})
+			return provisionNode(ctx, "etcd", host)
+		})
+		if err != nil {
+			return err
+		}
+		journal.add(nodes)
+	}
+
+	// the workloads crash looping before the first batch of workers, which
+	// the health gates do not hold against the rollout
+	var crashLoopingBefore []string
+	snapshotTaken := false
+	for _, step := range provisionSteps(journal.nodes(), opts.Rollout) {
+		if step.Role != "worker" {
+			for _, node := range step.Hosts {
+				if err := provisionNode(ctx, step.Role, node); err != nil {
+					return err
 				}
-				wg.Go(func(ctx context.Context) error {
-					provision(ctx, role, node, k, sshClient, skipDrain, newCluster)
-					return nil
-				})
-			} else {
-				provision(ctx, role, node, k, sshClient, skipDrain, newCluster)
 			}
+			continue
+		}
+
+		if !opts.NewCluster && !snapshotTaken {
+			crashLoopingBefore, err = k.CrashLoopingPods(ctx)
+			if err != nil {
+				return fmt.Errorf("listing crash looping pods: %w", err)
+			}
+			snapshotTaken = true
+		}
+
+		log.Infof("provisioning batch of workers: %s", strings.Join(step.Hosts, ", "))
+		wg := pool.New().WithMaxGoroutines(step.Parallelism).WithContext(ctx)
+		for i, node := range step.Hosts {
+			if i > 0 && !sleep(ctx, opts.Rollout.Stagger) {
+				break
+			}
+			wg.Go(func(ctx context.Context) error {
+				err := provisionNode(ctx, step.Role, node)
+				if err != nil {
+					log.WithField("node", node).WithError(err).Error("provisioning failed")
+				}
+				return err
+			})
+		}
+		if err := wg.Wait(); err != nil {
+			return fmt.Errorf("%w: %w", ErrRolloutHalted, err)
+		}
+		// interrupted while staggering, before the rest of the batch started
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("%w: %w", ErrRolloutHalted, err)
+		}
+
+		// a new cluster has no workloads to check until all workers are up
+		if !opts.NewCluster {
+			if err := healthGate(ctx, k, step.Hosts, crashLoopingBefore, opts.Rollout.GateTimeout, opts.Rollout.Settle); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Info("reconciling labels and taints of all nodes")
+	if err := syncLabels(ctx, k, clusterDef, clusterDef.Hosts()); err != nil {
+		return err
+	}
+
+	return journal.Finish()
+}
+
+// openJournal starts a journal for the nodes, or with opts.Resume continues
+// the last unfinished one. When resuming, nodes that were drained by the
+// previous run but will not be drained again are uncordoned.
+func openJournal(ctx context.Context, k *kubernetes.Client, cluster string, nodes map[string][]string, opts ProvisionOptions) (*Journal, error) {
+	if !opts.Resume {
+		return newJournal(OutputDir, cluster, nodes)
+	}
+
+	journal, err := latestJournal(OutputDir, cluster)
+	if err != nil {
+		return nil, err
+	}
+	if journal == nil {
+		log.Info("no unfinished provision run to resume, starting a new one")
+		return newJournal(OutputDir, cluster, nodes)
+	}
+
+	log.Infof("resuming provision run %s", journal.ID)
+	journal.add(nodes)
+	for _, n := range journal.Nodes {
+		if n.Phase != PhaseDone {
+			log.WithField("node", n.Host).Infof("resuming %s from phase %q", n.Role, n.Phase)
+		}
+	}
+
+	drained, err := k.DrainedNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range drained {
+		if willDrain(journal, node, opts) {
+			continue
+		}
+		if err := k.Uncordon(ctx, node); err != nil {
+			return nil, fmt.Errorf("uncordon node %s: %w", node, err)
 		}
 	}
+	return journal, nil
+}
 
-	if err := wg.Wait(); err != nil {
-		log.WithError(err).Error("error while waiting for workers")
+// willDrain reports whether provisioning the node drains it.
+func willDrain(journal *Journal, node string, opts ProvisionOptions) bool {
+	n := journal.node(node)
+	return n != nil && n.Role == "worker" && !opts.SkipDrain && n.Phase.before(PhaseDrained)
+}
+
+// ProvisionStep is a group of nodes of one role that are provisioned
+// together, Parallelism at a time. Steps run one after another.
+type ProvisionStep struct {
+	Role        string
+	Hosts       []string
+	Parallelism int
+}
+
+// provisionSteps orders the nodes by role. etcd and apiserver nodes are
+// provisioned one by one, workers in batches.
+func provisionSteps(nodes map[string][]string, rollout RolloutOptions) []ProvisionStep {
+	var steps []ProvisionStep
+	for _, role := range roleOrder() {
+		if len(nodes[role]) == 0 {
+			continue
+		}
+		if role != "worker" {
+			for _, node := range nodes[role] {
+				steps = append(steps, ProvisionStep{Role: role, Hosts: []string{node}, Parallelism: 1})
+			}
+			continue
+		}
+		for _, batch := range batches(nodes[role], rollout.batchSize(len(nodes[role]))) {
+			steps = append(steps, ProvisionStep{Role: role, Hosts: batch, Parallelism: len(batch)})
+		}
 	}
+	return steps
 }
 
-func provision(ctx context.Context, role, node string, k *kubernetes.Client, sshClient *ssh.Client, skipDrain bool, newCluster bool) {
+// provisioner provisions single nodes of a cluster.
+type provisioner struct {
+	k       *kubernetes.Client
+	ssh     *ssh.Client
+	cluster *vars.Cluster
+	opts    ProvisionOptions
+	journal *Journal
+}
+
+func (p *provisioner) provision(ctx context.Context, role, node string) error {
 	start := time.Now()
 	ctx = kubernetes.WithName(ctx, node)
 	log := log.WithField("node", node)
+	phase := p.journal.Phase(node)
 
 	log.Infof("--- provisioning %s: %s", role, node)
-	if role == "worker" && !skipDrain && !k.NewNode(ctx, node) {
-		k.Drain(ctx, node)
-		k.Wait(ctx, node)
-		k.DeleteNode(ctx, node)
+	drain := role == "worker" && !p.opts.SkipDrain
+	if drain && phase.before(PhaseDrained) {
+		isNew, err := p.k.NewNode(ctx, node)
+		if err != nil {
+			return fmt.Errorf("node %s: %w", node, err)
+		}
+		if !isNew {
+			if err := p.k.Drain(ctx, node, p.opts.Drain); err != nil {
+				return fmt.Errorf("draining node %s: %w", node, err)
+			}
+			if err := p.k.DeleteNode(ctx, node); err != nil {
+				return fmt.Errorf("deleting node %s: %w", node, err)
+			}
+		}
+		if err := p.journal.Record(node, PhaseDrained); err != nil {
+			return err
+		}
 	}
 
-	if err := sshClient.UploadFile(node, filepath.Join("output", node, "config.ign"), "/home/"+sshClient.User()+"/config.ign"); err != nil {
-		log.WithError(err).Fatal("uploading ignition config")
-	}
+	if phase.before(PhaseUploaded) {
+		previousBootID, err := bootID(node, p.ssh)
+		if err != nil {
+			return fmt.Errorf("reading boot id of %s: %w", node, err)
+		}
+		if err := p.journal.RecordBootID(node, previousBootID); err != nil {
+			return err
+		}
+
+		if err := p.ssh.UploadFile(node, filepath.Join("output", node, "config.ign"), "/home/"+p.ssh.User()+"/config.ign"); err != nil {
+			return fmt.Errorf("uploading ignition config to %s: %w", node, err)
+		}
 
-	if err := PrepareForReboot(node, sshClient); err != nil {
-		log.WithError(err).Fatal("preparing reboot")
+		if err := PrepareForReboot(node, p.ssh); err != nil {
+			return fmt.Errorf("preparing reboot of %s: %w", node, err)
+		}
+		log.Info("installed new ignition config")
+		if err := p.journal.Record(node, PhaseUploaded); err != nil {
+			return err
+		}
 	}
-	log.Info("installed new ignition config")
 
-	log.Infof("start reboot")
-	if err := sshClient.Reboot(node); err != nil {
-		log.WithError(err).Info("start reboot")
+	if phase.before(PhaseRebooted) {
+		previousBootID := p.journal.BootID(node)
+		currentBootID, err := bootID(node, p.ssh)
+		if err != nil {
+			log.WithError(err).Info("reading boot id")
+		}
+		// a resumed node may already have been rebooted by the previous run
+		if err != nil || currentBootID == previousBootID {
+			log.Infof("start reboot")
+			if err := p.ssh.Reboot(node); err != nil {
+				log.WithError(err).Info("start reboot")
+			}
+		}
+
+		if err := verifyReboot(ctx, role, node, previousBootID, p.ssh, p.opts.RebootTimeout, p.opts.NewCluster); err != nil {
+			return err
+		}
+		if err := p.journal.Record(node, PhaseRebooted); err != nil {
+			return err
+		}
 	}
 
-	if role == "etcd" && !newCluster {
-		counter := 0
-		for !EtcdHealthy(vars.ResolveIP(node), sshClient) {
-			if counter < 30 {
-				counter++
-				log.Infof("etcd not healthy, sleeping for 5 seconds before rechecking")
-				time.Sleep(5 * time.Second)
-				continue
+	if phase.before(PhaseRejoined) {
+		if role == "etcd" && !p.opts.NewCluster {
+			ip, err := p.ssh.Resolver().Resolve(node)
+			if err != nil {
+				return err
+			}
+			counter := 0
+			for !EtcdHealthy(ip, p.ssh) {
+				if counter < 30 {
+					counter++
+					log.Infof("etcd not healthy, sleeping for 5 seconds before rechecking")
+					time.Sleep(5 * time.Second)
+					continue
+				}
+				return fmt.Errorf("%w: etcd [%s] not healthy", ErrEtcdUnhealthy, node)
+			}
+		}
+
+		if drain {
+			if err := p.k.WaitForNode(ctx, node); err != nil {
+				return fmt.Errorf("waiting for node %s: %w", node, err)
 			}
-			panic(fmt.Sprintf("etcd [%s] not healthy", node))
+		}
+		if err := p.journal.Record(node, PhaseRejoined); err != nil {
+			return err
+		}
+	}
+
+	// a drained worker was deleted and has rejoined without its labels and
+	// taints; they are set before the health gates let workloads onto it
+	if role == "worker" && phase.before(PhaseLabelled) {
+		if err := syncNodeLabels(ctx, p.k, p.cluster, node); err != nil {
+			return err
+		}
+		if err := p.journal.Record(node, PhaseLabelled); err != nil {
+			return err
 		}
 	}
 
-	if (role == "worker") && !skipDrain {
-		k.WaitForNode(ctx, node)
-		k.LabelNode(ctx, node, "kubernetes.io/role", role)
+	if err := p.journal.Record(node, PhaseDone); err != nil {
+		return err
 	}
 	elapsed := time.Since(start)
 	log.Infof("done in %v", elapsed)
+	return nil
 }
 
 func roleOrder() []string {
@@ -110,7 +353,7 @@ func PrepareForReboot(host string, client *ssh.Client) error {
 }
 
 func EtcdHealthy(host string, client *ssh.Client) bool {
-	cmd := fmt.Sprintf("/opt/etcd/bin/etcdctl endpoint health --key=/etc/ssl/etcd/etcd-client-key.pem --cacert=/etc/ssl/etcd/ca.pem --cert=/etc/ssl/etcd/etcd-client.pem --endpoints=https://%s:2379", host)
+	cmd := fmt.Sprintf(etcdctl, host) + "endpoint health"
 
 	retVal, err := client.ExecuteCommandWithOutput(host, cmd)
 	if err != nil {
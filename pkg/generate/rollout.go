@@ -0,0 +1,154 @@
+package generate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrRolloutHalted is returned when a health gate failed after a batch of
+// workers, and the remaining workers were left untouched.
+var ErrRolloutHalted = errors.New("rollout halted")
+
+// RolloutOptions controls how workers are rolled out. Workers are provisioned
+// in batches, and the next batch is only started once the health gates pass
+// for the previous one.
+type RolloutOptions struct {
+	// BatchSize is the number of workers in a batch. If BatchPercent is set,
+	// the batch size is that percentage of the workers instead.
+	BatchSize    int
+	BatchPercent int
+	// Stagger is the delay between starting the nodes in a batch.
+	Stagger time.Duration
+	// GateTimeout is how long the nodes of a batch get to pass the gates.
+	GateTimeout time.Duration
+	// Settle is how long workloads are watched for crash loops once the
+	// nodes of a batch are up, after they passed within GateTimeout.
+	Settle time.Duration
+}
+
+// ParseBatchSize parses a batch size given as a number of nodes, e.g. "2", or
+// a percentage of the workers, e.g. "25%".
+func ParseBatchSize(s string) (size, percent int, err error) {
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		percent, err = strconv.Atoi(p)
+		if err != nil || percent < 1 || percent > 100 {
+			return 0, 0, fmt.Errorf("invalid batch percentage %q", s)
+		}
+		return 0, percent, nil
+	}
+	size, err = strconv.Atoi(s)
+	if err != nil || size < 1 {
+		return 0, 0, fmt.Errorf("invalid batch size %q", s)
+	}
+	return size, 0, nil
+}
+
+func (o RolloutOptions) batchSize(workers int) int {
+	size := o.BatchSize
+	if o.BatchPercent > 0 {
+		// round up, so a small percentage of a few workers is still one node
+		size = (workers*o.BatchPercent + 99) / 100
+	}
+	return max(1, size)
+}
+
+func batches(hosts []string, size int) [][]string {
+	var ret [][]string
+	for batch := range slices.Chunk(hosts, size) {
+		ret = append(ret, batch)
+	}
+	return ret
+}
+
+// gateClient is the part of the kubernetes client the health gates use.
+type gateClient interface {
+	NodeReady(ctx context.Context, node string) (bool, error)
+	PendingDaemonSetPods(ctx context.Context, node string) ([]string, error)
+	CrashLoopingPods(ctx context.Context) ([]string, error)
+}
+
+// healthGate waits for the nodes of a batch to be Ready with all their
+// DaemonSet pods running within timeout, then watches for settle that no
+// workload starts crash looping compared to before the rollout.
+func healthGate(ctx context.Context, k gateClient, batch, crashLoopingBefore []string, timeout, settle time.Duration) error {
+	log.Infof("checking health gates for %s", strings.Join(batch, ", "))
+	gateCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for _, node := range batch {
+		reason := ""
+		err := poll(gateCtx, func() (bool, error) {
+			ready, err := k.NodeReady(gateCtx, node)
+			if err != nil || !ready {
+				reason = "node is not Ready"
+				return false, nil
+			}
+			pending, err := k.PendingDaemonSetPods(gateCtx, node)
+			if err != nil || len(pending) > 0 {
+				reason = "daemonset pods not running: " + strings.Join(pending, ", ")
+				return false, nil
+			}
+			return true, nil
+		})
+		if err != nil {
+			return fmt.Errorf("%w: %s: %s after %s", ErrRolloutHalted, node, reason, timeout)
+		}
+		log.WithField("node", node).Info("node is Ready with daemonset pods running")
+	}
+
+	// a workload may only start crash looping a while after its pods moved
+	// to the batch, so the gate passes once settle is over without any
+	settleCtx, cancelSettle := context.WithTimeout(ctx, settle)
+	defer cancelSettle()
+	var added []string
+	var listErr error
+	err := poll(settleCtx, func() (bool, error) {
+		crashLooping, err := k.CrashLoopingPods(settleCtx)
+		if err != nil {
+			if settleCtx.Err() == nil {
+				listErr = err
+			}
+			return false, nil
+		}
+		listErr = nil
+		added = newEntries(crashLoopingBefore, crashLooping)
+		return len(added) > 0, nil
+	})
+	switch {
+	case err == nil:
+		return fmt.Errorf("%w: new pods in CrashLoopBackOff: %s", ErrRolloutHalted, strings.Join(added, ", "))
+	case ctx.Err() != nil:
+		return fmt.Errorf("%w: %w", ErrRolloutHalted, ctx.Err())
+	case listErr != nil:
+		return fmt.Errorf("%w: listing crash looping pods: %w", ErrRolloutHalted, listErr)
+	}
+	log.Infof("no new crash looping workloads after %s", strings.Join(batch, ", "))
+	return nil
+}
+
+// sleep sleeps for d, and reports false if ctx was done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func newEntries(before, after []string) []string {
+	var ret []string
+	for _, s := range after {
+		if !slices.Contains(before, s) && !slices.Contains(ret, s) {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
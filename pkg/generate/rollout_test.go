@@ -0,0 +1,134 @@
+package generate
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBatchSize(t *testing.T) {
+	size, percent, err := ParseBatchSize("3")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, size)
+	assert.Equal(t, 0, percent)
+
+	size, percent, err = ParseBatchSize("25%")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, size)
+	assert.Equal(t, 25, percent)
+
+	for _, invalid := range []string{"0", "-1", "0%", "101%", "many", "%"} {
+		_, _, err := ParseBatchSize(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	assert.Equal(t, 2, RolloutOptions{BatchSize: 2}.batchSize(10))
+	assert.Equal(t, 3, RolloutOptions{BatchPercent: 25}.batchSize(10), "percentages are rounded up")
+	assert.Equal(t, 1, RolloutOptions{BatchPercent: 10}.batchSize(3))
+	assert.Equal(t, 1, RolloutOptions{}.batchSize(3))
+}
+
+func TestNewEntries(t *testing.T) {
+	before := []string{"default/Deployment/app/app"}
+	after := []string{"default/Deployment/app/app", "kube-system/DaemonSet/flannel/flannel", "kube-system/DaemonSet/flannel/flannel"}
+	assert.Equal(t, []string{"kube-system/DaemonSet/flannel/flannel"}, newEntries(before, after))
+	assert.Empty(t, newEntries(after, before))
+}
+
+// fakeGate is a cluster whose nodes are Ready, and whose crash looping pods
+// are crashLooping(n) the nth time they are listed, unless listing fails with
+// fail(n).
+type fakeGate struct {
+	listed       atomic.Int32
+	crashLooping func(n int) []string
+	fail         func(n int) error
+}
+
+func (f *fakeGate) NodeReady(context.Context, string) (bool, error) { return true, nil }
+
+func (f *fakeGate) PendingDaemonSetPods(context.Context, string) ([]string, error) { return nil, nil }
+
+func (f *fakeGate) CrashLoopingPods(context.Context) ([]string, error) {
+	n := int(f.listed.Add(1))
+	if f.fail != nil {
+		if err := f.fail(n); err != nil {
+			return nil, err
+		}
+	}
+	return f.crashLooping(n), nil
+}
+
+func TestHealthGateSettle(t *testing.T) {
+	interval := verifyInterval
+	verifyInterval = time.Millisecond
+	t.Cleanup(func() { verifyInterval = interval })
+
+	before := []string{"default/Deployment/app/app"}
+
+	// a workload that starts crash looping a while after the batch is up
+	k := &fakeGate{crashLooping: func(n int) []string {
+		if n < 5 {
+			return before
+		}
+		return append(before, "default/Deployment/new/new")
+	}}
+	err := healthGate(context.Background(), k, []string{"worker1"}, before, time.Minute, time.Minute)
+	assert.ErrorIs(t, err, ErrRolloutHalted)
+	assert.ErrorContains(t, err, "new pods in CrashLoopBackOff: default/Deployment/new/new")
+	assert.Equal(t, int32(5), k.listed.Load())
+
+	// crash loops that were there before pass once settled
+	k = &fakeGate{crashLooping: func(int) []string { return before }}
+	require.NoError(t, healthGate(context.Background(), k, []string{"worker1"}, before, time.Minute, 20*time.Millisecond))
+	assert.Greater(t, k.listed.Load(), int32(1), "crash loops listed once")
+
+	// the settle window is not cut short by the gate timeout
+	start := time.Now()
+	require.NoError(t, healthGate(context.Background(), k, []string{"worker1"}, before, 10*time.Millisecond, 50*time.Millisecond))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// a failed list is retried
+	k = &fakeGate{crashLooping: func(int) []string { return before }, fail: func(n int) error {
+		if n < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}}
+	require.NoError(t, healthGate(context.Background(), k, []string{"worker1"}, before, time.Minute, 20*time.Millisecond))
+	assert.Greater(t, k.listed.Load(), int32(3))
+
+	// but fails the gate if it still fails when the window is over
+	k = &fakeGate{crashLooping: func(int) []string { return before }, fail: func(int) error { return errors.New("connection refused") }}
+	err = healthGate(context.Background(), k, []string{"worker1"}, before, time.Minute, 20*time.Millisecond)
+	assert.ErrorIs(t, err, ErrRolloutHalted)
+	assert.ErrorContains(t, err, "listing crash looping pods: connection refused")
+
+	// an interrupted gate does not pass
+	ctx, cancel := context.WithCancel(context.Background())
+	k = &fakeGate{crashLooping: func(n int) []string {
+		if n == 3 {
+			cancel()
+		}
+		return before
+	}}
+	err = healthGate(ctx, k, []string{"worker1"}, before, time.Minute, time.Minute)
+	assert.ErrorIs(t, err, ErrRolloutHalted)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestSleep(t *testing.T) {
+	assert.True(t, sleep(context.Background(), time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	assert.False(t, sleep(ctx, time.Minute))
+	assert.Less(t, time.Since(start), time.Second)
+}
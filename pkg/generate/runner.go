@@ -1,6 +1,7 @@
 package generate
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -12,15 +13,20 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func RunnerConfig(node, cluster, apiServer string, sshClient *ssh.Client, githubToken, repository string) {
+func RunnerConfig(node, cluster, apiServer string, sshClient *ssh.Client, githubToken, repository string) error {
 	log.Infof("generate runner config %s\n", node)
 
 	err := os.RemoveAll("./output")
 	if err != nil {
-		log.WithError(err).Fatal("deleting output dir")
+		return fmt.Errorf("deleting output dir: %w", err)
 	}
 
-	variables := make(map[string]string)
+	admins, err := vars.ParseAdmins("vars/admins.yaml")
+	if err != nil {
+		return err
+	}
+
+	variables := make(map[string]any)
 	variables["apiserver"] = apiServer
 	variables["cluster_name"] = cluster
 	variables["github_token"] = githubToken
@@ -28,13 +34,25 @@ func RunnerConfig(node, cluster, apiServer string, sshClient *ssh.Client, github
 	variables["identity_file"] = sshClient.IdentityFile()
 	variables["repository"] = repository
 	variables["repository_without_slash"] = strings.ReplaceAll(repository, "/", "-")
-	variables["users"] = vars.BuildUsersString(vars.ParseStringYAML("vars/admins.yaml"))
+	variables["admins"] = admins
+	variables["users"] = vars.BuildUsersString(admins)
 
-	clusterVars := vars.ParseStringYAML("vars/" + cluster + ".yaml")
+	clusterVars, err := vars.ParseYAML("vars/" + cluster + ".yaml")
+	if err != nil {
+		return err
+	}
 	variables = vars.Merge(variables, clusterVars)
 
-	templating.TemplateFiles("templates/github_runner", "output/"+node, variables, true)
-	templating.TemplateFiles("templates", "output", variables, false)
+	renderer, err := templating.NewRenderer("templates")
+	if err != nil {
+		return err
+	}
+	if err := renderer.TemplateFiles("templates/github_runner", "output/"+node, variables, true); err != nil {
+		return err
+	}
+	if err := renderer.TemplateFiles("templates", "output", variables, false); err != nil {
+		return err
+	}
 
 	log.Infof("download files from API server")
 	if err := sshClient.DownloadDir(apiServer, "output/"+node, "/etc/kubernetes/pki"); err != nil {
@@ -43,5 +61,5 @@ func RunnerConfig(node, cluster, apiServer string, sshClient *ssh.Client, github
 	nodeDir := "output/" + node
 	src := filepath.Join(nodeDir, "config.ign.yaml")
 	dst := filepath.Join(nodeDir, "config.ign")
-	transpile.Run(src, dst, nodeDir)
+	return transpile.Run(transpile.CLC, src, dst, nodeDir)
 }
@@ -0,0 +1,107 @@
+package generate
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/nais/onprem/nitro/pkg/templating"
+	"github.com/nais/onprem/nitro/pkg/vars"
+	log "github.com/sirupsen/logrus"
+)
+
+// unresolvedVariables returns the messages of the errors, joined ones
+// flattened. A template of a role fails the same way for every node of the
+// role, so each message is returned once.
+func unresolvedVariables(errs []error) []string {
+	var ret []string
+	for _, err := range errs {
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			for _, msg := range unresolvedVariables(joined.Unwrap()) {
+				if !slices.Contains(ret, msg) {
+					ret = append(ret, msg)
+				}
+			}
+			continue
+		}
+		if msg := err.Error(); !slices.Contains(ret, msg) {
+			ret = append(ret, msg)
+		}
+	}
+	return ret
+}
+
+// reportUnusedVars writes the vars set in vars files and the cluster file that
+// no template of a role refers to, by role, to output/unused-vars.out. Vars no
+// template at all refers to are logged, so stale vars get cleaned up.
+func reportUnusedVars(renderer *templating.Renderer, layers *vars.Layers, clusterDef *vars.Cluster) error {
+	shared, err := renderer.References("templates", false)
+	if err != nil {
+		return err
+	}
+
+	unusedByRole := make(map[string][]string)
+	used := make(map[string]bool)
+	var defined []string
+	for _, role := range vars.Roles {
+		nodes := clusterDef.Nodes(role)
+		if len(nodes) == 0 {
+			continue
+		}
+		refs, err := renderer.References(path.Join("templates", role), true)
+		if err != nil {
+			return err
+		}
+		var roleDefined []string
+		for _, node := range nodes {
+			for _, layer := range layers.Node(role, node) {
+				if !layer.Computed {
+					roleDefined = append(roleDefined, slices.Collect(maps.Keys(layer.Vars))...)
+				}
+			}
+		}
+		unusedByRole[role] = unusedVars(roleDefined, shared, refs)
+		for _, name := range roleDefined {
+			if !slices.Contains(unusedByRole[role], name) {
+				used[name] = true
+			}
+		}
+		defined = append(defined, roleDefined...)
+	}
+
+	var report strings.Builder
+	for _, role := range vars.Roles {
+		if unused, ok := unusedByRole[role]; ok {
+			fmt.Fprintf(&report, "%s: %s\n", role, strings.Join(unused, ", "))
+		}
+	}
+	unusedByAll := unusedVars(defined, used)
+	if len(unusedByAll) > 0 {
+		log.Warnf("vars not used by any template: %s", strings.Join(unusedByAll, ", "))
+	}
+
+	file := filepath.Join(OutputDir, "unused-vars.out")
+	if err := os.WriteFile(file, []byte(report.String()), 0o644); err != nil {
+		return fmt.Errorf("write %s: %w", file, err)
+	}
+	log.Infof("wrote vars not used by the templates of each role to %s", file)
+	return nil
+}
+
+// unusedVars returns the defined vars that none of the references refer to,
+// sorted and without duplicates.
+func unusedVars(defined []string, references ...map[string]bool) []string {
+	var ret []string
+	for _, name := range defined {
+		used := slices.ContainsFunc(references, func(refs map[string]bool) bool { return refs[name] })
+		if !used && !slices.Contains(ret, name) {
+			ret = append(ret, name)
+		}
+	}
+	slices.Sort(ret)
+	return ret
+}
@@ -0,0 +1,28 @@
+package generate
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnresolvedVariables(t *testing.T) {
+	a := errors.New("worker/a.yaml:1: variable \"a\" is not set")
+	b := errors.New("worker/b.yaml:2: variable \"b\" is not set")
+	c := errors.New("etcd/c.yaml:3: variable \"c\" is not set")
+
+	assert.Equal(t, []string{a.Error(), b.Error(), c.Error()}, unresolvedVariables([]error{
+		errors.Join(a, b),
+		errors.Join(a, b),
+		c,
+	}))
+}
+
+func TestUnusedVars(t *testing.T) {
+	shared := map[string]bool{"domain": true}
+	worker := map[string]bool{"k8s_version": true}
+	assert.Equal(t, []string{"etcd_version", "stale"}, unusedVars(
+		[]string{"stale", "domain", "k8s_version", "etcd_version", "stale"}, shared, worker))
+	assert.Empty(t, unusedVars([]string{"domain"}, shared))
+}
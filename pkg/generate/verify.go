@@ -0,0 +1,139 @@
+package generate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nais/onprem/nitro/pkg/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrRebootFailed is returned when a node did not come back from a reboot with
+// its new ignition config applied and its services running.
+var ErrRebootFailed = errors.New("reboot verification failed")
+
+// verifyInterval is how often poll checks, a var for the tests.
+var verifyInterval = 5 * time.Second
+
+// roleUnits are the systemd units that must be active on a node of the role
+// after it has been rebooted.
+func roleUnits(role string) []string {
+	switch role {
+	case "etcd":
+		return []string{"etcd"}
+	case "apiserver":
+		return []string{"kube-apiserver"}
+	case "worker":
+		return []string{"kubelet"}
+	}
+	return nil
+}
+
+// commandRunner runs commands on nodes.
+type commandRunner interface {
+	ExecuteCommandWithOutput(host, command string) (string, error)
+	Sha256sum(host, path string) (string, error)
+}
+
+func bootID(host string, sshClient commandRunner) (string, error) {
+	out, err := sshClient.ExecuteCommandWithOutput(host, "cat /proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// verifyReboot waits for the node to go down and come back with a new boot
+// id, then checks that ignition applied the config that was uploaded and
+// that the units of the role are active.
+func verifyReboot(ctx context.Context, role, node, previousBootID string, sshClient commandRunner, timeout time.Duration, newCluster bool) error {
+	log := log.WithField("node", node)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	fail := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s: %s", ErrRebootFailed, node, fmt.Sprintf(format, args...))
+	}
+
+	wentDown := false
+	err := poll(ctx, func() (bool, error) {
+		id, err := bootID(node, sshClient)
+		if err != nil {
+			if !wentDown {
+				log.Info("node is down")
+				wentDown = true
+			}
+			return false, nil
+		}
+		return id != previousBootID, nil
+	})
+	if err != nil {
+		if wentDown {
+			return fail("ssh did not come back within %s", timeout)
+		}
+		return fail("node did not reboot within %s", timeout)
+	}
+	log.Info("node is back with a new boot id")
+
+	localSum, err := utils.Sha256sum(filepath.Join("output", node, "config.ign"))
+	if err != nil {
+		return err
+	}
+	remoteSum, err := sshClient.Sha256sum(node, "/usr/share/oem/config.ign")
+	if err != nil {
+		return fail("checking ignition config: %v", err)
+	}
+	if remoteSum != localSum {
+		return fail("ignition config on node does not match %s", filepath.Join("output", node, "config.ign"))
+	}
+
+	// flatcar removes the first boot flag once ignition has run
+	if _, err := sshClient.ExecuteCommandWithOutput(node, "test ! -e /boot/flatcar/first_boot"); err != nil {
+		return fail("ignition did not run, /boot/flatcar/first_boot still exists")
+	}
+	log.Info("ignition config applied")
+
+	for _, unit := range roleUnits(role) {
+		if unit == "etcd" && newCluster {
+			// etcd does not become active until a quorum of the new cluster is up
+			continue
+		}
+		state := ""
+		err := poll(ctx, func() (bool, error) {
+			out, _ := sshClient.ExecuteCommandWithOutput(node, "systemctl is-active "+unit+" || true")
+			state = strings.TrimSpace(out)
+			return state == "active", nil
+		})
+		if err != nil {
+			return fail("unit %s is %q", unit, state)
+		}
+		log.Infof("unit %s is active", unit)
+	}
+
+	return nil
+}
+
+func poll(ctx context.Context, f func() (bool, error)) error {
+	ticker := time.NewTicker(verifyInterval)
+	defer ticker.Stop()
+
+	for {
+		done, err := f()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package generate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNode answers the commands verifyReboot runs on a node.
+type fakeNode struct {
+	// bootIDs are returned in turn, the last one from then on, "" when the
+	// node is down
+	bootIDs   []string
+	config    string
+	firstBoot bool
+	unit      string
+	reads     int
+}
+
+func (f *fakeNode) ExecuteCommandWithOutput(host, command string) (string, error) {
+	switch {
+	case command == "cat /proc/sys/kernel/random/boot_id":
+		id := f.bootIDs[min(f.reads, len(f.bootIDs)-1)]
+		f.reads++
+		if id == "" {
+			return "", errors.New("connection refused")
+		}
+		return id + "\n", nil
+	case command == "test ! -e /boot/flatcar/first_boot":
+		if f.firstBoot {
+			return "", errors.New("exit status 1")
+		}
+		return "", nil
+	case strings.HasPrefix(command, "systemctl is-active "):
+		return f.unit + "\n", nil
+	}
+	return "", fmt.Errorf("unexpected command %q on %s", command, host)
+}
+
+func (f *fakeNode) Sha256sum(_, _ string) (string, error) {
+	sum := sha256.Sum256([]byte(f.config))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func TestVerifyReboot(t *testing.T) {
+	interval := verifyInterval
+	verifyInterval = time.Millisecond
+	t.Cleanup(func() { verifyInterval = interval })
+
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.MkdirAll(filepath.Join("output", "node1"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join("output", "node1", "config.ign"), []byte("config"), 0o644))
+
+	for name, tc := range map[string]struct {
+		role       string
+		newCluster bool
+		node       fakeNode
+		err        string
+	}{
+		"rebooted": {
+			role: "worker",
+			node: fakeNode{bootIDs: []string{"old", "", "new"}, config: "config", unit: "active"},
+		},
+		"unchanged boot id": {
+			role: "worker",
+			node: fakeNode{bootIDs: []string{"old"}, config: "config", unit: "active"},
+			err:  "node1: node did not reboot within 50ms",
+		},
+		"not back": {
+			role: "worker",
+			node: fakeNode{bootIDs: []string{"old", ""}, config: "config", unit: "active"},
+			err:  "node1: ssh did not come back within 50ms",
+		},
+		"checksum mismatch": {
+			role: "worker",
+			node: fakeNode{bootIDs: []string{"new"}, config: "old config", unit: "active"},
+			err:  "node1: ignition config on node does not match " + filepath.Join("output", "node1", "config.ign"),
+		},
+		"first boot marker": {
+			role: "worker",
+			node: fakeNode{bootIDs: []string{"new"}, config: "config", firstBoot: true, unit: "active"},
+			err:  "node1: ignition did not run, /boot/flatcar/first_boot still exists",
+		},
+		"failed unit": {
+			role: "worker",
+			node: fakeNode{bootIDs: []string{"new"}, config: "config", unit: "failed"},
+			err:  `node1: unit kubelet is "failed"`,
+		},
+		"etcd of a new cluster": {
+			role:       "etcd",
+			newCluster: true,
+			node:       fakeNode{bootIDs: []string{"new"}, config: "config", unit: "activating"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := verifyReboot(context.Background(), tc.role, "node1", "old", &tc.node, 50*time.Millisecond, tc.newCluster)
+			if tc.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrRebootFailed)
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ErrDrainBlocked is returned when a node could not be drained, because
+// evictions were refused by a PodDisruptionBudget until the drain timed out or
+// because of the emptyDir policy.
+var ErrDrainBlocked = errors.New("drain blocked")
+
+// EmptyDirPolicy is what a drain does with pods that have emptyDir volumes,
+// whose data is lost when they are evicted.
+type EmptyDirPolicy string
+
+const (
+	// EmptyDirDelete evicts the pods like any other pod.
+	EmptyDirDelete EmptyDirPolicy = "delete"
+	// EmptyDirSkip leaves the pods on the node until it is rebooted.
+	EmptyDirSkip EmptyDirPolicy = "skip"
+	// EmptyDirFail refuses to drain the node.
+	EmptyDirFail EmptyDirPolicy = "fail"
+)
+
+func ParseEmptyDirPolicy(s string) (EmptyDirPolicy, error) {
+	switch p := EmptyDirPolicy(s); p {
+	case EmptyDirDelete, EmptyDirSkip, EmptyDirFail:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown emptyDir policy %q, must be one of %s, %s, %s", s, EmptyDirDelete, EmptyDirSkip, EmptyDirFail)
+}
+
+type DrainOptions struct {
+	EmptyDir EmptyDirPolicy
+	// Timeout is how long to keep retrying evictions refused by a
+	// PodDisruptionBudget, and to wait for evicted pods to terminate.
+	Timeout time.Duration
+	// Force deletes pods that are still blocked by a PodDisruptionBudget
+	// when Timeout is reached, instead of failing the drain.
+	Force bool
+}
+
+const evictionInterval = 5 * time.Second
+
+// Drain cordons the node and evicts its pods through the eviction api, so
+// PodDisruptionBudgets are honored. Mirror pods and pods owned by a DaemonSet
+// are left on the node.
+func (c *Client) Drain(ctx context.Context, nodeName string, opts DrainOptions) error {
+	log := log.WithField("node", nodeName)
+	log.Infof("initiate node drain")
+	if err := c.cordon(ctx, nodeName); err != nil {
+		return err
+	}
+
+	pods, err := c.nodePods(ctx, nodeName)
+	if err != nil {
+		return err
+	}
+	evict, err := podsToEvict(pods, opts.EmptyDir)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrDrainBlocked, nodeName, err)
+	}
+
+	log.Infof("evicting %d pods", len(evict))
+	return c.evict(ctx, nodeName, evict, opts)
+}
+
+func (c *Client) cordon(ctx context.Context, nodeName string) error {
+	return retry(ctx, 2, func() error {
+		node, err := c.getNode(ctx, nodeName)
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			return fmt.Errorf("node %s not found", nodeName)
+		}
+		node.Spec.Unschedulable = true
+
+		// the taints keep new pods off the node, evicting its pods is left to
+		// the eviction api so disruption budgets are honored
+		if !hasTaint(ShutdownTaint, node.Spec.Taints) {
+			node.Spec.Taints = append(node.Spec.Taints, corev1.Taint{
+				Key:    ShutdownTaint,
+				Value:  "true",
+				Effect: corev1.TaintEffectNoSchedule,
+			})
+		}
+
+		if !hasTaint(FlannelUnavailableTaint, node.Spec.Taints) {
+			node.Spec.Taints = append(node.Spec.Taints, corev1.Taint{
+				Key:    FlannelUnavailableTaint,
+				Value:  "true",
+				Effect: corev1.TaintEffectNoSchedule,
+			})
+		}
+		_, err = c.k.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// podsToEvict returns the pods that must be evicted for the node to be
+// drained.
+func podsToEvict(pods []corev1.Pod, emptyDir EmptyDirPolicy) ([]corev1.Pod, error) {
+	var evict []corev1.Pod
+	var withEmptyDir []string
+	for _, pod := range pods {
+		name := pod.Namespace + "/" + pod.Name
+		switch {
+		case pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed:
+			continue
+		case isMirrorPod(pod):
+			log.Debugf("skipping mirror pod %s", name)
+			continue
+		case isDaemonSetPod(pod):
+			log.Debugf("skipping daemonset pod %s", name)
+			continue
+		case hasEmptyDir(pod):
+			switch emptyDir {
+			case EmptyDirSkip:
+				log.Infof("skipping pod %s with emptyDir volume", name)
+				continue
+			case EmptyDirFail:
+				withEmptyDir = append(withEmptyDir, name)
+				continue
+			}
+		}
+		evict = append(evict, pod)
+	}
+
+	if len(withEmptyDir) > 0 {
+		return nil, fmt.Errorf("pods with emptyDir volumes would lose their data: %s", strings.Join(withEmptyDir, ", "))
+	}
+	return evict, nil
+}
+
+func isMirrorPod(pod corev1.Pod) bool {
+	_, ok := pod.Annotations[corev1.MirrorPodAnnotationKey]
+	return ok
+}
+
+func isDaemonSetPod(pod corev1.Pod) bool {
+	owner := metav1.GetControllerOf(&pod)
+	return owner != nil && owner.Kind == "DaemonSet"
+}
+
+func hasEmptyDir(pod corev1.Pod) bool {
+	for _, v := range pod.Spec.Volumes {
+		if v.EmptyDir != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// evict evicts the pods, retrying evictions refused by a disruption budget,
+// and waits for the evicted pods to be gone from the node.
+func (c *Client) evict(ctx context.Context, nodeName string, pods []corev1.Pod, opts DrainOptions) error {
+	log := log.WithField("node", nodeName)
+	timeout, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	pending := make(map[types.UID]corev1.Pod)
+	for _, pod := range pods {
+		pending[pod.UID] = pod
+	}
+	evicted := make(map[types.UID]corev1.Pod)
+
+	ticker := time.NewTicker(evictionInterval)
+	defer ticker.Stop()
+
+	for {
+		for uid, pod := range pending {
+			err := c.k.PolicyV1().Evictions(pod.Namespace).Evict(timeout, &policyv1.Eviction{
+				ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace},
+			})
+			switch {
+			case err == nil, apierrors.IsNotFound(err):
+				delete(pending, uid)
+				evicted[uid] = pod
+			case apierrors.IsTooManyRequests(err):
+				log.Debugf("eviction of pod %s/%s refused: %v", pod.Namespace, pod.Name, err)
+			case timeout.Err() != nil:
+				// reported with the other pending pods below
+			default:
+				return fmt.Errorf("evicting pod %s/%s: %w", pod.Namespace, pod.Name, err)
+			}
+		}
+
+		remaining, err := c.remainingPods(timeout, nodeName, evicted)
+		if err != nil && timeout.Err() == nil {
+			return err
+		}
+		if len(pending) == 0 && len(remaining) == 0 {
+			log.Infof("no pods left")
+			return nil
+		}
+		log.Infof("waiting for %d pods blocked by disruption budgets and %d terminating pods", len(pending), len(remaining))
+
+		select {
+		case <-timeout.Done():
+			return c.drainTimedOut(ctx, nodeName, pending, remaining, opts)
+		case <-ticker.C:
+		}
+	}
+}
+
+// remainingPods returns the evicted pods that are still on the node.
+func (c *Client) remainingPods(ctx context.Context, nodeName string, evicted map[types.UID]corev1.Pod) ([]corev1.Pod, error) {
+	resp, err := c.k.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("spec.nodeName=%s", nodeName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var remaining []corev1.Pod
+	for _, pod := range resp.Items {
+		if _, ok := evicted[pod.UID]; ok {
+			remaining = append(remaining, pod)
+		}
+	}
+	return remaining, nil
+}
+
+func (c *Client) drainTimedOut(ctx context.Context, nodeName string, pending map[types.UID]corev1.Pod, remaining []corev1.Pod, opts DrainOptions) error {
+	log := log.WithField("node", nodeName)
+
+	var blocked []string
+	for _, pod := range pending {
+		blocked = append(blocked, c.blockedBy(ctx, pod))
+	}
+	var terminating []string
+	for _, pod := range remaining {
+		terminating = append(terminating, pod.Namespace+"/"+pod.Name)
+	}
+
+	if !opts.Force {
+		var reasons []string
+		if len(blocked) > 0 {
+			reasons = append(reasons, "evictions refused: "+strings.Join(blocked, "; "))
+		}
+		if len(terminating) > 0 {
+			reasons = append(reasons, "pods still terminating: "+strings.Join(terminating, ", "))
+		}
+		return fmt.Errorf("%w: %s: not drained within %s: %s", ErrDrainBlocked, nodeName, opts.Timeout, strings.Join(reasons, "; "))
+	}
+
+	for _, b := range blocked {
+		log.Warnf("deleting pod despite disruption budget: %s", b)
+	}
+	for _, pod := range pending {
+		err := c.k.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("deleting pod %s/%s: %w", pod.Namespace, pod.Name, err)
+		}
+	}
+	if len(terminating) > 0 {
+		log.Warnf("continuing with pods still terminating: %s", strings.Join(terminating, ", "))
+	}
+	return nil
+}
+
+// blockedBy describes the pod and the disruption budgets that cover it.
+func (c *Client) blockedBy(ctx context.Context, pod corev1.Pod) string {
+	name := pod.Namespace + "/" + pod.Name
+	resp, err := c.k.PolicyV1().PodDisruptionBudgets(pod.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Sprintf("%s (could not list disruption budgets: %v)", name, err)
+	}
+
+	pdbs := matchingPDBs(pod, resp.Items)
+	if len(pdbs) == 0 {
+		return name
+	}
+	var budgets []string
+	for _, pdb := range pdbs {
+		budgets = append(budgets, fmt.Sprintf("PodDisruptionBudget %s/%s allows %d disruptions, %d of %d pods healthy",
+			pdb.Namespace, pdb.Name, pdb.Status.DisruptionsAllowed, pdb.Status.CurrentHealthy, pdb.Status.ExpectedPods))
+	}
+	return fmt.Sprintf("%s blocked by %s", name, strings.Join(budgets, ", "))
+}
+
+func matchingPDBs(pod corev1.Pod, pdbs []policyv1.PodDisruptionBudget) []policyv1.PodDisruptionBudget {
+	var ret []policyv1.PodDisruptionBudget
+	for _, pdb := range pdbs {
+		selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		if err != nil {
+			continue
+		}
+		if selector.Matches(labels.Set(pod.Labels)) {
+			ret = append(ret, pdb)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,101 @@
+package kubernetes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func pod(name string, f ...func(*corev1.Pod)) corev1.Pod {
+	p := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": name}},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	for _, f := range f {
+		f(&p)
+	}
+	return p
+}
+
+func names(pods []corev1.Pod) (ret []string) {
+	for _, p := range pods {
+		ret = append(ret, p.Name)
+	}
+	return ret
+}
+
+func TestPodsToEvict(t *testing.T) {
+	controller := true
+	pods := []corev1.Pod{
+		pod("app"),
+		pod("completed", func(p *corev1.Pod) { p.Status.Phase = corev1.PodSucceeded }),
+		pod("mirror", func(p *corev1.Pod) {
+			p.Annotations = map[string]string{corev1.MirrorPodAnnotationKey: "x"}
+		}),
+		pod("daemonset-lookalike", func(p *corev1.Pod) {
+			p.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "daemonset", Controller: &controller}}
+		}),
+		pod("fluentd-abcde", func(p *corev1.Pod) {
+			p.OwnerReferences = []metav1.OwnerReference{{Kind: "DaemonSet", Name: "fluentd", Controller: &controller}}
+		}),
+		pod("cache", func(p *corev1.Pod) {
+			p.Spec.Volumes = []corev1.Volume{{Name: "tmp", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+		}),
+	}
+
+	evict, err := podsToEvict(pods, EmptyDirDelete)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"app", "daemonset-lookalike", "cache"}, names(evict))
+
+	evict, err = podsToEvict(pods, EmptyDirSkip)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"app", "daemonset-lookalike"}, names(evict))
+
+	_, err = podsToEvict(pods, EmptyDirFail)
+	assert.ErrorContains(t, err, "default/cache")
+}
+
+func TestMatchingPDBs(t *testing.T) {
+	pdbs := []policyv1.PodDisruptionBudget{
+		{ObjectMeta: metav1.ObjectMeta{Name: "app"}, Spec: policyv1.PodDisruptionBudgetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "app"}},
+		}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "other"}, Spec: policyv1.PodDisruptionBudgetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "other"}},
+		}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "all"}, Spec: policyv1.PodDisruptionBudgetSpec{
+			Selector: &metav1.LabelSelector{},
+		}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "none"}},
+	}
+
+	var matched []string
+	for _, pdb := range matchingPDBs(pod("app"), pdbs) {
+		matched = append(matched, pdb.Name)
+	}
+	assert.Equal(t, []string{"app", "all"}, matched)
+}
+
+func TestCordonUncordon(t *testing.T) {
+	ctx := context.Background()
+	c := &Client{k: fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "worker1"}})}
+
+	require.NoError(t, c.cordon(ctx, "worker1"))
+	node, err := c.k.CoreV1().Nodes().Get(ctx, "worker1", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.True(t, node.Spec.Unschedulable)
+	assert.True(t, hasTaint(ShutdownTaint, node.Spec.Taints))
+	assert.True(t, hasTaint(FlannelUnavailableTaint, node.Spec.Taints))
+
+	require.NoError(t, c.Uncordon(ctx, "worker1"))
+	node, err = c.k.CoreV1().Nodes().Get(ctx, "worker1", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.False(t, node.Spec.Unschedulable)
+	assert.Empty(t, node.Spec.Taints)
+}
@@ -0,0 +1,77 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NodeReady reports whether the node is registered and has the Ready condition.
+func (c *Client) NodeReady(ctx context.Context, nodeName string) (bool, error) {
+	node, err := c.k.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	return nodeReady(*node), nil
+}
+
+func nodeReady(node corev1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// PendingDaemonSetPods returns the DaemonSet pods on the node that are not
+// running.
+func (c *Client) PendingDaemonSetPods(ctx context.Context, nodeName string) ([]string, error) {
+	pods, err := c.k.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("spec.nodeName=%s", nodeName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pendingDaemonSetPods(pods.Items), nil
+}
+
+func pendingDaemonSetPods(pods []corev1.Pod) []string {
+	var ret []string
+	for _, pod := range pods {
+		if isDaemonSetPod(pod) && pod.Status.Phase != corev1.PodRunning {
+			ret = append(ret, fmt.Sprintf("%s/%s (%s)", pod.Namespace, pod.Name, pod.Status.Phase))
+		}
+	}
+	return ret
+}
+
+// CrashLoopingPods returns the containers in the cluster that are in
+// CrashLoopBackOff. Containers of pods with a controller are named after the
+// controller, so a crashing workload is the same when its pod is replaced.
+func (c *Client) CrashLoopingPods(ctx context.Context) ([]string, error) {
+	pods, err := c.k.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return crashLooping(pods.Items), nil
+}
+
+func crashLooping(pods []corev1.Pod) []string {
+	var ret []string
+	for _, pod := range pods {
+		name := pod.Namespace + "/" + pod.Name
+		if owner := metav1.GetControllerOf(&pod); owner != nil {
+			name = pod.Namespace + "/" + owner.Kind + "/" + owner.Name
+		}
+		for _, status := range slices.Concat(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses) {
+			if status.State.Waiting != nil && status.State.Waiting.Reason == "CrashLoopBackOff" {
+				ret = append(ret, name+"/"+status.Name)
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,43 @@
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNodeReady(t *testing.T) {
+	node := func(status corev1.ConditionStatus) corev1.Node {
+		return corev1.Node{Status: corev1.NodeStatus{Conditions: []corev1.NodeCondition{
+			{Type: corev1.NodeMemoryPressure, Status: corev1.ConditionFalse},
+			{Type: corev1.NodeReady, Status: status},
+		}}}
+	}
+	assert.True(t, nodeReady(node(corev1.ConditionTrue)))
+	assert.False(t, nodeReady(node(corev1.ConditionUnknown)))
+	assert.False(t, nodeReady(corev1.Node{}))
+}
+
+func TestHealthChecks(t *testing.T) {
+	controller := true
+	daemonSet := func(p *corev1.Pod) {
+		p.OwnerReferences = []metav1.OwnerReference{{Kind: "DaemonSet", Name: "flannel", Controller: &controller}}
+	}
+	crashing := func(p *corev1.Pod) {
+		p.Status.ContainerStatuses = []corev1.ContainerStatus{{
+			Name:  "main",
+			State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+		}}
+	}
+	pods := []corev1.Pod{
+		pod("flannel-a", daemonSet),
+		pod("flannel-b", daemonSet, func(p *corev1.Pod) { p.Status.Phase = corev1.PodPending }),
+		pod("app", crashing),
+		pod("flannel-c", daemonSet, crashing),
+	}
+
+	assert.Equal(t, []string{"default/flannel-b (Pending)"}, pendingDaemonSetPods(pods))
+	assert.Equal(t, []string{"default/app/main", "default/DaemonSet/flannel/main"}, crashLooping(pods))
+}
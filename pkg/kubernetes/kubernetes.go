@@ -2,45 +2,60 @@ package kubernetes
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
-	"strings"
+	"slices"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
 	client "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+// ErrTimeout is returned when an operation against the kubernetes api did not
+// succeed within its retry window, e.g. a node that never rejoined the cluster.
+var ErrTimeout = errors.New("kubernetes operation timed out")
+
+// ShutdownTaint is set on a node while it is drained for provisioning.
+const ShutdownTaint = "nais.io/nitro-shutdown"
+
+// FlannelUnavailableTaint is set on a node with ShutdownTaint, as its pod
+// network goes away with the reboot.
+const FlannelUnavailableTaint = "nais.io/flannel-unavailable"
+
 type Client struct {
-	k *client.Clientset
+	k client.Interface
 }
 
-func New(cluster string) *Client {
+func New(cluster string) (*Client, error) {
 	k8sConfig, err := BuildConfigFromFlags(cluster, os.Getenv("KUBECONFIG"))
 	if err != nil {
-		log.WithError(err).Fatal("initialize kubeconfig")
+		return nil, fmt.Errorf("initialize kubeconfig: %w", err)
 	}
 
 	clientSet, err := client.NewForConfig(k8sConfig)
 	if err != nil {
-		log.WithError(err).Fatal("initialize kubernetes client")
+		return nil, fmt.Errorf("initialize kubernetes client: %w", err)
 	}
-	return &Client{k: clientSet}
+	return &Client{k: clientSet}, nil
 }
 
-func (c *Client) NewNode(ctx context.Context, nodeName string) bool {
-	return c.getNode(ctx, nodeName) == nil
+func (c *Client) NewNode(ctx context.Context, nodeName string) (bool, error) {
+	node, err := c.getNode(ctx, nodeName)
+	return node == nil, err
 }
 
-func (c *Client) WaitForNode(ctx context.Context, nodeName string) {
+func (c *Client) WaitForNode(ctx context.Context, nodeName string) error {
 	log.WithField("node", nodeName).Infof("wait for node to join cluster")
-	retry(ctx, 10, func() error {
-		node := c.getNode(ctx, nodeName)
+	return retry(ctx, 10, func() error {
+		node, err := c.getNode(ctx, nodeName)
+		if err != nil {
+			return err
+		}
 		if node == nil {
 			return fmt.Errorf("node %s not found", nodeName)
 		}
@@ -49,47 +64,45 @@ func (c *Client) WaitForNode(ctx context.Context, nodeName string) {
 	})
 }
 
-func (c *Client) LabelNode(ctx context.Context, nodeName, key, value string) bool {
-	log.WithField("node", nodeName).Infof("label node")
-	patch := []byte(fmt.Sprintf(`{"metadata":{"labels":{%q:%q}}}`, key, value))
-	retry(ctx, 2, func() error {
-		_, err := c.k.CoreV1().Nodes().Patch(ctx, nodeName, types.MergePatchType, patch, metav1.PatchOptions{})
+// Uncordon removes the taints a drain sets from a node and makes it
+// schedulable again, undoing a drain that was not followed by a reboot.
+func (c *Client) Uncordon(ctx context.Context, nodeName string) error {
+	log.WithField("node", nodeName).Infof("uncordon node")
+	return retry(ctx, 2, func() error {
+		node, err := c.getNode(ctx, nodeName)
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			return nil
+		}
+		node.Spec.Unschedulable = false
+		node.Spec.Taints = slices.DeleteFunc(node.Spec.Taints, func(t corev1.Taint) bool {
+			return t.Key == ShutdownTaint || t.Key == FlannelUnavailableTaint
+		})
+		_, err = c.k.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
 		return err
 	})
-	return true
 }
 
-func (c *Client) Drain(ctx context.Context, nodeName string) {
-	log.WithField("node", nodeName).Infof("initiate node drain")
-	retry(ctx, 2, func() error {
-		node := c.getNode(ctx, nodeName)
-		node.Spec.Unschedulable = true
-
-		if !hasTaint("nais.io/nitro-shutdown", node.Spec.Taints) {
-			node.Spec.Taints = append(node.Spec.Taints, corev1.Taint{
-				Key:    "nais.io/nitro-shutdown",
-				Value:  "true",
-				Effect: corev1.TaintEffectNoExecute,
-			})
-		}
-
-		if !hasTaint("nais.io/flannel-unavailable", node.Spec.Taints) {
-			node.Spec.Taints = append(node.Spec.Taints, corev1.Taint{
-				Key:    "nais.io/flannel-unavailable",
-				Value:  "true",
-				Effect: corev1.TaintEffectNoSchedule,
-			})
-		}
-		if _, err := c.k.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{}); err != nil {
-			return err
+// DrainedNodes returns the nodes that have the shutdown taint.
+func (c *Client) DrainedNodes(ctx context.Context) ([]string, error) {
+	nodes, err := c.getNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, n := range nodes {
+		if hasTaint(ShutdownTaint, n.Spec.Taints) {
+			ret = append(ret, n.Name)
 		}
-		return nil
-	})
+	}
+	return ret, nil
 }
 
-func (c *Client) nodePods(ctx context.Context, nodeName string) []corev1.Pod {
+func (c *Client) nodePods(ctx context.Context, nodeName string) ([]corev1.Pod, error) {
 	var pods []corev1.Pod
-	retry(ctx, 2, func() error {
+	err := retry(ctx, 2, func() error {
 		resp, err := c.k.CoreV1().Pods("").List(ctx, metav1.ListOptions{
 			FieldSelector: fmt.Sprintf("spec.nodeName=%s", nodeName),
 		})
@@ -101,13 +114,13 @@ func (c *Client) nodePods(ctx context.Context, nodeName string) []corev1.Pod {
 		return nil
 	})
 
-	return pods
+	return pods, err
 }
 
-func (c *Client) getNodes(ctx context.Context) []corev1.Node {
+func (c *Client) getNodes(ctx context.Context) ([]corev1.Node, error) {
 	var nodes []corev1.Node
 	timeoutSeconds := int64(2)
-	retry(ctx, 5, func() error {
+	err := retry(ctx, 5, func() error {
 		resp, err := c.k.CoreV1().Nodes().List(ctx, metav1.ListOptions{TimeoutSeconds: &timeoutSeconds})
 		if err != nil {
 			return err
@@ -115,16 +128,20 @@ func (c *Client) getNodes(ctx context.Context) []corev1.Node {
 		nodes = resp.Items
 		return nil
 	})
-	return nodes
+	return nodes, err
 }
 
-func (c *Client) getNode(ctx context.Context, nodeName string) *corev1.Node {
-	for _, n := range c.getNodes(ctx) {
+func (c *Client) getNode(ctx context.Context, nodeName string) (*corev1.Node, error) {
+	nodes, err := c.getNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
 		if n.Name == nodeName {
-			return &n
+			return &n, nil
 		}
 	}
-	return nil
+	return nil, nil
 }
 
 func hasTaint(key string, taints []corev1.Taint) bool {
@@ -136,98 +153,40 @@ func hasTaint(key string, taints []corev1.Taint) bool {
 	return false
 }
 
-func (c *Client) isDaemonSet(ctx context.Context, podName string) bool {
-	var found bool
-	retry(ctx, 5, func() error {
-		resp, err := c.k.AppsV1().DaemonSets("").List(ctx, metav1.ListOptions{})
-		if err != nil {
-			return err
-		}
-		for _, ds := range resp.Items {
-			if strings.Contains(podName, ds.Name) {
-				found = true
-				return nil
-			}
-		}
-		found = false
-		return nil
-	})
-
-	return found
-}
-
-func (c *Client) DeleteNode(ctx context.Context, nodeName string) {
-	retry(ctx, 2, func() error {
+func (c *Client) DeleteNode(ctx context.Context, nodeName string) error {
+	return retry(ctx, 2, func() error {
 		return c.k.CoreV1().Nodes().Delete(ctx, nodeName, metav1.DeleteOptions{})
 	})
 }
 
-func (c *Client) Wait(ctx context.Context, nodeName string) {
-	maxWaitMinutes := 3
-	endTime := time.Now().Add(time.Duration(maxWaitMinutes) * 55 * time.Second)
-	log.WithField("node", nodeName).Infof("will wait until %s", endTime.Local().String())
-	retry(ctx, maxWaitMinutes, func() error {
-		remaining := len(c.remainingPods(ctx, nodeName))
-		if time.Now().After(endTime) {
-			log.WithField("node", nodeName).Warnf("abort wait on drain because of timeout")
-			return nil
-		}
-
-		if remaining > 0 {
-			return fmt.Errorf("pods remaining: %d", remaining)
-		}
-
-		log.WithField("node", nodeName).Infof("no pods left")
-		return nil
-	})
-}
-
-func (c *Client) remainingPods(ctx context.Context, node string) []string {
-	pods := c.nodePods(ctx, node)
-
-	var remaining []string
-
-	for _, pod := range pods {
-		if c.isDaemonSet(ctx, pod.Name) {
-			continue
-		}
-
-		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
-			continue
-		}
-
-		remaining = append(remaining, pod.Name)
-	}
-	return remaining
-}
-
-func retry(ctx context.Context, maxWaitMinutes int, f func() error) {
+func retry(ctx context.Context, maxWaitMinutes int, f func() error) error {
 	minutes := time.Duration(maxWaitMinutes)
 	maxWaitTime := minutes * time.Minute
 	const RetryInterval = 5 * time.Second
 
 	retryTicker := time.NewTicker(RetryInterval)
+	defer retryTicker.Stop()
 	ctx, cancel := context.WithTimeout(ctx, maxWaitTime)
 	defer cancel()
 
 	var log log.FieldLogger = log.StandardLogger()
-	panicExtra := ""
+	errExtra := ""
 	if name := GetName(ctx); name != "" {
 		log = log.WithField("node", name)
-		panicExtra = fmt.Sprintf(" (node: %s)", name)
+		errExtra = fmt.Sprintf(" (node: %s)", name)
 	}
 
 	for {
 		err := f()
 		if err == nil {
-			return
+			return nil
 		}
 
 		log.Infof("retrying in %s (max wait time: %s): %s", RetryInterval.String(), maxWaitTime.String(), err)
 
 		select {
 		case <-ctx.Done():
-			panic(fmt.Sprintf("stopping retry: retry context is done: %s%s", ctx.Err(), panicExtra))
+			return fmt.Errorf("%w: stopping retry: retry context is done: %s%s: %w", ErrTimeout, ctx.Err(), errExtra, err)
 		case <-retryTicker.C:
 		}
 	}
@@ -0,0 +1,156 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ErrNodeNotFound is returned when a node is not registered in the cluster.
+var ErrNodeNotFound = errors.New("node not found")
+
+// The annotations record which labels and taints of a node are managed by
+// nitro, so the ones removed from the cluster file are removed from the node
+// while labels and taints set by others are left alone.
+const (
+	ManagedLabelsAnnotation = "nais.io/nitro-managed-labels"
+	ManagedTaintsAnnotation = "nais.io/nitro-managed-taints"
+)
+
+// ReconcileNode makes the labels and taints managed by nitro on the node
+// match the given ones, with a strategic merge patch. It reports whether the
+// node was changed.
+func (c *Client) ReconcileNode(ctx context.Context, nodeName string, labels map[string]string, taints []corev1.Taint) (bool, error) {
+	if _, err := c.k.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{}); apierrors.IsNotFound(err) {
+		return false, fmt.Errorf("%w: %s", ErrNodeNotFound, nodeName)
+	}
+
+	changed := false
+	err := retry(ctx, 2, func() error {
+		node, err := c.k.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		patch, err := reconcilePatch(*node, labels, taints)
+		if err != nil || patch == nil {
+			return err
+		}
+		log.WithField("node", nodeName).Infof("reconciling labels and taints")
+		// the patch carries the resource version, so a concurrent change to
+		// the taints is a conflict and retried instead of overwritten
+		_, err = c.k.CoreV1().Nodes().Patch(ctx, nodeName, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+		if err == nil {
+			changed = true
+		}
+		return err
+	})
+	return changed, err
+}
+
+// reconcilePatch returns the patch that makes the managed labels and taints of
+// the node match the given ones, or nil if they already do.
+func reconcilePatch(node corev1.Node, labels map[string]string, taints []corev1.Taint) ([]byte, error) {
+	patchLabels := make(map[string]any)
+	for k, v := range labels {
+		if current, ok := node.Labels[k]; !ok || current != v {
+			patchLabels[k] = v
+		}
+	}
+	for _, k := range managed(node, ManagedLabelsAnnotation) {
+		if _, ok := labels[k]; !ok {
+			if _, ok := node.Labels[k]; ok {
+				patchLabels[k] = nil
+			}
+		}
+	}
+
+	annotations := make(map[string]any)
+	managedLabels := strings.Join(slices.Sorted(maps.Keys(labels)), ",")
+	if node.Annotations[ManagedLabelsAnnotation] != managedLabels {
+		annotations[ManagedLabelsAnnotation] = managedLabels
+	}
+	var taintKeys []string
+	for _, t := range taints {
+		taintKeys = append(taintKeys, taintKey(t))
+	}
+	slices.Sort(taintKeys)
+	managedTaints := strings.Join(taintKeys, ",")
+	if node.Annotations[ManagedTaintsAnnotation] != managedTaints {
+		annotations[ManagedTaintsAnnotation] = managedTaints
+	}
+
+	newTaints := reconcileTaints(node.Spec.Taints, managed(node, ManagedTaintsAnnotation), taints)
+	taintsChanged := !slices.EqualFunc(node.Spec.Taints, newTaints, func(a, b corev1.Taint) bool {
+		return a.Key == b.Key && a.Value == b.Value && a.Effect == b.Effect
+	})
+
+	if len(patchLabels) == 0 && len(annotations) == 0 && !taintsChanged {
+		return nil, nil
+	}
+
+	metadata := map[string]any{"resourceVersion": node.ResourceVersion}
+	if len(patchLabels) > 0 {
+		metadata["labels"] = patchLabels
+	}
+	if len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	}
+	patch := map[string]any{"metadata": metadata}
+	if taintsChanged {
+		// the taints of a node have no merge key, the list is replaced
+		patch["spec"] = map[string]any{"taints": newTaints}
+	}
+	return json.Marshal(patch)
+}
+
+// reconcileTaints replaces the previously managed taints of the node with the
+// given taints, keeping the order of the taints that stay.
+func reconcileTaints(current []corev1.Taint, previouslyManaged []string, taints []corev1.Taint) []corev1.Taint {
+	wanted := make(map[string]corev1.Taint)
+	for _, t := range taints {
+		wanted[taintKey(t)] = t
+	}
+
+	ret := make([]corev1.Taint, 0, len(current)+len(taints))
+	seen := make(map[string]bool)
+	for _, t := range current {
+		key := taintKey(t)
+		switch w, ok := wanted[key]; {
+		case ok:
+			t.Value = w.Value
+			seen[key] = true
+		case slices.Contains(previouslyManaged, key):
+			continue
+		}
+		ret = append(ret, t)
+	}
+	for _, t := range taints {
+		if key := taintKey(t); !seen[key] {
+			seen[key] = true
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
+func managed(node corev1.Node, annotation string) []string {
+	value := node.Annotations[annotation]
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+func taintKey(t corev1.Taint) string {
+	return t.Key + ":" + string(t.Effect)
+}
@@ -0,0 +1,83 @@
+package kubernetes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestReconcileNode(t *testing.T) {
+	ctx := context.Background()
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "worker1",
+			Labels: map[string]string{
+				"kubernetes.io/hostname": "worker1",
+				"nais.io/gpu":            "true",
+				"nais.io/pool":           "old",
+			},
+			Annotations: map[string]string{
+				ManagedLabelsAnnotation: "nais.io/gpu,nais.io/pool",
+				ManagedTaintsAnnotation: "nais.io/gpu:NoSchedule",
+			},
+		},
+		Spec: corev1.NodeSpec{
+			Taints: []corev1.Taint{
+				{Key: ShutdownTaint, Value: "true", Effect: corev1.TaintEffectNoSchedule},
+				{Key: "nais.io/gpu", Value: "true", Effect: corev1.TaintEffectNoSchedule},
+			},
+		},
+	}
+	c := &Client{k: fake.NewSimpleClientset(node)}
+
+	labels := map[string]string{"nais.io/pool": "new", "kubernetes.io/role": "worker"}
+	taints := []corev1.Taint{{Key: "nais.io/dedicated", Value: "batch", Effect: corev1.TaintEffectNoExecute}}
+	changed, err := c.ReconcileNode(ctx, "worker1", labels, taints)
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	got, err := c.k.CoreV1().Nodes().Get(ctx, "worker1", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"kubernetes.io/hostname": "worker1",
+		"kubernetes.io/role":     "worker",
+		"nais.io/pool":           "new",
+	}, got.Labels)
+	assert.Equal(t, []corev1.Taint{
+		{Key: ShutdownTaint, Value: "true", Effect: corev1.TaintEffectNoSchedule},
+		{Key: "nais.io/dedicated", Value: "batch", Effect: corev1.TaintEffectNoExecute},
+	}, got.Spec.Taints)
+	assert.Equal(t, "kubernetes.io/role,nais.io/pool", got.Annotations[ManagedLabelsAnnotation])
+	assert.Equal(t, "nais.io/dedicated:NoExecute", got.Annotations[ManagedTaintsAnnotation])
+
+	changed, err = c.ReconcileNode(ctx, "worker1", labels, taints)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	_, err = c.ReconcileNode(ctx, "worker2", labels, taints)
+	assert.ErrorIs(t, err, ErrNodeNotFound)
+}
+
+func TestReconcileTaints(t *testing.T) {
+	current := []corev1.Taint{
+		{Key: "a", Value: "1", Effect: corev1.TaintEffectNoSchedule},
+		{Key: "b", Value: "1", Effect: corev1.TaintEffectNoSchedule},
+		{Key: "c", Value: "1", Effect: corev1.TaintEffectNoSchedule},
+	}
+	wanted := []corev1.Taint{
+		{Key: "b", Value: "2", Effect: corev1.TaintEffectNoSchedule},
+		{Key: "d", Value: "1", Effect: corev1.TaintEffectNoSchedule},
+	}
+
+	// a is left alone, b is updated in place, c is no longer wanted
+	assert.Equal(t, []corev1.Taint{
+		{Key: "a", Value: "1", Effect: corev1.TaintEffectNoSchedule},
+		{Key: "b", Value: "2", Effect: corev1.TaintEffectNoSchedule},
+		{Key: "d", Value: "1", Effect: corev1.TaintEffectNoSchedule},
+	}, reconcileTaints(current, []string{"b:NoSchedule", "c:NoSchedule"}, wanted))
+}
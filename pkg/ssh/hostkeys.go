@@ -0,0 +1,175 @@
+package ssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ErrHostKeyMismatch is returned when a host presents a key that differs from
+// the one recorded for it.
+var ErrHostKeyMismatch = errors.New("host key mismatch")
+
+// HostKeys configures host key verification. With neither file set, host keys
+// are not verified.
+type HostKeys struct {
+	// KnownHostsFile is a known_hosts file that host keys are verified against.
+	KnownHostsFile string
+	// TofuStore is a known_hosts formatted file, typically committed to the
+	// cluster repo. Its entries are added to KnownHostsFile, and keys of hosts
+	// that are in neither file are trusted on first use and recorded in it.
+	TofuStore string
+}
+
+type hostKeyVerifier struct {
+	config HostKeys
+	mu     sync.Mutex
+}
+
+func newHostKeyVerifier(config HostKeys) (*hostKeyVerifier, error) {
+	if config.KnownHostsFile == "" && config.TofuStore == "" {
+		log.Warn("host keys are not verified, set a known hosts file to enable verification")
+		return nil, nil
+	}
+
+	for _, file := range []string{config.KnownHostsFile, config.TofuStore} {
+		if err := touch(file); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.KnownHostsFile != "" && config.TofuStore != "" {
+		if err := appendMissingLines(config.TofuStore, config.KnownHostsFile); err != nil {
+			return nil, fmt.Errorf("populating %s from %s: %w", config.KnownHostsFile, config.TofuStore, err)
+		}
+	}
+
+	return &hostKeyVerifier{config: config}, nil
+}
+
+// callback returns a host key callback for the given host. Keys are looked up
+// by hostname, as the ip of a node may change; keys trusted on first use are
+// recorded for both the hostname and the dialed ip.
+func (v *hostKeyVerifier) callback(host string) gossh.HostKeyCallback {
+	if v == nil {
+		return gossh.InsecureIgnoreHostKey()
+	}
+
+	return func(_ string, remote net.Addr, key gossh.PublicKey) error {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+
+		var files []string
+		for _, file := range []string{v.config.KnownHostsFile, v.config.TofuStore} {
+			if file != "" {
+				files = append(files, file)
+			}
+		}
+
+		check, err := knownhosts.New(files...)
+		if err != nil {
+			return fmt.Errorf("reading known hosts: %w", err)
+		}
+
+		address := net.JoinHostPort(host, "22")
+		err = check(address, remote, key)
+
+		var keyErr *knownhosts.KeyError
+		switch {
+		case err == nil:
+			return nil
+		case errors.As(err, &keyErr) && len(keyErr.Want) > 0:
+			return fmt.Errorf("%w: %s: %w", ErrHostKeyMismatch, host, err)
+		case errors.As(err, &keyErr) && v.config.TofuStore != "":
+			addresses := []string{knownhosts.Normalize(address)}
+			if tcp, ok := remote.(*net.TCPAddr); ok && tcp.IP.String() != host {
+				addresses = append(addresses, knownhosts.Normalize(remote.String()))
+			}
+			line := knownhosts.Line(addresses, key)
+			log.Infof("trusting %s key for %s on first use, recording it in %s", key.Type(), host, v.config.TofuStore)
+			return appendLine(v.config.TofuStore, line)
+		}
+		return fmt.Errorf("verifying host key of %s: %w", host, err)
+	}
+}
+
+func touch(file string) error {
+	if file == "" {
+		return nil
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func appendLine(file, line string) error {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func appendMissingLines(src, dst string) error {
+	dstLines, err := readLines(dst)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for _, line := range dstLines {
+		existing[line] = true
+	}
+
+	lines, err := readLines(src)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		if existing[line] {
+			continue
+		}
+		if err := appendLine(dst, line); err != nil {
+			return err
+		}
+		existing[line] = true
+	}
+	return nil
+}
+
+func readLines(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func(f *os.File) {
+		if err := f.Close(); err != nil {
+			log.WithError(err).Warnf("close %s", file)
+		}
+	}(f)
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
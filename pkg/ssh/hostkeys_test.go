@@ -0,0 +1,69 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func newPublicKey(t *testing.T) gossh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := gossh.NewPublicKey(pub)
+	require.NoError(t, err)
+	return key
+}
+
+func TestHostKeyVerifierTrustsOnFirstUse(t *testing.T) {
+	dir := t.TempDir()
+	verifier, err := newHostKeyVerifier(HostKeys{
+		KnownHostsFile: filepath.Join(dir, "known_hosts"),
+		TofuStore:      filepath.Join(dir, "tofu"),
+	})
+	require.NoError(t, err)
+
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+	key := newPublicKey(t)
+	callback := verifier.callback("worker1.domain.local")
+
+	assert.NoError(t, callback("10.0.0.1:22", remote, key), "unknown host is trusted on first use")
+	assert.NoError(t, callback("10.0.0.1:22", remote, key), "recorded key is accepted")
+
+	err = callback("10.0.0.1:22", remote, newPublicKey(t))
+	assert.ErrorIs(t, err, ErrHostKeyMismatch)
+
+	store, err := os.ReadFile(filepath.Join(dir, "tofu"))
+	require.NoError(t, err)
+	assert.Contains(t, string(store), "worker1.domain.local,10.0.0.1 ssh-ed25519")
+}
+
+func TestHostKeyVerifierRejectsUnknownWithoutTofu(t *testing.T) {
+	dir := t.TempDir()
+	knownHosts := filepath.Join(dir, "known_hosts")
+	tofu := filepath.Join(dir, "tofu")
+
+	key := newPublicKey(t)
+	require.NoError(t, appendLine(tofu, "worker1.domain.local "+string(gossh.MarshalAuthorizedKey(key))))
+
+	// entries in the store are copied to the known hosts file
+	_, err := newHostKeyVerifier(HostKeys{KnownHostsFile: knownHosts, TofuStore: tofu})
+	require.NoError(t, err)
+	lines, err := readLines(knownHosts)
+	require.NoError(t, err)
+	assert.Len(t, lines, 1)
+
+	verifier, err := newHostKeyVerifier(HostKeys{KnownHostsFile: knownHosts})
+	require.NoError(t, err)
+
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+	assert.NoError(t, verifier.callback("worker1.domain.local")("10.0.0.1:22", remote, key))
+	assert.Error(t, verifier.callback("worker2.domain.local")("10.0.0.2:22", remote, key))
+}
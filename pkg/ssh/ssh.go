@@ -1,35 +1,74 @@
 package ssh
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/melbahja/goph"
 	"github.com/nais/onprem/nitro/pkg/utils"
 	"github.com/nais/onprem/nitro/pkg/vars"
+	"github.com/pkg/sftp"
 	log "github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
 )
 
+// ErrHostUnreachable is returned when no ssh connection could be made to a host.
+var ErrHostUnreachable = errors.New("host unreachable")
+
+// ErrCommandFailed is returned when a command run on a host exits non-zero or
+// its session fails. The *ssh.ExitError with the exit status is wrapped.
+var ErrCommandFailed = errors.New("command failed")
+
+const dialTimeout = 60 * time.Second
+
+// Client keeps one ssh connection, and one sftp channel on it, per host. A
+// connection is reused by all calls for that host and redialed when it has
+// gone away, e.g. after a reboot.
 type Client struct {
 	auth         goph.Auth
 	identityFile string
 	user         string
+	port         uint
+	hostKeys     *hostKeyVerifier
+	resolver     vars.Resolver
+
+	mu    sync.Mutex
+	conns map[string]*conn
+}
+
+type conn struct {
+	mu     sync.Mutex
+	client *goph.Client
+	sftp   *sftp.Client
 }
 
-func New(user, privateKey string) *Client {
+func New(user, privateKey string, hostKeys HostKeys, resolver vars.Resolver) (*Client, error) {
 	auth, err := goph.Key(privateKey, "")
 	if err != nil {
-		log.WithError(err).Fatal("new ssh client")
+		return nil, fmt.Errorf("reading identity file %s: %w", privateKey, err)
+	}
+
+	verifier, err := newHostKeyVerifier(hostKeys)
+	if err != nil {
+		return nil, err
 	}
 
 	return &Client{
 		auth:         auth,
 		identityFile: privateKey,
 		user:         user,
-	}
+		port:         22,
+		hostKeys:     verifier,
+		resolver:     resolver,
+		conns:        make(map[string]*conn),
+	}, nil
 }
 
 func (c *Client) User() string {
@@ -40,113 +79,287 @@ func (c *Client) IdentityFile() string {
 	return c.identityFile
 }
 
+// Resolver is the resolver hosts are dialed with.
+func (c *Client) Resolver() vars.Resolver {
+	return c.resolver
+}
+
+// Close closes all cached connections.
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for host, conn := range c.conns {
+		conn.mu.Lock()
+		conn.close(host)
+		conn.mu.Unlock()
+	}
+	c.conns = make(map[string]*conn)
+}
+
+func (c *Client) hostConn(host string) *conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hc, ok := c.conns[host]
+	if !ok {
+		hc = &conn{}
+		c.conns[host] = hc
+	}
+	return hc
+}
+
+func (c *Client) connect(host string) (*goph.Client, error) {
+	hc := c.hostConn(host)
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	return c.dial(hc, host)
+}
+
+// dial returns the cached connection to the host, dialing a new one if there
+// is none or the cached one no longer answers keepalives. hc.mu must be held.
+func (c *Client) dial(hc *conn, host string) (*goph.Client, error) {
+	if hc.client != nil {
+		if _, _, err := hc.client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+			return hc.client, nil
+		}
+		log.Debugf("connection to %s lost, reconnecting", host)
+		hc.close(host)
+	}
+
+	ip, err := c.resolver.Resolve(host)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := goph.NewConn(&goph.Config{
+		User:     c.user,
+		Addr:     ip,
+		Port:     c.port,
+		Auth:     c.auth,
+		Timeout:  dialTimeout,
+		Callback: c.hostKeys.callback(host),
+	})
+	if err != nil {
+		if errors.Is(err, ErrHostKeyMismatch) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s@%s: %w", ErrHostUnreachable, c.user, host, err)
+	}
+
+	hc.client = client
+	return client, nil
+}
+
+func (c *Client) sftp(host string) (*sftp.Client, error) {
+	hc := c.hostConn(host)
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	client, err := c.dial(hc, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if hc.sftp == nil {
+		hc.sftp, err = client.NewSftp()
+		if err != nil {
+			return nil, fmt.Errorf("opening sftp channel to %s: %w", host, err)
+		}
+	}
+	return hc.sftp, nil
+}
+
+// disconnect drops the cached connection to the host.
+func (c *Client) disconnect(host string) {
+	hc := c.hostConn(host)
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.close(host)
+}
+
+func (hc *conn) close(host string) {
+	if hc.sftp != nil {
+		if err := hc.sftp.Close(); err != nil {
+			log.WithError(err).Debugf("close sftp channel to %s", host)
+		}
+		hc.sftp = nil
+	}
+	if hc.client != nil {
+		if err := hc.client.Close(); err != nil {
+			log.WithError(err).Debugf("close connection to %s", host)
+		}
+		hc.client = nil
+	}
+}
+
 func (c *Client) UploadFile(host, src, dst string) error {
-	ip := vars.ResolveIP(host)
-	client, err := goph.NewUnknown(c.user, ip, c.auth)
+	ftp, err := c.sftp(host)
+	if err != nil {
+		return err
+	}
+
+	local, err := os.Open(src)
 	if err != nil {
 		return err
 	}
+	defer local.Close()
 
-	return client.Upload(src, dst)
+	remote, err := ftp.Create(dst)
+	if err != nil {
+		return fmt.Errorf("creating %s on %s: %w", dst, host, err)
+	}
+
+	if _, err := io.Copy(remote, local); err != nil {
+		_ = remote.Close()
+		return err
+	}
+	return remote.Close()
 }
 
 func (c *Client) Reboot(host string) error {
+	defer c.disconnect(host)
+
 	err := c.ExecuteCommand(host, "sudo systemctl reboot")
-	if err != nil {
-		if err.Error() == "wait: remote command exited without exit status or exit signal" {
-			return nil
-		}
-		return err
+	// the connection goes away before the command exits
+	var exitMissing *gossh.ExitMissingError
+	if errors.As(err, &exitMissing) {
+		return nil
 	}
-	return nil
+	return err
 }
 
 func (c *Client) downloadFile(host, dst, src string) error {
-	ip := vars.ResolveIP(host)
-	client, err := goph.NewUnknown(c.user, ip, c.auth)
+	ftp, err := c.sftp(host)
+	if err != nil {
+		return err
+	}
+
+	remote, err := ftp.Open(src)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	local, err := os.Create(dst)
 	if err != nil {
 		return err
 	}
 
-	return client.Download(src, dst)
+	if _, err := io.Copy(local, remote); err != nil {
+		_ = local.Close()
+		return err
+	}
+	return local.Close()
 }
 
-func (c *Client) DownloadFile(host, dstFile, srcFile string) {
+// DownloadFile downloads a file if it exists on the host. A failed download is
+// only logged, as callers use it to fetch files that may not have been created
+// yet; an error is returned if the local file could not be cleaned up.
+func (c *Client) DownloadFile(host, dstFile, srcFile string) error {
 	err := c.downloadFile(host, dstFile, srcFile)
 	if err != nil {
 		log.Infof("could not download file %s from %s: %v", srcFile, host, err)
 		if utils.LocalFileExists(dstFile) {
 			f, err := os.Stat(dstFile)
 			if err != nil {
-				log.WithError(err).Fatalf("unable to inspect local file: %v:", dstFile)
+				return fmt.Errorf("unable to inspect local file %s: %w", dstFile, err)
 			}
 			if f.Size() == 0 {
 				if err := os.Remove(dstFile); err != nil {
-					log.WithError(err).Fatalf("unable to delete empty local file: %v", dstFile)
+					return fmt.Errorf("unable to delete empty local file %s: %w", dstFile, err)
 				}
 			}
 		}
 	} else {
 		log.Infof("downloaded file %s from %s", srcFile, host)
 	}
+	return nil
+}
+
+// FetchFile downloads a file that must exist on the host. Unlike DownloadFile
+// a failed download is returned, wrapping ErrHostUnreachable or
+// ErrHostKeyMismatch if the host could not be reached.
+func (c *Client) FetchFile(host, dstFile, srcFile string) error {
+	if err := c.downloadFile(host, dstFile, srcFile); err != nil {
+		return fmt.Errorf("downloading %s from %s: %w", srcFile, host, err)
+	}
+	log.Infof("downloaded file %s from %s", srcFile, host)
+	return nil
 }
 
+// DownloadDir downloads the files in a dir and its subdirs. Files that could
+// not be downloaded do not stop the others, and are returned in one error.
 func (c *Client) DownloadDir(host, dstDir, srcDir string) error {
 	log.Infof("downloading all files from %s:%s => %s", host, srcDir, dstDir)
 
-	out, err := c.ExecuteCommandWithOutput(host, "ls "+srcDir)
+	ftp, err := c.sftp(host)
 	if err != nil {
 		return err
 	}
 
-	files := strings.Split(out, "\n")
+	files, err := ftp.ReadDir(srcDir)
+	if err != nil {
+		return fmt.Errorf("listing %s on %s: %w", srcDir, host, err)
+	}
+
+	var errs []error
 	for _, file := range files {
-		srcFilePath := filepath.Join(srcDir, file)
-		dstFilePath := filepath.Join(dstDir, file)
-		if file == "" {
+		srcFilePath := path.Join(srcDir, file.Name())
+		dstFilePath := filepath.Join(dstDir, file.Name())
+		if file.IsDir() {
+			if err := os.MkdirAll(dstFilePath, 0o755); err != nil {
+				return err
+			}
+			if err := c.DownloadDir(host, dstFilePath, srcFilePath); err != nil {
+				errs = append(errs, err)
+			}
 			continue
 		}
-		c.DownloadFile(host, dstFilePath, srcFilePath)
+		if err := c.downloadFile(host, dstFilePath, srcFilePath); err != nil {
+			errs = append(errs, fmt.Errorf("downloading %s from %s: %w", srcFilePath, host, err))
+		}
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
 func (c *Client) ExecuteCommandWithOutput(host, command string) (string, error) {
-	ip := vars.ResolveIP(host)
-	client, err := goph.NewUnknown(c.user, ip, c.auth)
+	client, err := c.connect(host)
 	if err != nil {
 		return "", err
 	}
 
-	defer func(client *goph.Client) {
-		err := client.Close()
-		if err != nil {
-			log.WithError(err).Warning("close client")
-		}
-	}(client)
-
 	out, err := client.Run(command)
 	if err != nil {
-		return "", fmt.Errorf("executing ssh ExecuteCommand: error: '%s', output: '%s'", err, string(out))
+		return "", fmt.Errorf("%w: %s@%s: %w, output: '%s'", ErrCommandFailed, c.user, host, err, string(out))
 	}
 
 	return string(out), nil
 }
 
 func (c *Client) ExecuteCommand(host, command string) error {
-	ip := vars.ResolveIP(host)
-	client, err := goph.NewUnknown(c.user, ip, c.auth)
+	client, err := c.connect(host)
 	if err != nil {
 		return err
 	}
 
-	client.Config.Timeout = 60 * time.Second
-
 	out, err := client.Run(command)
 	if err != nil {
-		return fmt.Errorf("executing ssh command: error: '%s', output: '%s'", err, string(out))
+		return fmt.Errorf("%w: %s@%s: %w, output: '%s'", ErrCommandFailed, c.user, host, err, string(out))
 	}
 
 	return nil
 }
+
+// Sha256sum returns the checksum of a file on the host, or an empty string if
+// the file does not exist.
+func (c *Client) Sha256sum(host, path string) (string, error) {
+	current, err := c.ExecuteCommandWithOutput(host, "if sudo test -f "+path+"; then sudo sha256sum "+path+"; fi")
+	if err != nil {
+		return "", fmt.Errorf("getting checksum of %s for host %s@%s: %w", path, c.user, host, err)
+	}
+	if current == "" {
+		return "", nil
+	}
+	return strings.Split(current, " ")[0], nil
+}
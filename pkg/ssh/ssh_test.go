@@ -0,0 +1,171 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nais/onprem/nitro/pkg/vars"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// newTestClient returns a client for node1, served by an ssh server on
+// localhost that runs commands with run, and serves the local files over
+// sftp.
+func newTestClient(t *testing.T, run func(command string) (string, uint32)) *Client {
+	t.Helper()
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := gossh.NewSignerFromKey(hostKey)
+	require.NoError(t, err)
+	config := &gossh.ServerConfig{
+		PublicKeyCallback: func(gossh.ConnMetadata, gossh.PublicKey) (*gossh.Permissions, error) { return nil, nil },
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestConn(conn, config, run)
+		}
+	}()
+
+	_, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	block, err := gossh.MarshalPrivateKey(clientKey, "")
+	require.NoError(t, err)
+	identity := filepath.Join(t.TempDir(), "id")
+	require.NoError(t, os.WriteFile(identity, pem.EncodeToMemory(block), 0o600))
+
+	c, err := New("deployer", identity, HostKeys{}, &vars.StaticResolver{IPs: map[string]string{"node1": "127.0.0.1"}})
+	require.NoError(t, err)
+	c.port = uint(listener.Addr().(*net.TCPAddr).Port)
+	t.Cleanup(c.Close)
+	return c
+}
+
+func serveTestConn(conn net.Conn, config *gossh.ServerConfig, run func(string) (string, uint32)) {
+	_, chans, reqs, err := gossh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(gossh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				if req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp" {
+					_ = req.Reply(true, nil)
+					if server, err := sftp.NewServer(channel); err == nil {
+						_ = server.Serve()
+					}
+					return
+				}
+				if req.Type != "exec" {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				var exec struct{ Command string }
+				_ = gossh.Unmarshal(req.Payload, &exec)
+				_ = req.Reply(true, nil)
+				out, status := run(exec.Command)
+				_, _ = channel.Write([]byte(out))
+				_, _ = channel.SendRequest("exit-status", false, gossh.Marshal(struct{ Status uint32 }{status}))
+				return
+			}
+		}()
+	}
+}
+
+func TestExecuteCommandWrapsExitError(t *testing.T) {
+	c := newTestClient(t, func(command string) (string, uint32) {
+		if command == "false" {
+			return "nope", 3
+		}
+		return "ok", 0
+	})
+
+	out, err := c.ExecuteCommandWithOutput("node1", "true")
+	require.NoError(t, err)
+	assert.Equal(t, "ok", out)
+
+	_, err = c.ExecuteCommandWithOutput("node1", "false")
+	assert.ErrorIs(t, err, ErrCommandFailed)
+	var exitErr *gossh.ExitError
+	require.True(t, errors.As(err, &exitErr))
+	assert.Equal(t, 3, exitErr.ExitStatus())
+	assert.ErrorContains(t, err, "output: 'nope'")
+
+	err = c.ExecuteCommand("node1", "false")
+	assert.ErrorIs(t, err, ErrCommandFailed)
+	assert.True(t, errors.As(err, &exitErr))
+}
+
+func TestDownloadDir(t *testing.T) {
+	c := newTestClient(t, func(string) (string, uint32) { return "", 0 })
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "etcd"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "ca.pem"), []byte("ca"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "etcd/ca.pem"), []byte("etcd ca"), 0o600))
+
+	dst := t.TempDir()
+	require.NoError(t, c.DownloadDir("node1", dst, src))
+	b, err := os.ReadFile(filepath.Join(dst, "ca.pem"))
+	require.NoError(t, err)
+	assert.Equal(t, "ca", string(b))
+	b, err = os.ReadFile(filepath.Join(dst, "etcd/ca.pem"))
+	require.NoError(t, err)
+	assert.Equal(t, "etcd ca", string(b))
+
+	// a file that cannot be read does not stop the others
+	require.NoError(t, os.Symlink(filepath.Join(src, "gone"), filepath.Join(src, "broken.pem")))
+	dst = t.TempDir()
+	err = c.DownloadDir("node1", dst, src)
+	assert.ErrorContains(t, err, "downloading "+src+"/broken.pem from node1")
+	assert.FileExists(t, filepath.Join(dst, "etcd/ca.pem"))
+}
+
+func TestFetchFile(t *testing.T) {
+	c := newTestClient(t, func(string) (string, uint32) { return "", 0 })
+	src := filepath.Join(t.TempDir(), "config.ign")
+	require.NoError(t, os.WriteFile(src, []byte("config"), 0o600))
+
+	dst := filepath.Join(t.TempDir(), "config.ign")
+	require.NoError(t, c.FetchFile("node1", dst, src))
+	b, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	assert.Equal(t, "config", string(b))
+
+	err = c.FetchFile("node1", dst, src+".missing")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	c.port = uint(closed.Addr().(*net.TCPAddr).Port)
+	require.NoError(t, closed.Close())
+	c.disconnect("node1")
+	err = c.FetchFile("node1", dst, src)
+	assert.ErrorIs(t, err, ErrHostUnreachable)
+}
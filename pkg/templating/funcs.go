@@ -0,0 +1,289 @@
+package templating
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"gopkg.in/yaml.v3"
+)
+
+// funcs are the functions available in templates. include executes the named
+// templates of tpl.
+func (r *Renderer) funcs(tpl *template.Template) template.FuncMap {
+	return template.FuncMap{
+		"indent":       indent,
+		"nindent":      func(n int, s string) string { return "\n" + indent(n, s) },
+		"toYaml":       toYaml,
+		"toJson":       toJson,
+		"b64enc":       func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"sha256sum":    func(s string) string { sum := sha256.Sum256([]byte(s)); return hex.EncodeToString(sum[:]) },
+		"join":         join,
+		"split":        func(sep, s string) []string { return strings.Split(s, sep) },
+		"default":      defaultValue,
+		"required":     required,
+		"get":          get,
+		"cidrHost":     cidrHost,
+		"cidrNetmask":  cidrNetmask,
+		"cidrContains": cidrContains,
+		"include": func(name string, data any) (string, error) {
+			if tpl == nil {
+				return "", errors.New("include called while parsing")
+			}
+			var b bytes.Buffer
+			err := tpl.ExecuteTemplate(&b, name, data)
+			return b.String(), err
+		},
+		"file": r.file,
+	}
+}
+
+// indent indents every line of s with n spaces.
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+func toYaml(v any) (string, error) {
+	var b bytes.Buffer
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+func toJson(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// join joins the elements of a list, of any type, with sep.
+func join(sep string, list any) (string, error) {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return "", fmt.Errorf("join: %T is not a list", list)
+	}
+	elems := make([]string, v.Len())
+	for i := range elems {
+		elems[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+	return strings.Join(elems, sep), nil
+}
+
+// defaultValue returns given, or def if given is empty: nil, false, zero or an
+// empty string, list or map. A var given to default is looked up with get, see
+// optionalLookups, so {{ .unset | default "x" }} is "x".
+func defaultValue(def, given any) any {
+	if empty(given) {
+		return def
+	}
+	return given
+}
+
+func required(msg string, v any) (any, error) {
+	if v == nil || v == "" {
+		return nil, errors.New(msg)
+	}
+	return v, nil
+}
+
+// get returns the value at the keys of v, nil if a map does not have one:
+// {{ get . "proxy" "url" }} is .proxy.url, or nil if either is not set.
+func get(v any, keys ...string) (any, error) {
+	for _, key := range keys {
+		if v == nil {
+			return nil, nil
+		}
+		rv := reflect.Indirect(reflect.ValueOf(v))
+		switch {
+		case rv.Kind() == reflect.Map && rv.Type().Key().Kind() == reflect.String:
+			elem := rv.MapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()))
+			if !elem.IsValid() {
+				return nil, nil
+			}
+			v = elem.Interface()
+		case rv.Kind() == reflect.Struct:
+			field := rv.FieldByName(key)
+			if !field.IsValid() || !field.CanInterface() {
+				return nil, fmt.Errorf("get: %s has no field %s", rv.Type(), key)
+			}
+			v = field.Interface()
+		default:
+			return nil, fmt.Errorf("get: cannot get %s of %T", key, v)
+		}
+	}
+	return v, nil
+}
+
+// optionalLookups rewrites the vars given to default or required to lookups
+// with get, as in {{ .proxy.url | default "" }} or {{ required "msg" $.a }},
+// so a var that is not set is nil to them instead of failing the template
+// under missingkey=error.
+func optionalLookups(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			optionalLookups(child)
+		}
+	case *parse.ActionNode:
+		optionalLookups(n.Pipe)
+	case *parse.IfNode:
+		optionalLookups(&n.BranchNode)
+	case *parse.RangeNode:
+		optionalLookups(&n.BranchNode)
+	case *parse.WithNode:
+		optionalLookups(&n.BranchNode)
+	case *parse.BranchNode:
+		optionalLookups(n.Pipe)
+		optionalLookups(n.List)
+		optionalLookups(n.ElseList)
+	case *parse.TemplateNode:
+		optionalLookups(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		// .unset | default "x"
+		if first := n.Cmds[0]; len(n.Cmds) > 1 && optional(n.Cmds[len(n.Cmds)-1]) && len(first.Args) == 1 {
+			if args := lookup(first.Args[0]); args != nil {
+				first.Args = args
+			}
+		}
+		for _, cmd := range n.Cmds {
+			optionalLookups(cmd)
+		}
+	case *parse.CommandNode:
+		// default "x" .unset
+		if last := len(n.Args) - 1; optional(n) && last == 2 {
+			if args := lookup(n.Args[last]); args != nil {
+				pos := n.Args[last].Position()
+				n.Args[last] = &parse.PipeNode{NodeType: parse.NodePipe, Pos: pos, Cmds: []*parse.CommandNode{
+					{NodeType: parse.NodeCommand, Pos: pos, Args: args},
+				}}
+			}
+		}
+		for _, arg := range n.Args {
+			optionalLookups(arg)
+		}
+	case *parse.ChainNode:
+		optionalLookups(n.Node)
+	}
+}
+
+// optional reports whether the command is a call of default or required.
+func optional(cmd *parse.CommandNode) bool {
+	ident, ok := cmd.Args[0].(*parse.IdentifierNode)
+	return ok && (ident.Ident == "default" || ident.Ident == "required")
+}
+
+// lookup returns the args of a call of get that looks up a field of dot or a
+// variable, as .a.b is get . "a" "b", or nil for any other node.
+func lookup(node parse.Node) []parse.Node {
+	var root parse.Node
+	var keys []string
+	switch n := node.(type) {
+	case *parse.FieldNode:
+		root, keys = &parse.DotNode{NodeType: parse.NodeDot, Pos: n.Pos}, n.Ident
+	case *parse.VariableNode:
+		if len(n.Ident) < 2 {
+			return nil
+		}
+		root, keys = &parse.VariableNode{NodeType: parse.NodeVariable, Pos: n.Pos, Ident: n.Ident[:1]}, n.Ident[1:]
+	default:
+		return nil
+	}
+	args := []parse.Node{parse.NewIdentifier("get").SetPos(node.Position()), root}
+	for _, key := range keys {
+		args = append(args, &parse.StringNode{NodeType: parse.NodeString, Pos: node.Position(), Quoted: strconv.Quote(key), Text: key})
+	}
+	return args
+}
+
+func empty(v any) bool {
+	if v == nil {
+		return true
+	}
+	return reflect.ValueOf(v).IsZero() || isEmptyCollection(reflect.ValueOf(v))
+}
+
+func isEmptyCollection(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Array, reflect.String:
+		return v.Len() == 0
+	}
+	return false
+}
+
+func parseIPv4CIDR(cidr string) (*net.IPNet, error) {
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("%s is not an ipv4 cidr", cidr)
+	}
+	return network, nil
+}
+
+// cidrHost returns the nth address of the network, e.g. cidrHost 1
+// "10.254.0.0/16" is 10.254.0.1.
+func cidrHost(n int, cidr string) (string, error) {
+	network, err := parseIPv4CIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+	ones, bits := network.Mask.Size()
+	if n < 0 || uint64(n) >= uint64(1)<<(bits-ones) {
+		return "", fmt.Errorf("host %d is outside of %s", n, cidr)
+	}
+	ip := binary.BigEndian.Uint32(network.IP.To4()) + uint32(n)
+	return net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip)).String(), nil
+}
+
+// cidrNetmask returns the netmask of the network, e.g. 255.255.0.0.
+func cidrNetmask(cidr string) (string, error) {
+	network, err := parseIPv4CIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+	return net.IP(network.Mask).String(), nil
+}
+
+func cidrContains(cidr, ip string) (bool, error) {
+	network, err := parseIPv4CIDR(cidr)
+	if err != nil {
+		return false, err
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false, fmt.Errorf("invalid ip %q", ip)
+	}
+	return network.Contains(parsed), nil
+}
+
+// file returns the content of a file in the templates dir, as is.
+func (r *Renderer) file(name string) (string, error) {
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("file %s is outside of the templates dir", name)
+	}
+	b, err := os.ReadFile(filepath.Join(r.root, name))
+	return string(b), err
+}
@@ -0,0 +1,127 @@
+package templating
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// missingKey matches the error of a template using a var that is not set.
+// With include, the errors of the nested templates are part of the message;
+// the match is the innermost one, the action that used the var.
+var missingKey = regexp.MustCompile(`template: ([^:]+):(\d+):\d+: executing "[^"]*" at <([^>]*)>: map has no entry for key "([^"]*)"`)
+
+// executeError turns the error of rendering src into an ErrUnresolvedVariable
+// naming the template file, line and var, if that is what it is.
+func (r *Renderer) executeError(src string, err error) error {
+	var execErr template.ExecError
+	if !errors.As(err, &execErr) {
+		return fmt.Errorf("%w: %w", ErrTemplate, err)
+	}
+	m := missingKey.FindStringSubmatch(err.Error())
+	if m == nil {
+		return fmt.Errorf("%w: %w", ErrTemplate, err)
+	}
+	file := src
+	if name := m[1]; name != filepath.Base(src) {
+		file = filepath.Join(r.root, PartialsDir, name)
+	}
+	return fmt.Errorf("%w: %s:%s: variable %q is not set, at <%s>", ErrUnresolvedVariable, file, m[2], m[4], m[3])
+}
+
+// References returns the names of the vars the templates in templateDir and
+// the partials refer to. A var looked up with index, like index . "name", is
+// counted by any string that is its name, so vars are rather counted as used
+// than not.
+func (r *Renderer) References(templateDir string, recursive bool) (map[string]bool, error) {
+	refs := make(map[string]bool)
+	for _, tpl := range r.partials.Templates() {
+		if tpl.Tree != nil {
+			references(tpl.Tree.Root, refs)
+		}
+	}
+
+	err := filepath.WalkDir(templateDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != templateDir && d.IsDir() && (!recursive || d.Name() == PartialsDir) {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || strings.HasSuffix(path, VerbatimSuffix) {
+			return nil
+		}
+
+		tpl, err := r.partials.Clone()
+		if err != nil {
+			return err
+		}
+		tpl, err = tpl.Funcs(r.funcs(tpl)).ParseFiles(path)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrTemplate, err)
+		}
+		for _, t := range tpl.Templates() {
+			if t.Tree != nil {
+				references(t.Tree.Root, refs)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading templates in %s: %w", templateDir, err)
+	}
+	return refs, nil
+}
+
+func references(node parse.Node, refs map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			references(child, refs)
+		}
+	case *parse.ActionNode:
+		references(n.Pipe, refs)
+	case *parse.IfNode:
+		references(&n.BranchNode, refs)
+	case *parse.RangeNode:
+		references(&n.BranchNode, refs)
+	case *parse.WithNode:
+		references(&n.BranchNode, refs)
+	case *parse.BranchNode:
+		references(n.Pipe, refs)
+		references(n.List, refs)
+		references(n.ElseList, refs)
+	case *parse.TemplateNode:
+		references(n.Pipe, refs)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			references(cmd, refs)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			references(arg, refs)
+		}
+	case *parse.ChainNode:
+		references(n.Node, refs)
+	case *parse.FieldNode:
+		refs[n.Ident[0]] = true
+	case *parse.VariableNode:
+		// $.name
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			refs[n.Ident[1]] = true
+		}
+	case *parse.StringNode:
+		refs[n.Text] = true
+	}
+}
@@ -1,24 +1,125 @@
 package templating
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io/fs"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"text/template"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func templateFile(dst, src string, vars map[string]string) error {
-	err := os.MkdirAll(filepath.Dir(dst), 0755)
+var (
+	// ErrTemplate is returned when a template cannot be parsed or executed.
+	ErrTemplate = errors.New("template error")
+	// ErrUnresolvedVariable is returned when a template references a variable that is not set.
+	ErrUnresolvedVariable = errors.New("unresolved variable")
+)
+
+// ErrCollision is returned when two files are rendered to the same path.
+var ErrCollision = errors.New("output file collision")
+
+// PartialsDir is the dir in the templates dir whose templates can be used
+// from any template, by file name or by the names they define.
+const PartialsDir = "_partials"
+
+// LocationDir and NodeDir are the overlay dirs of a role dir:
+// <role>/_location/<location> and <role>/_node/<hostname>.
+const (
+	LocationDir = "_location"
+	NodeDir     = "_node"
+)
+
+// VerbatimSuffix marks a file that is copied as is instead of templated, like
+// a binary or pre-encoded file. The suffix is dropped from the copy.
+const VerbatimSuffix = ".verbatim"
+
+// Renderer renders templates with the function library and the partials of a
+// templates dir.
+type Renderer struct {
+	root     string
+	partials *template.Template
+
+	mu sync.Mutex
+	// written is the source of each file rendered, by output path
+	written map[string]string
+}
+
+// NewRenderer parses the partials of the templates dir root.
+func NewRenderer(root string) (*Renderer, error) {
+	r := &Renderer{root: root, written: make(map[string]string)}
+	r.partials = template.New(PartialsDir).Funcs(r.funcs(nil))
+
+	dir := filepath.Join(root, PartialsDir)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && path == dir {
+			return filepath.SkipDir
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if _, err := r.partials.New(filepath.ToSlash(name)).Parse(string(content)); err != nil {
+			return fmt.Errorf("%w: %w", ErrTemplate, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("parsing partials: %w", err)
+	}
+	for _, t := range r.partials.Templates() {
+		if t.Tree != nil {
+			optionalLookups(t.Tree.Root)
+		}
+	}
+	return r, nil
+}
+
+func (r *Renderer) templateFile(dst, src string, vars map[string]any) (err error) {
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
 	if err != nil {
 		return err
 	}
 
-	tpl, err := template.ParseFiles(src)
+	content, err := os.ReadFile(src)
 	if err != nil {
 		return err
 	}
+	tpl, err := r.partials.Clone()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrTemplate, err)
+	}
+	tpl = tpl.Funcs(r.funcs(tpl)).Option("missingkey=error")
+	file, err := tpl.New(filepath.Base(src)).Parse(string(content))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrTemplate, err)
+	}
+	// the clones share the trees of the partials, which are rewritten once
+	for _, t := range file.Templates() {
+		if partial := r.partials.Lookup(t.Name()); t.Tree != nil && (partial == nil || partial.Tree != t.Tree) {
+			optionalLookups(t.Tree.Root)
+		}
+	}
+
+	// render before creating dst, so a failed template leaves no half file
+	var b bytes.Buffer
+	if err := tpl.ExecuteTemplate(&b, filepath.Base(src), withoutNil(vars)); err != nil {
+		return r.executeError(src, err)
+	}
 
 	output, err := os.Create(dst)
 	if err != nil {
@@ -26,34 +127,143 @@ func templateFile(dst, src string, vars map[string]string) error {
 	}
 
 	defer func(output *os.File) {
-		err := output.Close()
-		if err != nil {
-			log.WithError(err).Fatalf("close file %s", output.Name())
+		if closeErr := output.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("close file %s: %w", output.Name(), closeErr)
 		}
 	}(output)
 
-	return tpl.Execute(output, vars)
+	_, err = output.Write(b.Bytes())
+	return err
 }
 
-func TemplateFiles(templateDir, outputDir string, vars map[string]string, recursive bool) {
+// TemplateFiles renders the templates in templateDir to outputDir. Templates
+// using a variable that is not set are all reported, in one error.
+func (r *Renderer) TemplateFiles(templateDir, outputDir string, vars map[string]any, recursive bool) error {
 	log.Infof("processing %s => %s", templateDir, outputDir)
-	err := filepath.WalkDir(templateDir, func(path string, d fs.DirEntry, err error) error {
+	files, err := layerFiles(templateDir, recursive)
+	if err != nil {
+		return fmt.Errorf("templating %s: %w", templateDir, err)
+	}
+	return r.render(files, outputDir, vars)
+}
+
+// TemplateLayers renders the templates of a role dir and its overlays to
+// outputDir. A file in an overlay replaces the file with the same path in the
+// layers before it. Overlays that do not exist are skipped.
+func (r *Renderer) TemplateLayers(outputDir string, vars map[string]any, roleDir string, overlays ...string) error {
+	log.Infof("processing %s => %s", roleDir, outputDir)
+	files, err := layerFiles(roleDir, true)
+	if err != nil {
+		return fmt.Errorf("templating %s: %w", roleDir, err)
+	}
+	for _, overlay := range overlays {
+		if _, err := os.Stat(overlay); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		log.Infof("applying overlay %s", overlay)
+		overlayFiles, err := layerFiles(overlay, true)
 		if err != nil {
-			log.WithError(err).Fatal("walkdir")
+			return fmt.Errorf("templating %s: %w", overlay, err)
 		}
+		maps.Copy(files, overlayFiles)
+	}
+	return r.render(files, outputDir, vars)
+}
 
-		if path != templateDir && d.IsDir() && !recursive {
-			return filepath.SkipDir
+// layerFiles returns the files of a layer by their path in the output dir.
+// Partials and overlay dirs are not part of the layer.
+func layerFiles(dir string, recursive bool) (map[string]string, error) {
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
 		}
 
-		if !d.IsDir() {
-			return templateFile(outputDir+"/"+d.Name(), path, vars)
+		if path != dir && d.IsDir() && (!recursive || slices.Contains([]string{PartialsDir, LocationDir, NodeDir}, d.Name())) {
+			return filepath.SkipDir
+		}
+		if d.IsDir() {
+			return nil
 		}
 
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		out := strings.TrimSuffix(rel, VerbatimSuffix)
+		if other, ok := files[out]; ok {
+			return fmt.Errorf("%w: %s and %s are both rendered to %s", ErrCollision, other, path, out)
+		}
+		files[out] = path
 		return nil
 	})
+	return files, err
+}
 
+// render renders the files, by their path in outputDir.
+func (r *Renderer) render(files map[string]string, outputDir string, vars map[string]any) error {
+	var unresolved []error
+	for _, out := range slices.Sorted(maps.Keys(files)) {
+		src := files[out]
+		dst := filepath.Join(outputDir, out)
+		if err := r.claim(dst, src); err != nil {
+			return err
+		}
+		if strings.HasSuffix(src, VerbatimSuffix) {
+			if err := copyFile(dst, src); err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := r.templateFile(dst, src, vars)
+		if errors.Is(err, ErrUnresolvedVariable) {
+			unresolved = append(unresolved, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("templating %s: %w", src, err)
+		}
+	}
+	return errors.Join(unresolved...)
+}
+
+// claim records that src is rendered to dst, and fails if another file
+// already was.
+func (r *Renderer) claim(dst, src string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if other, ok := r.written[dst]; ok && other != src {
+		return fmt.Errorf("%w: %s and %s are both rendered to %s", ErrCollision, other, src, dst)
+	}
+	r.written[dst] = src
+	return nil
+}
+
+// copyFile copies a verbatim file, keeping its mode.
+func copyFile(dst, src string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(src)
 	if err != nil {
-		log.WithError(err).Fatal("walkdir")
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(dst, content, info.Mode().Perm())
+}
+
+// withoutNil leaves out the vars that are set to null, so using them is an
+// error like using a var that is not set, instead of rendering "<no value>".
+func withoutNil(vars map[string]any) map[string]any {
+	ret := make(map[string]any, len(vars))
+	for k, v := range vars {
+		if v != nil {
+			ret[k] = v
+		}
 	}
+	return ret
 }
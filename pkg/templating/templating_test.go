@@ -0,0 +1,253 @@
+package templating
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+	return dir
+}
+
+func TestTemplateFilesWithPartials(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"_partials/units.tpl": `{{ define "unit" }}[Unit]
+Description={{ .name }}{{ end }}`,
+		"_partials/motd": "welcome to {{ .cluster_name }}",
+		"files/banner":   "{{ not templated }}",
+		"worker/config.ign.yaml": `units:
+  - contents: |{{ include "unit" . | nindent 6 }}
+motd: {{ template "motd" . }}
+banner: {{ file "files/banner" }}
+`,
+	})
+	out := t.TempDir()
+
+	r, err := NewRenderer(dir)
+	require.NoError(t, err)
+	require.NoError(t, r.TemplateFiles(filepath.Join(dir, "worker"), out, map[string]any{"cluster_name": "dev", "name": "kubelet"}, true))
+
+	b, err := os.ReadFile(filepath.Join(out, "config.ign.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, `units:
+  - contents: |
+      [Unit]
+      Description=kubelet
+motd: welcome to dev
+banner: {{ not templated }}
+`, string(b))
+
+	// the partials are not rendered as files of their own
+	require.NoError(t, r.TemplateFiles(dir, out, nil, false))
+	_, err = os.Stat(filepath.Join(out, "units.tpl"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestTemplateFilesKeepsDirs(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"worker/config.ign.yaml":        "{{ .a }}",
+		"worker/files/etc/motd":         "motd {{ .a }}",
+		"worker/units/motd":             "unit {{ .a }}",
+		"worker/files/blob.gz.verbatim": "{{ not templated }}",
+		"etcd/files/etc/motd":           "motd",
+		"etcd/files/etc/motd.verbatim":  "motd",
+		"apiserver/etc/motd":            "motd",
+	})
+	out := t.TempDir()
+
+	r, err := NewRenderer(dir)
+	require.NoError(t, err)
+	require.NoError(t, r.TemplateFiles(filepath.Join(dir, "worker"), out, map[string]any{"a": "1"}, true))
+	for name, want := range map[string]string{
+		"config.ign.yaml": "1",
+		"files/etc/motd":  "motd 1",
+		"units/motd":      "unit 1",
+		"files/blob.gz":   "{{ not templated }}",
+	} {
+		b, err := os.ReadFile(filepath.Join(out, name))
+		require.NoError(t, err, name)
+		assert.Equal(t, want, string(b), name)
+	}
+
+	// rendering the same files again is fine, another file to the same path is not
+	require.NoError(t, r.TemplateFiles(filepath.Join(dir, "worker"), out, map[string]any{"a": "1"}, true))
+	err = r.TemplateFiles(filepath.Join(dir, "apiserver"), filepath.Join(out, "files"), nil, true)
+	assert.ErrorIs(t, err, ErrCollision)
+
+	err = r.TemplateFiles(filepath.Join(dir, "etcd"), t.TempDir(), nil, true)
+	assert.ErrorIs(t, err, ErrCollision)
+}
+
+func TestTemplateLayers(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"worker/config.ign.yaml":                        "base",
+		"worker/files/proxy.env":                        "onprem proxy",
+		"worker/files/motd":                             "motd",
+		"worker/_location/azure/files/proxy.env":        "azure proxy",
+		"worker/_location/azure/files/waagent.conf":     "waagent",
+		"worker/_node/worker1/config.ign.yaml":          "worker1",
+		"worker/_node/worker1/files/motd.verbatim":      "{{ worker1 }}",
+		"worker/_node/worker2/files/collision":          "",
+		"worker/_node/worker2/files/collision.verbatim": "",
+	})
+
+	render := func(overlays ...string) map[string]string {
+		t.Helper()
+		r, err := NewRenderer(dir)
+		require.NoError(t, err)
+		out := t.TempDir()
+		require.NoError(t, r.TemplateLayers(out, nil, filepath.Join(dir, "worker"), overlays...))
+		files := make(map[string]string)
+		require.NoError(t, filepath.WalkDir(out, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			b, err := os.ReadFile(path)
+			rel, _ := filepath.Rel(out, path)
+			files[rel] = string(b)
+			return err
+		}))
+		return files
+	}
+
+	assert.Equal(t, map[string]string{
+		"config.ign.yaml": "base",
+		"files/proxy.env": "onprem proxy",
+		"files/motd":      "motd",
+	}, render(filepath.Join(dir, "worker/_location/onprem"), filepath.Join(dir, "worker/_node/worker3")))
+
+	assert.Equal(t, map[string]string{
+		"config.ign.yaml":    "worker1",
+		"files/proxy.env":    "azure proxy",
+		"files/waagent.conf": "waagent",
+		"files/motd":         "{{ worker1 }}",
+	}, render(filepath.Join(dir, "worker/_location/azure"), filepath.Join(dir, "worker/_node/worker1")))
+
+	r, err := NewRenderer(dir)
+	require.NoError(t, err)
+	err = r.TemplateLayers(t.TempDir(), nil, filepath.Join(dir, "worker"), filepath.Join(dir, "worker/_node/worker2"))
+	assert.ErrorIs(t, err, ErrCollision)
+}
+
+func TestFuncs(t *testing.T) {
+	r, err := NewRenderer(t.TempDir())
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		tpl  string
+		vars map[string]any
+		want string
+	}{
+		{`{{ "a\nb" | indent 2 }}`, nil, "  a\n  b"},
+		{`x:{{ "a: 1" | nindent 2 }}`, nil, "x:\n  a: 1"},
+		{`{{ .v | toYaml }}`, map[string]any{"v": map[string]any{"a": []any{"b"}}}, "a:\n  - b"},
+		{`{{ .v | toJson }}`, map[string]any{"v": []string{"a"}}, `["a"]`},
+		{`{{ "hei" | b64enc }}`, nil, "aGVp"},
+		{`{{ "hei" | sha256sum }}`, nil, "f9d1af62d004d4da648929bc7dde552685979d6e6a78dc8f9b64eb08e9c4ccb7"},
+		{`{{ .v | join "," }}`, map[string]any{"v": []any{"a", 1}}, "a,1"},
+		{`{{ index (split "," "a,b") 1 }}`, nil, "b"},
+		{`{{ index . "missing" | default "x" }}`, map[string]any{}, "x"},
+		{`{{ .v | default "x" }}`, map[string]any{"v": "y"}, "y"},
+		{`{{ .v | default "x" }}`, map[string]any{"v": []any{}}, "x"},
+		{`{{ .unset | default "x" }}`, map[string]any{}, "x"},
+		{`{{ .proxy.url | default "x" }}`, map[string]any{}, "x"},
+		{`{{ .proxy.url | default "x" }}`, map[string]any{"proxy": map[string]any{"url": "y"}}, "y"},
+		{`{{ default "x" .unset }}`, map[string]any{}, "x"},
+		{`{{ range .l }}{{ $.unset | default .Name }}{{ end }}`, map[string]any{"l": []struct{ Name string }{{"a"}}}, "a"},
+		{`{{ get . "proxy" "url" }}`, map[string]any{"proxy": map[string]any{"url": "y"}}, "y"},
+		{`{{ cidrHost 10 "10.254.0.0/16" }}`, nil, "10.254.0.10"},
+		{`{{ cidrNetmask "10.254.0.0/16" }}`, nil, "255.255.0.0"},
+		{`{{ cidrContains "10.254.0.0/16" "10.254.3.4" }}`, nil, "true"},
+	} {
+		dir := writeFiles(t, map[string]string{"t": tc.tpl})
+		out := t.TempDir()
+		require.NoError(t, r.templateFile(filepath.Join(out, "t"), filepath.Join(dir, "t"), tc.vars), tc.tpl)
+		b, err := os.ReadFile(filepath.Join(out, "t"))
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, string(b), tc.tpl)
+	}
+
+	for _, tpl := range []string{
+		`{{ index . "missing" | required "missing is required" }}`,
+		`{{ .missing | required "missing is required" }}`,
+		`{{ get "a" "b" }}`,
+		`{{ cidrHost 256 "10.0.0.0/24" }}`,
+		`{{ cidrNetmask "fd00::/64" }}`,
+		`{{ file "../outside" }}`,
+	} {
+		dir := writeFiles(t, map[string]string{"t": tpl})
+		assert.ErrorIs(t, r.templateFile(filepath.Join(t.TempDir(), "t"), filepath.Join(dir, "t"), map[string]any{}), ErrTemplate, tpl)
+	}
+
+	// an unset var not given to default or required still fails
+	dir := writeFiles(t, map[string]string{"t": `{{ .unset | printf "%s" }}`})
+	assert.ErrorIs(t, r.templateFile(filepath.Join(t.TempDir(), "t"), filepath.Join(dir, "t"), map[string]any{}), ErrUnresolvedVariable)
+}
+
+func TestUnresolvedVariables(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"_partials/unit.tpl": "{{ define \"unit\" }}\n{{ .name }}{{ end }}",
+		"worker/a.yaml":      "a: {{ .a }}\nb: {{ .proxy.url }}\n",
+		"worker/b.yaml":      "{{ include \"unit\" . }}",
+		"worker/c.yaml":      "c: {{ .c }}",
+	})
+	out := t.TempDir()
+
+	r, err := NewRenderer(dir)
+	require.NoError(t, err)
+	err = r.TemplateFiles(filepath.Join(dir, "worker"), out, map[string]any{"a": "1", "proxy": map[string]any{}, "c": nil}, true)
+	require.ErrorIs(t, err, ErrUnresolvedVariable)
+	assert.ErrorContains(t, err, filepath.Join(dir, "worker/a.yaml")+`:2: variable "url" is not set, at <.proxy.url>`)
+	assert.ErrorContains(t, err, filepath.Join(dir, "_partials/unit.tpl")+`:2: variable "name" is not set, at <.name>`)
+	assert.ErrorContains(t, err, filepath.Join(dir, "worker/c.yaml")+`:1: variable "c" is not set, at <.c>`)
+
+	_, err = os.Stat(filepath.Join(out, "a.yaml"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestDefaultInPartials(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"_partials/proxy.tpl": `{{ define "proxy" }}{{ .proxy | default "none" }}{{ end }}`,
+		"worker/a":            `{{ include "proxy" . }} {{ .port | default 80 }}`,
+	})
+	out := t.TempDir()
+
+	r, err := NewRenderer(dir)
+	require.NoError(t, err)
+	for range 2 {
+		require.NoError(t, r.TemplateFiles(filepath.Join(dir, "worker"), out, map[string]any{}, false))
+		b, err := os.ReadFile(filepath.Join(out, "a"))
+		require.NoError(t, err)
+		assert.Equal(t, "none 80", string(b))
+	}
+}
+
+func TestReferences(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"_partials/unit.tpl": `{{ define "unit" }}{{ .unit_name }}{{ end }}`,
+		"worker/a.yaml":      `{{ .a }}{{ range .list }}{{ $.b }}{{ .Hostname }}{{ end }}{{ if .c }}{{ index . "d" }}{{ else }}{{ .e.f }}{{ end }}`,
+		"worker/nested/b":    `{{ template "unit" . }}{{ with .g }}{{ . }}{{ end }}`,
+		"etcd/c":             `{{ .h }}`,
+	})
+
+	r, err := NewRenderer(dir)
+	require.NoError(t, err)
+	refs, err := r.References(filepath.Join(dir, "worker"), true)
+	require.NoError(t, err)
+	for _, name := range []string{"unit_name", "a", "list", "b", "c", "d", "e", "g"} {
+		assert.True(t, refs[name], name)
+	}
+	assert.False(t, refs["f"])
+	assert.False(t, refs["h"])
+}
@@ -0,0 +1,64 @@
+package transpile
+
+import (
+	"errors"
+	"fmt"
+
+	butane "github.com/coreos/butane/config"
+	"github.com/coreos/butane/config/common"
+	"github.com/coreos/ignition/v2/config/v3_4"
+	"github.com/coreos/vcontext/report"
+	"gopkg.in/yaml.v3"
+)
+
+// translateButane translates a Butane config of the flatcar variant to
+// Ignition 3.x with the upstream translator. Local contents, trees and local
+// ssh keys and unit contents are read from filesDir. Warnings, such as a
+// misspelled key, fail the translation like butane --strict does, and the
+// result is validated against the spec.
+func translateButane(data []byte, filesDir string) ([]byte, error) {
+	var header struct {
+		Variant string `yaml:"variant"`
+	}
+	if err := yaml.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("parsing butane config: %w", err)
+	}
+	if header.Variant != "flatcar" {
+		return nil, fmt.Errorf("butane variant %q, must be flatcar", header.Variant)
+	}
+
+	out, rpt, err := butane.TranslateBytes(data, common.TranslateBytesOptions{
+		TranslateOptions: common.TranslateOptions{FilesDir: filesDir},
+	})
+	if err != nil {
+		return nil, reportError(err, rpt)
+	}
+	for _, entry := range rpt.Entries {
+		if entry.Kind == report.Warn {
+			return nil, reportError(errors.New("config has warnings"), rpt)
+		}
+	}
+	if err := Validate(out); err != nil {
+		return nil, fmt.Errorf("translated config: %w", err)
+	}
+	return out, nil
+}
+
+// Validate parses an Ignition 3.x config of a spec version up to 3.4.0, the
+// one Butane flatcar 1.1.0 translates to, and validates it against its spec.
+func Validate(data []byte) error {
+	_, rpt, err := v3_4.ParseCompatibleVersion(data)
+	if err != nil {
+		return reportError(err, rpt)
+	}
+	return nil
+}
+
+// reportError returns err with the entries of the report, which have the
+// path and line of what is wrong.
+func reportError(err error, rpt report.Report) error {
+	if len(rpt.Entries) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w:\n%s", err, rpt.String())
+}
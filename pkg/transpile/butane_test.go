@@ -0,0 +1,115 @@
+package transpile
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranslateButane(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"files/etc/motd":        "hei",
+		"tree/bin/tool":         "#!/bin/sh",
+		"tree/etc/tool.conf":    "a=1",
+		"units/kubelet.service": "[Install]\nWantedBy=multi-user.target\n",
+		"keys/alice.pub":        "ssh-ed25519 a1\n# comment\n\nssh-ed25519 a2\n",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+	require.NoError(t, os.Chmod(filepath.Join(dir, "tree/bin/tool"), 0o755))
+
+	out, err := translateButane([]byte(`
+variant: flatcar
+version: 1.1.0
+passwd:
+  users:
+    - name: alice
+      ssh_authorized_keys: [ssh-ed25519 a0]
+      ssh_authorized_keys_local: [keys/alice.pub]
+storage:
+  files:
+    - path: /etc/motd
+      mode: 0644
+      contents:
+        local: files/etc/motd
+    - path: /etc/hosts
+      append:
+        - inline: 10.0.0.1 apiserver
+  trees:
+    - local: tree
+      path: /opt
+  disks:
+    - device: /dev/sdb
+      wipe_table: true
+      partitions:
+        - number: 1
+          size_mib: 1024
+systemd:
+  units:
+    - name: kubelet.service
+      enabled: true
+      contents_local: units/kubelet.service
+`), dir)
+	require.NoError(t, err)
+
+	var got map[string]any
+	require.NoError(t, json.Unmarshal(out, &got))
+	var want map[string]any
+	require.NoError(t, json.Unmarshal([]byte(`{
+  "ignition": {"version": "3.4.0"},
+  "passwd": {"users": [{"name": "alice", "sshAuthorizedKeys": ["ssh-ed25519 a0", "ssh-ed25519 a1", "# comment", "ssh-ed25519 a2"]}]},
+  "storage": {
+    "files": [
+      {"path": "/etc/motd", "mode": 420, "contents": {"compression": "", "source": "data:,hei"}},
+      {"path": "/etc/hosts", "append": [{"compression": "", "source": "data:,10.0.0.1%20apiserver"}]},
+      {"path": "/opt/bin/tool", "mode": 493, "contents": {"compression": "", "source": "data:,%23!%2Fbin%2Fsh"}},
+      {"path": "/opt/etc/tool.conf", "mode": 420, "contents": {"compression": "", "source": "data:,a%3D1"}}
+    ],
+    "disks": [{"device": "/dev/sdb", "wipeTable": true, "partitions": [{"number": 1, "sizeMiB": 1024}]}]
+  },
+  "systemd": {"units": [{"name": "kubelet.service", "enabled": true, "contents": "[Install]\nWantedBy=multi-user.target\n"}]}
+}`), &want))
+	assert.Equal(t, want, got)
+}
+
+func TestTranslateButaneErrors(t *testing.T) {
+	for name, config := range map[string]string{
+		"variant":      "variant: fcos\nversion: 1.0.0\n",
+		"version":      "variant: flatcar\nversion: 2.0.0\n",
+		"outside":      "variant: flatcar\nversion: 1.0.0\nstorage:\n  files:\n    - path: /a\n      contents:\n        local: ../a\n",
+		"missing":      "variant: flatcar\nversion: 1.0.0\nstorage:\n  files:\n    - path: /a\n      contents:\n        local: a\n",
+		"inline+local": "variant: flatcar\nversion: 1.1.0\nstorage:\n  files:\n    - path: /a\n      contents:\n        inline: a\n        local: a\n",
+	} {
+		_, err := translateButane([]byte(config), t.TempDir())
+		assert.Error(t, err, name)
+	}
+
+	for config, want := range map[string]string{
+		"storage:\n  files:\n    - path: /a\n      mdoe: 420\n":                                                      "warning at $.storage.files.0.mdoe, line 6 col 7: unused key mdoe",
+		"storage:\n  disks:\n    - device: /dev/sdb\n      partitions:\n        - number: 1\n          sizeMiB: 1\n": "unused key sizeMiB",
+		"systemd:\n  units:\n    - name: a.service\n      enabled: yes please\n":                                     "cannot unmarshal !!str `yes please` into bool",
+		"storage:\n  luks:\n    - name: root\n      device: /dev/sda\n      discard: true\n":                         "$.storage.luks.0.discard, line 7 col 7: unused key discard",
+		"storage:\n  files:\n    - path: etc/motd\n":                                                                 "error at $.storage.files.0.path, line 5 col 13: path not absolute",
+		"systemd:\n  units:\n    - enabled: true\n":                                                                  "$.systemd.units.0.name",
+		"ignition:\n  version: 3.4.0\n":                                                                              "unused key version",
+	} {
+		_, err := translateButane([]byte("variant: flatcar\nversion: 1.0.0\n"+config), t.TempDir())
+		assert.ErrorContains(t, err, want, config)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for name, want := range map[string]Format{"": CLC, "clc": CLC, "butane": Butane} {
+		format, err := ParseFormat(name)
+		require.NoError(t, err)
+		assert.Equal(t, want, format)
+	}
+	_, err := ParseFormat("ignition")
+	assert.Error(t, err)
+}
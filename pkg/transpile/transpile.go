@@ -2,63 +2,168 @@ package transpile
 
 import (
 	"encoding/json"
-	"flag"
-	"io"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/vincent-petithory/dataurl"
+	"gopkg.in/yaml.v3"
 
 	"github.com/flatcar/container-linux-config-transpiler/config"
 )
 
-func init() {
-	flag.String("files-dir", "lol-hack", "")
+// ErrTranspile is returned when a container linux config cannot be converted to ignition.
+var ErrTranspile = errors.New("transpile error")
+
+// Format is the format of the config templates of a cluster.
+type Format string
+
+const (
+	// CLC is a Container Linux Config, transpiled to Ignition 2.x.
+	CLC Format = "clc"
+	// Butane is a Butane config of the flatcar variant, translated to
+	// Ignition 3.x.
+	Butane Format = "butane"
+)
+
+// ParseFormat returns the format with the name, CLC if it is empty.
+func ParseFormat(name string) (Format, error) {
+	switch Format(name) {
+	case "", CLC:
+		return CLC, nil
+	case Butane:
+		return Butane, nil
+	}
+	return "", fmt.Errorf("unknown config format %q, must be %s or %s", name, CLC, Butane)
 }
 
-func Run(src, dst, configDir string) {
-	inFile, err := os.Open(src)
+// Run converts the config in src to ignition in dst. Files the config refers
+// to as local are read from filesDir.
+func Run(format Format, src, dst, filesDir string) error {
+	dataIn, err := os.ReadFile(src)
 	if err != nil {
-		log.WithError(err).Fatal("opening ignition file")
+		return fmt.Errorf("reading ignition file: %w", err)
 	}
 
-	dataIn, err := io.ReadAll(inFile)
+	dataOut, err := Transpile(format, dataIn, filesDir)
 	if err != nil {
-		log.WithError(err).Fatal("reading bytes")
+		return fmt.Errorf("%w: %s: %w", ErrTranspile, src, err)
+	}
+
+	if err := os.WriteFile(dst, dataOut, 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", dst, err)
+	}
+	log.Infof("transpiled ignition file %s from %s", dst, src)
+	return nil
+}
+
+// Transpile converts a config to ignition. Files the config refers to as
+// local are read from filesDir. It is safe to call concurrently.
+func Transpile(format Format, data []byte, filesDir string) ([]byte, error) {
+	if format == Butane {
+		return translateButane(data, filesDir)
 	}
 
-	// hack
-	if err := flag.Set("files-dir", configDir); err != nil {
-		log.WithError(err).Fatalf("setting files-dir flag to %s", configDir)
+	data, err := inlineLocalFiles(data, filesDir)
+	if err != nil {
+		return nil, err
 	}
 
-	cfg, ast, report := config.Parse(dataIn)
+	cfg, ast, report := config.Parse(data)
 	if len(report.Entries) > 0 {
-		for i, entry := range report.Entries {
-			log.Errorf("entry %d: %s - %s", i, entry.Kind.String(), entry.Message)
-		}
-		log.WithError(err).Fatalf("config parse has error entries, report: %s", report.String())
+		return nil, fmt.Errorf("config parse has error entries, report: %s", report.String())
 	}
 
 	ignCfg, report := config.Convert(cfg, "", ast)
 	if len(report.Entries) > 0 {
-		for i, entry := range report.Entries {
-			log.Errorf("entry %d: %s - %s", i, entry.Kind.String(), entry.Message)
-		}
-		log.WithError(err).Fatalf("config convert has error entries, report: %s", report.String())
+		return nil, fmt.Errorf("config convert has error entries, report: %s", report.String())
 	}
 
 	dataOut, err := json.Marshal(&ignCfg)
 	if err != nil {
-		log.WithError(err).Fatalf("failed to marshal output: %v", err)
+		return nil, fmt.Errorf("failed to marshal output: %w", err)
 	}
+	return dataOut, nil
+}
 
-	outFile, err := os.Create(dst)
-	if err != nil {
-		log.WithError(err).Fatalf("failed to create: %v", err)
+// inlineLocalFiles replaces the local contents of the files of a container
+// linux config with a data url of the file in filesDir, which is what the
+// transpiler would make of them given its files-dir flag. The config is
+// returned as is if it has no local files; otherwise it is reformatted, so
+// the lines in the reports of the transpiler may be off.
+func inlineLocalFiles(data []byte, filesDir string) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parsing container linux config: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return data, nil
 	}
 
-	if _, err := outFile.Write(dataOut); err != nil {
-		log.WithError(err).Fatalf("failed to write: %v", err)
+	changed := false
+	files := child(child(doc.Content[0], "storage"), "files")
+	if files == nil || files.Kind != yaml.SequenceNode {
+		return data, nil
 	}
-	log.Infof("transpiled ignition file %s from %s", dst, src)
+	for _, file := range files.Content {
+		contents := child(file, "contents")
+		if contents == nil || contents.Kind != yaml.MappingNode {
+			continue
+		}
+		for i := 0; i+1 < len(contents.Content); i += 2 {
+			key, value := contents.Content[i], contents.Content[i+1]
+			if key.Value != "local" {
+				continue
+			}
+			b, err := readLocal(filesDir, value.Value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", value.Line, err)
+			}
+			key.Value = "remote"
+			contents.Content[i+1] = &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+				{Kind: yaml.ScalarNode, Value: "url"},
+				{Kind: yaml.ScalarNode, Value: "data:," + dataurl.Escape(b)},
+			}}
+			changed = true
+		}
+	}
+	if !changed {
+		return data, nil
+	}
+	return yaml.Marshal(&doc)
+}
+
+// child returns the value of the key in a yaml mapping, nil if there is none.
+func child(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// localPath returns the path of a local file, which must be in filesDir.
+func localPath(filesDir, local string) (string, error) {
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("local file %s is not in the files dir", local)
+	}
+	return filepath.Join(filesDir, local), nil
+}
+
+func readLocal(filesDir, local string) ([]byte, error) {
+	p, err := localPath(filesDir, local)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("reading local file: %w", err)
+	}
+	return b, nil
 }
@@ -0,0 +1,61 @@
+package transpile
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranspileCLCLocalFiles(t *testing.T) {
+	const clc = `storage:
+  files:
+    - path: /etc/motd
+      filesystem: root
+      mode: 0644
+      contents:
+        local: files/motd
+    - path: /etc/issue
+      filesystem: root
+      mode: 0644
+      contents:
+        inline: hei
+`
+	// each node has its own files dir, and nodes are transpiled concurrently
+	var wg sync.WaitGroup
+	for i := range 8 {
+		dir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "files"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "files/motd"), fmt.Appendf(nil, "node %d", i), 0o644))
+		wg.Go(func() {
+			out, err := Transpile(CLC, []byte(clc), dir)
+			if !assert.NoError(t, err) {
+				return
+			}
+			var cfg struct {
+				Storage struct {
+					Files []struct {
+						Path     string `json:"path"`
+						Contents struct {
+							Source string `json:"source"`
+						} `json:"contents"`
+					} `json:"files"`
+				} `json:"storage"`
+			}
+			require.NoError(t, json.Unmarshal(out, &cfg))
+			assert.Equal(t, fmt.Sprintf("data:,node%%20%d", i), cfg.Storage.Files[0].Contents.Source)
+			assert.Equal(t, "data:,hei", cfg.Storage.Files[1].Contents.Source)
+		})
+	}
+	wg.Wait()
+
+	_, err := Transpile(CLC, []byte(clc), t.TempDir())
+	assert.ErrorContains(t, err, "line 7: reading local file")
+	_, err = Transpile(CLC, []byte("storage:\n  files:\n    - path: /a\n      contents:\n        local: ../a\n"), t.TempDir())
+	assert.ErrorContains(t, err, "not in the files dir")
+}
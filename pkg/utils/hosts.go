@@ -6,11 +6,7 @@ import (
 	"github.com/nais/onprem/nitro/pkg/vars"
 )
 
-func GenerateHosts(clusterWithLocation map[string][]vars.Node, resolveIp func(string) string) string {
-	if resolveIp == nil {
-		resolveIp = vars.ResolveIP
-	}
-
+func GenerateHosts(clusterWithLocation map[string][]vars.Node, resolveIp func(string) (string, error)) (string, error) {
 	var hostnames []string
 
 	for _, nodes := range clusterWithLocation {
@@ -25,8 +21,12 @@ func GenerateHosts(clusterWithLocation map[string][]vars.Node, resolveIp func(st
 
 	sortedRetVal := ""
 	for _, hostname := range hostnames {
-		sortedRetVal += resolveIp(hostname) + " " + hostname + "\n"
+		ip, err := resolveIp(hostname)
+		if err != nil {
+			return "", err
+		}
+		sortedRetVal += ip + " " + hostname + "\n"
 	}
 
-	return sortedRetVal
+	return sortedRetVal, nil
 }
@@ -7,8 +7,8 @@ import (
 	"github.com/nais/onprem/nitro/pkg/vars"
 )
 
-func resolveIpFake(hostname string) string {
-	return "10.0.0.1"
+func resolveIpFake(hostname string) (string, error) {
+	return "10.0.0.1", nil
 }
 
 func TestGenerateHosts(t *testing.T) {
@@ -36,7 +36,10 @@ func TestGenerateHosts(t *testing.T) {
 10.0.0.1 worker-ci-5
 `
 
-	result := GenerateHosts(clusterWithLocation, resolveIpFake)
+	result, err := GenerateHosts(clusterWithLocation, resolveIpFake)
+	if err != nil {
+		t.Fatalf("GenerateHosts() error: %v", err)
+	}
 
 	cmp := cmp.Diff(result, expectedResult)
 	if cmp != "" {
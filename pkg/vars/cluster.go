@@ -0,0 +1,283 @@
+package vars
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/nais/onprem/nitro/pkg/transpile"
+	"gopkg.in/yaml.v3"
+)
+
+// ClusterVersion is the version of the cluster file format. Files without a
+// version are read as this version.
+const ClusterVersion = 1
+
+// Roles are the node roles of a cluster, in the order they are provisioned.
+var Roles = []string{"etcd", "apiserver", "worker"}
+
+// Cluster is a cluster file, clusters/<name>.yaml.
+type Cluster struct {
+	Version  int      `yaml:"version"`
+	Settings Settings `yaml:"settings"`
+	// Roles holds the labels and taints of every node of a role.
+	Roles     map[string]RoleSettings `yaml:"roles"`
+	Etcd      []Node                  `yaml:"etcd"`
+	Apiserver []Node                  `yaml:"apiserver"`
+	Worker    []Node                  `yaml:"worker"`
+}
+
+// Settings apply to every node of the cluster.
+type Settings struct {
+	// Vars are template vars. They override the vars file of the cluster.
+	Vars Values `yaml:"vars"`
+	// Labels are kubernetes labels set on every node.
+	Labels map[string]string `yaml:"labels"`
+	// ConfigFormat is the format of the config.ign.yaml templates: clc
+	// (default) for Ignition 2.x or butane for Ignition 3.x.
+	ConfigFormat transpile.Format `yaml:"configFormat"`
+}
+
+type RoleSettings struct {
+	Labels map[string]string `yaml:"labels"`
+	Taints []Taint           `yaml:"taints"`
+	// Vars are template vars for the nodes of the role.
+	Vars Values `yaml:"vars"`
+}
+
+type Node struct {
+	Hostname string `yaml:"hostname"`
+	Location string `yaml:"location"`
+	// IP is used instead of resolving the hostname.
+	IP string `yaml:"ip"`
+	// FailureDomain is the zone of the node, used for the
+	// topology.kubernetes.io/zone label and the failure_domain template var.
+	FailureDomain string            `yaml:"failureDomain"`
+	Labels        map[string]string `yaml:"labels"`
+	Taints        []Taint           `yaml:"taints"`
+	// Vars are template vars for this node only.
+	Vars Values `yaml:"vars"`
+	// Maintenance leaves the node out of provision and analyze. Its config is
+	// still generated and it is still part of the cluster vars.
+	Maintenance bool `yaml:"maintenance"`
+}
+
+type Taint struct {
+	Key    string `yaml:"key"`
+	Value  string `yaml:"value"`
+	Effect string `yaml:"effect"`
+}
+
+// ParseCluster reads and validates a cluster file. Unknown keys are an error.
+func ParseCluster(file string) (*Cluster, error) {
+	f, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading cluster file %s: %w", ErrInvalidConfig, file, err)
+	}
+
+	c := &Cluster{}
+	decoder := yaml.NewDecoder(bytes.NewReader(f))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: unmarshalling cluster file %s: %w", ErrInvalidConfig, file, err)
+	}
+	if c.Version == 0 {
+		c.Version = ClusterVersion
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("cluster file %s: %w", file, err)
+	}
+	return c, nil
+}
+
+// Validate checks the cluster for errors that would otherwise surface half
+// way through a provision.
+func (c *Cluster) Validate() error {
+	var errs []error
+	if c.Version != ClusterVersion {
+		errs = append(errs, fmt.Errorf("unsupported version %d, must be %d", c.Version, ClusterVersion))
+	}
+
+	if _, err := transpile.ParseFormat(string(c.Settings.ConfigFormat)); err != nil {
+		errs = append(errs, fmt.Errorf("settings: %w", err))
+	}
+
+	for role, settings := range c.Roles {
+		if !slices.Contains(Roles, role) {
+			errs = append(errs, fmt.Errorf("roles: unknown role %q, must be one of %s", role, strings.Join(Roles, ", ")))
+		}
+		for _, taint := range settings.Taints {
+			if err := validateTaint(taint); err != nil {
+				errs = append(errs, fmt.Errorf("roles: %s: %w", role, err))
+			}
+		}
+	}
+
+	roles := make(map[string]string)
+	for _, role := range Roles {
+		nodes := c.Nodes(role)
+		if len(nodes) == 0 && role != "worker" {
+			errs = append(errs, fmt.Errorf("no %s nodes", role))
+		}
+		for _, node := range nodes {
+			if node.Hostname == "" {
+				errs = append(errs, fmt.Errorf("%s node without hostname", role))
+				continue
+			}
+			if other, ok := roles[node.Hostname]; ok {
+				if other == role {
+					errs = append(errs, fmt.Errorf("%s listed twice under %s", node.Hostname, role))
+				} else {
+					errs = append(errs, fmt.Errorf("%s listed under both %s and %s", node.Hostname, other, role))
+				}
+				continue
+			}
+			roles[node.Hostname] = role
+
+			if node.IP != "" && net.ParseIP(node.IP) == nil {
+				errs = append(errs, fmt.Errorf("%s: invalid ip %q", node.Hostname, node.IP))
+			}
+			for _, taint := range node.Taints {
+				if err := validateTaint(taint); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", node.Hostname, err))
+				}
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, errors.Join(errs...))
+	}
+	return nil
+}
+
+func validateTaint(t Taint) error {
+	if t.Key == "" {
+		return errors.New("taint without key")
+	}
+	switch t.Effect {
+	case "NoSchedule", "PreferNoSchedule", "NoExecute":
+		return nil
+	}
+	return fmt.Errorf("taint %s: invalid effect %q, must be NoSchedule, PreferNoSchedule or NoExecute", t.Key, t.Effect)
+}
+
+// Nodes returns the nodes of a role.
+func (c *Cluster) Nodes(role string) []Node {
+	switch role {
+	case "etcd":
+		return c.Etcd
+	case "apiserver":
+		return c.Apiserver
+	case "worker":
+		return c.Worker
+	}
+	return nil
+}
+
+// ByRole returns the nodes by role.
+func (c *Cluster) ByRole() map[string][]Node {
+	ret := make(map[string][]Node)
+	for _, role := range Roles {
+		if nodes := c.Nodes(role); len(nodes) > 0 {
+			ret[role] = nodes
+		}
+	}
+	return ret
+}
+
+// Hosts returns the hostnames by role.
+func (c *Cluster) Hosts() map[string][]string {
+	ret := make(map[string][]string)
+	for _, role := range Roles {
+		for _, node := range c.Nodes(role) {
+			ret[role] = append(ret[role], node.Hostname)
+		}
+	}
+	return ret
+}
+
+// Node returns the node with the hostname and its role.
+func (c *Cluster) Node(hostname string) (Node, string, bool) {
+	for _, role := range Roles {
+		for _, node := range c.Nodes(role) {
+			if node.Hostname == hostname {
+				return node, role, true
+			}
+		}
+	}
+	return Node{}, "", false
+}
+
+// StaticIPs returns the ips set in the cluster file by hostname.
+func (c *Cluster) StaticIPs() map[string]string {
+	ret := make(map[string]string)
+	for _, role := range Roles {
+		for _, node := range c.Nodes(role) {
+			if node.IP != "" {
+				ret[node.Hostname] = node.IP
+			}
+		}
+	}
+	return ret
+}
+
+// Active returns the hosts that are not in maintenance.
+func (c *Cluster) Active(hosts map[string][]string) map[string][]string {
+	ret := make(map[string][]string)
+	for role, hostnames := range hosts {
+		for _, hostname := range hostnames {
+			if node, _, ok := c.Node(hostname); ok && node.Maintenance {
+				continue
+			}
+			ret[role] = append(ret[role], hostname)
+		}
+	}
+	return ret
+}
+
+// ConfigFormat returns the format of the config templates of the cluster.
+func (c *Cluster) ConfigFormat() transpile.Format {
+	format, _ := transpile.ParseFormat(string(c.Settings.ConfigFormat))
+	return format
+}
+
+// NodeLabels are the kubernetes labels of the node: the cluster labels, the
+// labels of its role, its role, location and the zone of its failure domain,
+// and its own labels. Later labels override earlier ones.
+func (c *Cluster) NodeLabels(hostname string) map[string]string {
+	node, role, _ := c.Node(hostname)
+	labels := Merge(c.Settings.Labels, c.Roles[role].Labels)
+	labels["kubernetes.io/role"] = role
+	if node.Location != "" {
+		labels["nais.io/location"] = node.Location
+	}
+	if node.FailureDomain != "" {
+		labels["topology.kubernetes.io/zone"] = node.FailureDomain
+	}
+	return Merge(labels, node.Labels)
+}
+
+// NodeTaints are the taints of the role of the node and its own taints. A
+// node taint replaces a role taint with the same key and effect.
+func (c *Cluster) NodeTaints(hostname string) []Taint {
+	node, role, _ := c.Node(hostname)
+	var taints []Taint
+	for _, t := range c.Roles[role].Taints {
+		if !slices.ContainsFunc(node.Taints, func(n Taint) bool { return n.Key == t.Key && n.Effect == t.Effect }) {
+			taints = append(taints, t)
+		}
+	}
+	return append(taints, node.Taints...)
+}
+
+// ShortName is the hostname without its domain.
+func (n Node) ShortName() string {
+	return strings.Split(n.Hostname, ".")[0]
+}
@@ -0,0 +1,133 @@
+package vars
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeCluster(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "cluster.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(content), 0o644))
+	return file
+}
+
+func TestParseClusterExample(t *testing.T) {
+	c, err := ParseCluster("../../examples/clusters/clustername.yaml")
+	require.NoError(t, err)
+
+	assert.Equal(t, ClusterVersion, c.Version)
+	assert.Equal(t, map[string][]string{
+		"etcd":      {"etcd1.domain.local", "etcd2.domain.local", "etcd3.domain.local"},
+		"apiserver": {"apiserver.domain.local"},
+		"worker":    {"worker1.domain.local", "worker2.domain.local", "worker3.domain.local"},
+	}, c.Hosts())
+}
+
+func TestParseCluster(t *testing.T) {
+	file := writeCluster(t, `
+version: 1
+settings:
+  labels:
+    nais.io/cluster: dev
+roles:
+  worker:
+    labels:
+      nais.io/pool: general
+    taints:
+      - key: nais.io/gpu
+        value: "false"
+        effect: NoSchedule
+      - key: nais.io/dedicated
+        value: batch
+        effect: NoExecute
+etcd:
+  - hostname: etcd1.domain.local
+apiserver:
+  - hostname: apiserver.domain.local
+    ip: 10.0.0.10
+worker:
+  - hostname: worker1.domain.local
+    location: onprem
+    failureDomain: zone-a
+    labels:
+      nais.io/gpu: "true"
+    taints:
+      - key: nais.io/gpu
+        value: "true"
+        effect: NoSchedule
+    maintenance: true
+`)
+	c, err := ParseCluster(file)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{"apiserver.domain.local": "10.0.0.10"}, c.StaticIPs())
+
+	assert.Equal(t, map[string]string{
+		"kubernetes.io/role":          "worker",
+		"nais.io/cluster":             "dev",
+		"nais.io/gpu":                 "true",
+		"nais.io/location":            "onprem",
+		"nais.io/pool":                "general",
+		"topology.kubernetes.io/zone": "zone-a",
+	}, c.NodeLabels("worker1.domain.local"))
+	assert.Equal(t, []Taint{
+		{Key: "nais.io/dedicated", Value: "batch", Effect: "NoExecute"},
+		{Key: "nais.io/gpu", Value: "true", Effect: "NoSchedule"},
+	}, c.NodeTaints("worker1.domain.local"))
+
+	assert.Equal(t, map[string][]string{"etcd": {"etcd1.domain.local"}}, c.Active(map[string][]string{
+		"etcd":   {"etcd1.domain.local"},
+		"worker": {"worker1.domain.local"},
+	}))
+}
+
+func TestParseClusterRejectsUnknownKeys(t *testing.T) {
+	file := writeCluster(t, `
+etcd:
+  - hostname: etcd1.domain.local
+    locaton: azure
+apiserver:
+  - hostname: apiserver.domain.local
+`)
+	_, err := ParseCluster(file)
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+	assert.ErrorContains(t, err, "locaton")
+}
+
+func TestValidate(t *testing.T) {
+	c := &Cluster{
+		Version: 2,
+		Roles: map[string]RoleSettings{
+			"workers": {},
+			"worker":  {Taints: []Taint{{Key: "b"}}},
+		},
+		Etcd: []Node{
+			{Hostname: "etcd1"},
+			{Hostname: "etcd1"},
+		},
+		Worker: []Node{
+			{Hostname: "etcd1"},
+			{Hostname: "worker1", IP: "not-an-ip", Taints: []Taint{{Key: "a", Effect: "Sometimes"}}},
+		},
+	}
+
+	err := c.Validate()
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+	for _, msg := range []string{
+		"unsupported version 2",
+		"no apiserver nodes",
+		"etcd1 listed twice under etcd",
+		"etcd1 listed under both etcd and worker",
+		`worker1: invalid ip "not-an-ip"`,
+		`taint a: invalid effect "Sometimes"`,
+		`roles: unknown role "workers"`,
+		`roles: worker: taint b: invalid effect ""`,
+	} {
+		assert.ErrorContains(t, err, msg)
+	}
+}
@@ -0,0 +1,109 @@
+package vars
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// DefaultsFile holds the vars of every cluster.
+	DefaultsFile = "vars/defaults.yaml"
+	// RuntimeSource is the source of the vars nitro sets itself.
+	RuntimeSource = "nitro"
+)
+
+// LocationFile returns the vars file of the nodes with the location.
+func LocationFile(location string) string {
+	return "vars/locations/" + location + ".yaml"
+}
+
+// Layer is a set of template vars and where they were set.
+type Layer struct {
+	Source string
+	Vars   map[string]any
+	// Computed vars are set by nitro, not in a file.
+	Computed bool
+}
+
+// Layers are the layers of template vars of a cluster. From lowest to
+// highest precedence: the global defaults, the vars file of the cluster, the
+// cluster settings, the vars file of the location of a node, the vars of its
+// role and its own vars in the cluster file. The vars nitro sets override
+// them all.
+type Layers struct {
+	cluster     *Cluster
+	clusterFile string
+	base        []Layer
+	locations   map[string]Layer
+	runtime     Layer
+}
+
+// Set sets a var nitro computed for every node.
+func (l *Layers) Set(name string, value any) {
+	l.runtime.Vars[name] = value
+}
+
+// Cluster returns the layers of the templates that are not rendered for a
+// node.
+func (l *Layers) Cluster() []Layer {
+	return append(slices.Clone(l.base), l.runtime)
+}
+
+// Node returns the layers of a node of the role.
+func (l *Layers) Node(role string, node Node) []Layer {
+	layers := slices.Clone(l.base)
+	if location, ok := l.locations[node.Location]; ok {
+		layers = append(layers, location)
+	}
+	layers = append(layers,
+		Layer{Source: l.clusterFile + ": roles." + role, Vars: l.cluster.Roles[role].Vars},
+		Layer{Source: l.clusterFile + ": " + node.Hostname, Vars: node.Vars},
+		l.runtime,
+	)
+	return layers
+}
+
+// Flatten merges the layers, a var in a later layer replacing the same var in
+// an earlier one, and returns the vars and the source of each.
+func Flatten(layers []Layer) (map[string]any, map[string]string) {
+	vars := make(map[string]any)
+	sources := make(map[string]string)
+	for _, layer := range layers {
+		for name, value := range layer.Vars {
+			vars[name] = value
+			sources[name] = layer.Source
+		}
+	}
+	return vars, sources
+}
+
+// Annotate returns the vars as yaml, sorted by name, with the source of each
+// as a comment.
+func Annotate(vars map[string]any, sources map[string]string) ([]byte, error) {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	for _, name := range slices.Sorted(maps.Keys(vars)) {
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: name}
+		value := &yaml.Node{}
+		if err := value.Encode(vars[name]); err != nil {
+			return nil, fmt.Errorf("encoding var %s: %w", name, err)
+		}
+		if value.Kind == yaml.ScalarNode {
+			value.LineComment = sources[name]
+		} else {
+			key.HeadComment = sources[name]
+		}
+		doc.Content = append(doc.Content, key, value)
+	}
+
+	var b bytes.Buffer
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
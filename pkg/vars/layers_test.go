@@ -0,0 +1,89 @@
+package vars
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVarsLayers(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"vars/defaults.yaml":        "ntp: ntp.domain.com\nproxy: http://proxy\nk8s_version: 1.19\n",
+		"vars/dev.yaml":             "k8s_version: 1.20\ncluster_name: ignored\n",
+		"vars/admins.yaml":          "alice: ssh-ed25519 alice\n",
+		"vars/locations/azure.yaml": "proxy: http://azure-proxy\nmtu: 1400\n",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+	t.Chdir(dir)
+
+	worker1 := Node{Hostname: "worker1.domain.local", Location: "azure", Vars: Values{"mtu": "9000"}}
+	worker2 := Node{Hostname: "worker2.domain.local", Location: "onprem"}
+	cluster := &Cluster{
+		Settings:  Settings{Vars: Values{"ntp": "ntp.dev"}},
+		Roles:     map[string]RoleSettings{"worker": {Vars: Values{"mtu": "1500", "pool": "general"}}},
+		Etcd:      []Node{{Hostname: "etcd1.domain.local"}},
+		Apiserver: []Node{{Hostname: "apiserver.domain.local"}},
+		Worker:    []Node{worker1, worker2},
+	}
+	resolver := &StaticResolver{IPs: map[string]string{
+		"etcd1.domain.local":     "10.0.0.1",
+		"apiserver.domain.local": "10.0.0.10",
+		"worker1.domain.local":   "10.0.0.21",
+		"worker2.domain.local":   "10.0.0.22",
+	}}
+
+	layers, err := ParseVars("dev", "id_rsa", cluster, resolver)
+	require.NoError(t, err)
+	layers.Set("etcd_initial_cluster_state", "new")
+
+	vars, sources := Flatten(layers.Node("worker", worker1))
+	for name, want := range map[string][2]string{
+		"ntp":                        {"ntp.dev", "clusters/dev.yaml: settings"},
+		"k8s_version":                {"1.20", "vars/dev.yaml"},
+		"proxy":                      {"http://azure-proxy", "vars/locations/azure.yaml"},
+		"pool":                       {"general", "clusters/dev.yaml: roles.worker"},
+		"mtu":                        {"9000", "clusters/dev.yaml: worker1.domain.local"},
+		"cluster_name":               {"dev", RuntimeSource},
+		"etcd_initial_cluster_state": {"new", RuntimeSource},
+	} {
+		assert.Equal(t, want[0], vars[name], name)
+		assert.Equal(t, want[1], sources[name], name)
+	}
+
+	vars, sources = Flatten(layers.Node("worker", worker2))
+	assert.Equal(t, "http://proxy", vars["proxy"])
+	assert.Equal(t, DefaultsFile, sources["proxy"])
+	assert.Equal(t, "1500", vars["mtu"])
+
+	vars, _ = Flatten(layers.Node("etcd", cluster.Etcd[0]))
+	assert.NotContains(t, vars, "pool")
+
+	vars, _ = Flatten(layers.Cluster())
+	assert.NotContains(t, vars, "mtu")
+}
+
+func TestAnnotate(t *testing.T) {
+	out, err := Annotate(map[string]any{
+		"proxy":   "http://proxy",
+		"ntp":     []any{"ntp1", "ntp2"},
+		"enabled": true,
+	}, map[string]string{
+		"proxy":   "vars/dev.yaml",
+		"ntp":     DefaultsFile,
+		"enabled": "clusters/dev.yaml: settings",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, `enabled: true # clusters/dev.yaml: settings
+# vars/defaults.yaml
+ntp:
+  - ntp1
+  - ntp2
+proxy: http://proxy # vars/dev.yaml
+`, string(out))
+}
@@ -0,0 +1,204 @@
+package vars
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+// Resolver resolves the hostname of a node to the ip used to reach it.
+type Resolver interface {
+	Resolve(hostname string) (string, error)
+}
+
+// Family is the address family a resolver prefers. If a host has no address
+// of the preferred family, an address of the other family is used.
+type Family string
+
+const (
+	IPv4 Family = "ipv4"
+	IPv6 Family = "ipv6"
+)
+
+func ParseFamily(s string) (Family, error) {
+	switch f := Family(s); f {
+	case IPv4, IPv6:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown address family %q, must be %s or %s", s, IPv4, IPv6)
+}
+
+const lookupTimeout = 10 * time.Second
+
+// ResolverConfig selects how hostnames without a static ip are resolved: with
+// the system resolver, a DNS server or dig on a jump host.
+type ResolverConfig struct {
+	Family Family
+	// DNSServer is a DNS server to query instead of the system resolver, as
+	// host:port.
+	DNSServer string
+	// JumpHost is an ssh host to run dig on, for names only its DNS knows.
+	JumpHost string
+}
+
+// NewResolver returns the resolver for a run: static ips from the cluster
+// file first, then the configured lookup. Lookups are cached for the life of
+// the resolver.
+func NewResolver(config ResolverConfig, cluster *Cluster) Resolver {
+	if config.Family == "" {
+		config.Family = IPv4
+	}
+	if config.JumpHost == "" && os.Getenv("JUMPHOST_DNS") != "" {
+		log.Warn("JUMPHOST_DNS is deprecated, use --jumphost-dns aura")
+		config.JumpHost = "aura"
+	}
+
+	var lookup Resolver = &SystemResolver{Family: config.Family}
+	switch {
+	case config.JumpHost != "":
+		lookup = &JumpHostResolver{Host: config.JumpHost, Family: config.Family}
+	case config.DNSServer != "":
+		lookup = NewDNSResolver(config.DNSServer, config.Family)
+	}
+
+	return &CachingResolver{Next: &StaticResolver{IPs: cluster.StaticIPs(), Next: lookup}}
+}
+
+// SystemResolver looks up hosts with the system resolver.
+type SystemResolver struct {
+	Family   Family
+	resolver *net.Resolver
+}
+
+func (r *SystemResolver) Resolve(hostname string) (string, error) {
+	resolver := r.resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	ips, err := resolver.LookupIP(ctx, "ip", hostname)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %w", ErrUnresolvedHost, hostname, err)
+	}
+	return pick(hostname, ips, r.Family)
+}
+
+// NewDNSResolver returns a resolver that queries the DNS server at address,
+// host:port, instead of the servers configured on the system.
+func NewDNSResolver(address string, family Family) *SystemResolver {
+	return &SystemResolver{
+		Family: family,
+		resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, address)
+			},
+		},
+	}
+}
+
+// JumpHostResolver runs dig on a jump host over ssh, using the ssh config of
+// the user running nitro.
+type JumpHostResolver struct {
+	Host   string
+	Family Family
+}
+
+func (r *JumpHostResolver) Resolve(hostname string) (string, error) {
+	var ips []net.IP
+	for _, record := range []string{"A", "AAAA"} {
+		out, err := exec.Command("ssh", r.Host, "dig +short "+record+" "+hostname).Output()
+		if err != nil {
+			return "", fmt.Errorf("%w: %s: dig on %s: %w", ErrUnresolvedHost, hostname, r.Host, err)
+		}
+		ips = append(ips, parseDig(string(out))...)
+	}
+	return pick(hostname, ips, r.Family)
+}
+
+// parseDig returns the ips in dig +short output, which also lists the CNAMEs
+// that were followed.
+func parseDig(out string) []net.IP {
+	var ips []net.IP
+	for _, line := range strings.Split(out, "\n") {
+		if ip := net.ParseIP(strings.TrimSpace(line)); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// pick returns the first ip of the preferred family, or the first ip if there
+// is none.
+func pick(hostname string, ips []net.IP, family Family) (string, error) {
+	if len(ips) == 0 {
+		return "", fmt.Errorf("%w: %s: no addresses", ErrUnresolvedHost, hostname)
+	}
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (family != IPv6) {
+			return ip.String(), nil
+		}
+	}
+	log.Debugf("%s has no %s address, using %s", hostname, family, ips[0])
+	return ips[0].String(), nil
+}
+
+// StaticResolver returns the ips set in the cluster file, and passes other
+// hosts on to Next.
+type StaticResolver struct {
+	IPs  map[string]string
+	Next Resolver
+}
+
+func (r *StaticResolver) Resolve(hostname string) (string, error) {
+	if ip, ok := r.IPs[hostname]; ok {
+		return ip, nil
+	}
+	return r.Next.Resolve(hostname)
+}
+
+// CachingResolver remembers the ips of the hosts it has resolved, so a host
+// is looked up once per run. Concurrent lookups of the same host share one
+// lookup; failed lookups are not remembered, so they are tried again.
+type CachingResolver struct {
+	Next Resolver
+
+	group singleflight.Group
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+func (r *CachingResolver) Resolve(hostname string) (string, error) {
+	r.mu.Lock()
+	ip, ok := r.cache[hostname]
+	r.mu.Unlock()
+	if ok {
+		return ip, nil
+	}
+
+	v, err, _ := r.group.Do(hostname, func() (any, error) {
+		ip, err := r.Next.Resolve(hostname)
+		if err != nil {
+			return "", err
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.cache == nil {
+			r.cache = make(map[string]string)
+		}
+		r.cache[hostname] = ip
+		return ip, nil
+	})
+	return v.(string), err
+}
@@ -0,0 +1,115 @@
+package vars
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPick(t *testing.T) {
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("10.0.0.1")}
+
+	ip, err := pick("host", ips, IPv4)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", ip)
+
+	ip, err = pick("host", ips, IPv6)
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", ip)
+
+	// falls back to the other family
+	ip, err = pick("host", ips[:1], IPv4)
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", ip)
+
+	_, err = pick("host", nil, IPv4)
+	assert.ErrorIs(t, err, ErrUnresolvedHost)
+}
+
+func TestParseDig(t *testing.T) {
+	out := "alias.domain.local.\nhost.domain.local.\n10.0.0.1\n10.0.0.2\n"
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}, parseDig(out))
+	assert.Empty(t, parseDig(""))
+}
+
+type countingResolver struct {
+	calls map[string]int
+}
+
+func (r *countingResolver) Resolve(hostname string) (string, error) {
+	r.calls[hostname]++
+	if hostname == "unknown" {
+		return "", ErrUnresolvedHost
+	}
+	return "10.0.0.1", nil
+}
+
+func TestStaticAndCachingResolver(t *testing.T) {
+	lookup := &countingResolver{calls: make(map[string]int)}
+	r := &CachingResolver{Next: &StaticResolver{IPs: map[string]string{"static": "10.0.0.9"}, Next: lookup}}
+
+	for range 2 {
+		ip, err := r.Resolve("static")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.9", ip)
+
+		ip, err = r.Resolve("host")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.1", ip)
+
+		_, err = r.Resolve("unknown")
+		assert.True(t, errors.Is(err, ErrUnresolvedHost))
+	}
+	// failed lookups are tried again
+	assert.Equal(t, map[string]int{"host": 1, "unknown": 2}, lookup.calls)
+}
+
+type blockingResolver struct {
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (r *blockingResolver) Resolve(hostname string) (string, error) {
+	r.calls.Add(1)
+	if hostname == "slow" {
+		<-r.release
+	}
+	return "10.0.0.1", nil
+}
+
+func TestCachingResolverDoesNotBlockOtherHosts(t *testing.T) {
+	lookup := &blockingResolver{release: make(chan struct{})}
+	r := &CachingResolver{Next: lookup}
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Go(func() {
+			ip, err := r.Resolve("slow")
+			assert.NoError(t, err)
+			assert.Equal(t, "10.0.0.1", ip)
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = r.Resolve("fast")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookup of another host waited for the slow one")
+	}
+
+	close(lookup.release)
+	wg.Wait()
+	calls := lookup.calls.Load()
+	_, _ = r.Resolve("slow")
+	assert.Equal(t, calls, lookup.calls.Load(), "resolved hosts are cached")
+}
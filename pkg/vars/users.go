@@ -0,0 +1,77 @@
+package vars
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// User is an admin user created on every node. Rendered with toYaml it is
+// an ignition passwd user.
+type User struct {
+	Name              string   `yaml:"name" json:"name"`
+	Groups            []string `yaml:"groups" json:"groups"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys" json:"ssh_authorized_keys"`
+}
+
+// user is an entry of the admins file: a single key, a list of keys, or a map
+// with the keys and groups of the user.
+type user struct {
+	Groups            []string `yaml:"groups"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys"`
+}
+
+func (u *user) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		u.SSHAuthorizedKeys = []string{node.Value}
+		return nil
+	case yaml.SequenceNode:
+		return node.Decode(&u.SSHAuthorizedKeys)
+	}
+	type plain user
+	return node.Decode((*plain)(u))
+}
+
+// ParseAdmins reads the admins file, vars/admins.yaml, by user name. Users
+// without groups are in the sudo group.
+func ParseAdmins(file string) ([]User, error) {
+	f, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading yaml file %s: %w", ErrInvalidConfig, file, err)
+	}
+
+	admins := make(map[string]user)
+	if err := yaml.Unmarshal(f, &admins); err != nil {
+		return nil, fmt.Errorf("%w: unmarshalling yaml file %s: %w", ErrInvalidConfig, file, err)
+	}
+
+	var users []User
+	for name, u := range admins {
+		if len(u.Groups) == 0 {
+			u.Groups = []string{"sudo"}
+		}
+		users = append(users, User{Name: name, Groups: u.Groups, SSHAuthorizedKeys: u.SSHAuthorizedKeys})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users, nil
+}
+
+// BuildUsersString renders the users as the passwd users of an ignition config.
+func BuildUsersString(users []User) string {
+	var b strings.Builder
+
+	for _, u := range users {
+		b.WriteString(fmt.Sprintf("    - name: %s\n", u.Name))
+		b.WriteString(fmt.Sprintf("      groups: [%s]\n", strings.Join(u.Groups, ", ")))
+		b.WriteString("      ssh_authorized_keys:\n")
+		for _, key := range u.SSHAuthorizedKeys {
+			b.WriteString(fmt.Sprintf("      - \"%s\"\n", key))
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,71 @@
+package vars
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Values are template vars read from yaml. Lists and maps are kept as
+// []any and map[string]any for templates to range over. Scalars are kept as
+// the strings they are written as, as templates compare them with strings:
+// true is "true", and a version like 1.20 is not read as the number 1.2.
+type Values map[string]any
+
+func (v *Values) UnmarshalYAML(node *yaml.Node) error {
+	value, err := decodeValue(node)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		*v = Values{}
+		return nil
+	}
+	m, ok := value.(map[string]any)
+	if !ok {
+		return fmt.Errorf("line %d: vars must be a map", node.Line)
+	}
+	*v = m
+	return nil
+}
+
+func decodeValue(node *yaml.Node) (any, error) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return decodeValue(node.Content[0])
+	case yaml.AliasNode:
+		return decodeValue(node.Alias)
+	case yaml.SequenceNode:
+		ret := make([]any, 0, len(node.Content))
+		for _, item := range node.Content {
+			value, err := decodeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, value)
+		}
+		return ret, nil
+	case yaml.MappingNode:
+		ret := make(map[string]any)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("line %d: keys must be strings", key.Line)
+			}
+			decoded, err := decodeValue(value)
+			if err != nil {
+				return nil, err
+			}
+			ret[key.Value] = decoded
+		}
+		return ret, nil
+	}
+
+	if node.ShortTag() == "!!null" {
+		return nil, nil
+	}
+	return node.Value, nil
+}
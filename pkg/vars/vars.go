@@ -1,161 +1,259 @@
 package vars
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"net"
+	"io/fs"
 	"os"
-	"os/exec"
-	"sort"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 )
 
-func ParseVars(cluster, identity string, hosts map[string][]string) map[string]string {
-	vars := ParseStringYAML("vars/" + cluster + ".yaml") // read cluster-specific vars
-	vars["users"] = BuildUsersString(ParseStringYAML("vars/admins.yaml"))
-	vars["identity_file"] = identity
-	vars["cluster_name"] = cluster
-
-	additionalVars := resolveRuntimeVars(hosts)
-
-	return Merge(vars, additionalVars)
-}
+var (
+	// ErrInvalidConfig is returned when a cluster or vars file cannot be read or parsed.
+	ErrInvalidConfig = errors.New("invalid config")
+	// ErrUnresolvedHost is returned when a hostname cannot be resolved to an ip.
+	ErrUnresolvedHost = errors.New("unresolved host")
+)
 
-func resolveRuntimeVars(hosts map[string][]string) map[string]string {
-	noProxyIPs := resolveIPs(hosts["worker"])
+// ParseVars reads the layers of template vars of the cluster: the global
+// defaults, the vars file of the cluster, the cluster settings, the vars files
+// of the locations of its nodes and the vars resolved from the cluster file.
+func ParseVars(name, identity string, cluster *Cluster, resolver Resolver) (*Layers, error) {
+	defaults, err := parseOptionalYAML(DefaultsFile)
+	if err != nil {
+		return nil, err
+	}
+	clusterVars, err := ParseYAML("vars/" + name + ".yaml") // read cluster-specific vars
+	if err != nil {
+		return nil, err
+	}
+	admins, err := ParseAdmins("vars/admins.yaml")
+	if err != nil {
+		return nil, err
+	}
 
-	var etcdIPList []string
-	var etcdUrls []string
-	var etcdInitialCluster []string
-	for _, etcdUrl := range hosts["etcd"] {
-		etcdServerShort := strings.Split(etcdUrl, ".")[0]
-		ip := ResolveIP(etcdUrl)
-		etcdUrls = append(etcdUrls, "https://"+ip+":2379")
+	locations := make(map[string]Layer)
+	for _, role := range Roles {
+		for _, node := range cluster.Nodes(role) {
+			if _, ok := locations[node.Location]; ok || node.Location == "" {
+				continue
+			}
+			file := LocationFile(node.Location)
+			locationVars, err := parseOptionalYAML(file)
+			if err != nil {
+				return nil, err
+			}
+			locations[node.Location] = Layer{Source: file, Vars: locationVars}
+		}
+	}
 
-		etcdIPList = append(etcdIPList, ip)
-		shortString := fmt.Sprintf("%s=https://%s:2380", etcdServerShort, ip)
-		etcdInitialCluster = append(etcdInitialCluster, shortString)
+	runtimeVars, err := resolveRuntimeVars(cluster, resolver)
+	if err != nil {
+		return nil, err
 	}
+	runtimeVars["admins"] = admins
+	runtimeVars["users"] = BuildUsersString(admins)
+	runtimeVars["identity_file"] = identity
+	runtimeVars["cluster_name"] = name
 
-	vars := make(map[string]string)
-	vars["apiserver"] = hosts["apiserver"][0]
-	vars["apiserver_ip"] = ResolveIP(hosts["apiserver"][0])
-	vars["worker_ips"] = strings.Join(noProxyIPs, ",")
-	vars["etcd_hostnames"] = strings.Join(hosts["etcd"], "\",\n\"")
-	vars["etcd_ips"] = strings.Join(etcdIPList, "\",\n\"")
-	vars["etcd_ips_no_proxy"] = strings.Join(etcdIPList, ",")
-	vars["etcd_initial_cluster"] = strings.Join(etcdInitialCluster, ",")
-	vars["etcd_urls"] = strings.Join(etcdUrls, ",")
+	clusterFile := "clusters/" + name + ".yaml"
+	return &Layers{
+		cluster:     cluster,
+		clusterFile: clusterFile,
+		base: []Layer{
+			{Source: DefaultsFile, Vars: defaults},
+			{Source: "vars/" + name + ".yaml", Vars: clusterVars},
+			{Source: clusterFile + ": settings", Vars: cluster.Settings.Vars},
+		},
+		locations: locations,
+		runtime:   Layer{Source: RuntimeSource, Vars: runtimeVars, Computed: true},
+	}, nil
+}
 
-	log.Infof("resolved runtime vars")
-	return vars
+// Host is a node as seen by the templates.
+type Host struct {
+	Hostname  string
+	ShortName string
+	IP        string
 }
 
-func ParseStringYAML(file string) map[string]string {
-	f, err := os.ReadFile(file)
-	if err != nil {
-		log.WithError(err).Fatalf("reading yaml file: %s", file)
-	}
+// EtcdHost is an etcd node with its client and peer urls.
+type EtcdHost struct {
+	Host      `yaml:",inline"`
+	ClientURL string
+	PeerURL   string
+}
 
-	vars := make(map[string]string)
-	err = yaml.Unmarshal(f, &vars)
-	if err != nil {
-		log.WithError(err).Fatalf("unmarshalling yaml file: %s", file)
+func resolveHosts(nodes []Node, resolver Resolver) ([]Host, error) {
+	var hosts []Host
+	for _, node := range nodes {
+		ip, err := resolver.Resolve(node.Hostname)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, Host{Hostname: node.Hostname, ShortName: node.ShortName(), IP: ip})
 	}
-
-	return vars
+	return hosts, nil
 }
 
-func ParseSliceYAML(file string) map[string][]string {
-	f, err := os.ReadFile(file)
-	if err != nil {
-		log.WithError(err).Fatalf("reading yaml file: %s", file)
+// resolveRuntimeVars returns the vars describing the nodes of the cluster.
+// The etcd members and workers are lists to range over; the joined strings
+// are kept for templates written before they were.
+func resolveRuntimeVars(cluster *Cluster, resolver Resolver) (map[string]any, error) {
+	if len(cluster.Apiserver) == 0 {
+		return nil, fmt.Errorf("%w: no apiserver in cluster file", ErrInvalidConfig)
 	}
 
-	vars := make(map[string][]string)
-	varsNode := make(map[string][]Node)
-	err = yaml.Unmarshal(f, &varsNode)
+	workers, err := resolveHosts(cluster.Worker, resolver)
 	if err != nil {
-		log.WithError(err).Fatalf("unmarshalling yaml file: %s", file)
+		return nil, err
+	}
+	etcdHosts, err := resolveHosts(cluster.Etcd, resolver)
+	if err != nil {
+		return nil, err
 	}
 
-	for key, value := range varsNode {
-		for _, node := range value {
-			vars[key] = append(vars[key], node.Hostname)
+	var etcdMembers []EtcdHost
+	var etcdHostnames, etcdIPList, etcdUrls, etcdInitialCluster []string
+	for _, host := range etcdHosts {
+		member := EtcdHost{
+			Host:      host,
+			ClientURL: "https://" + host.IP + ":2379",
+			PeerURL:   "https://" + host.IP + ":2380",
 		}
+		etcdMembers = append(etcdMembers, member)
+		etcdHostnames = append(etcdHostnames, host.Hostname)
+		etcdIPList = append(etcdIPList, host.IP)
+		etcdUrls = append(etcdUrls, member.ClientURL)
+		etcdInitialCluster = append(etcdInitialCluster, host.ShortName+"="+member.PeerURL)
+	}
+	var workerIPs []string
+	for _, host := range workers {
+		workerIPs = append(workerIPs, host.IP)
+	}
+
+	apiserverIP, err := resolver.Resolve(cluster.Apiserver[0].Hostname)
+	if err != nil {
+		return nil, err
 	}
 
-	return vars
+	vars := make(map[string]any)
+	vars["apiserver"] = cluster.Apiserver[0].Hostname
+	vars["apiserver_ip"] = apiserverIP
+	vars["workers"] = workers
+	vars["etcd_members"] = etcdMembers
+	vars["worker_ips"] = strings.Join(workerIPs, ",")
+	vars["etcd_hostnames"] = strings.Join(etcdHostnames, "\",\n\"")
+	vars["etcd_ips"] = strings.Join(etcdIPList, "\",\n\"")
+	vars["etcd_ips_no_proxy"] = strings.Join(etcdIPList, ",")
+	vars["etcd_initial_cluster"] = strings.Join(etcdInitialCluster, ",")
+	vars["etcd_urls"] = strings.Join(etcdUrls, ",")
+
+	log.Infof("resolved runtime vars")
+	return vars, nil
 }
 
-type Node struct {
-	Hostname string `yaml:"hostname"`
-	Location string `yaml:"location"`
+// parseOptionalYAML reads a vars file that may not exist.
+func parseOptionalYAML(file string) (map[string]any, error) {
+	if _, err := os.Stat(file); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return ParseYAML(file)
 }
 
-func ParseClusterYAML(file string) map[string][]Node {
+// ParseYAML reads a vars file. Values may be lists and maps.
+func ParseYAML(file string) (map[string]any, error) {
 	f, err := os.ReadFile(file)
 	if err != nil {
-		log.WithError(err).Fatalf("reading yaml file: %s", file)
+		return nil, fmt.Errorf("%w: reading yaml file %s: %w", ErrInvalidConfig, file, err)
 	}
 
-	vars := make(map[string][]Node)
+	vars := Values{}
 	err = yaml.Unmarshal(f, &vars)
 	if err != nil {
-		log.WithError(err).Fatalf("unmarshalling yaml file: %s", file)
+		return nil, fmt.Errorf("%w: unmarshalling yaml file %s: %w", ErrInvalidConfig, file, err)
 	}
 
-	return vars
+	return vars, nil
 }
 
-func resolveIPs(hostnames []string) []string {
-	var ips []string
-	for _, hostname := range hostnames {
-		ip := ResolveIP(hostname)
-		ips = append(ips, ip)
+// ReplaceHostname swaps a node's hostname under the given role in a cluster
+// file, keeping the rest of the file and its comments as is. It returns false
+// if no node with that hostname is listed under the role.
+func ReplaceHostname(file, role, from, to string) (bool, error) {
+	f, err := os.ReadFile(file)
+	if err != nil {
+		return false, fmt.Errorf("%w: reading yaml file %s: %w", ErrInvalidConfig, file, err)
 	}
-	return ips
-}
 
-func ResolveIP(hostname string) string {
-	// Resolves DNS through aura jumphost
-	if os.Getenv("JUMPHOST_DNS") != "" {
-		out, err := exec.Command("/usr/bin/ssh", "aura", "dig +short "+hostname).Output()
-		if err != nil {
-			log.WithError(err).Fatalf("resolving ip for %s", hostname)
-		}
-		return strings.TrimSuffix(string(out), "\n")
+	var doc yaml.Node
+	if err := yaml.Unmarshal(f, &doc); err != nil {
+		return false, fmt.Errorf("%w: unmarshalling yaml file %s: %w", ErrInvalidConfig, file, err)
 	}
-
-	ip, err := net.LookupIP(hostname)
-	if err != nil {
-		log.WithError(err).Fatalf("resolving ip for %s", hostname)
+	if len(doc.Content) == 0 {
+		return false, nil
 	}
-	return ip[0].String()
-}
 
-func BuildUsersString(users map[string]string) string {
-	var keys []string
-	for key := range users {
-		keys = append(keys, key)
+	replaced := false
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != role {
+			continue
+		}
+		for _, node := range root.Content[i+1].Content {
+			matched := false
+			for j := 0; j+1 < len(node.Content); j += 2 {
+				if node.Content[j].Value == "hostname" && node.Content[j+1].Value == from {
+					node.Content[j+1].Value = to
+					matched = true
+				}
+			}
+			if matched {
+				// a static ip belongs to the old host
+				node.Content = removeKey(node.Content, "ip")
+				replaced = true
+			}
+		}
+	}
+	if !replaced {
+		return false, nil
 	}
-	sort.Strings(keys)
-	var b strings.Builder
 
-	for _, key := range keys {
-		b.WriteString(fmt.Sprintf("    - name: %s\n", key))
-		b.WriteString("      groups: [sudo]\n")
-		b.WriteString("      ssh_authorized_keys:\n")
-		b.WriteString(fmt.Sprintf("      - \"%s\"\n", users[key]))
+	var b bytes.Buffer
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return false, fmt.Errorf("marshalling yaml file %s: %w", file, err)
+	}
+	// renamed into place, so the file is never left half written
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, b.Bytes(), 0o644); err != nil {
+		return false, fmt.Errorf("writing yaml file %s: %w", file, err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return false, fmt.Errorf("writing yaml file %s: %w", file, err)
 	}
+	return true, nil
+}
 
-	return b.String()
+// removeKey removes a key and its value from the content of a yaml mapping.
+func removeKey(content []*yaml.Node, key string) []*yaml.Node {
+	for j := 0; j+1 < len(content); j += 2 {
+		if content[j].Value == key {
+			return append(content[:j], content[j+2:]...)
+		}
+	}
+	return content
 }
 
-func Merge(base, override map[string]string) map[string]string {
-	ret := make(map[string]string)
+// Merge returns base with the keys of override replaced. Nested maps are
+// replaced, not merged.
+func Merge[V any](base, override map[string]V) map[string]V {
+	ret := make(map[string]V)
 
 	for k, v := range base {
 		ret[k] = v
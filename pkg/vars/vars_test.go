@@ -0,0 +1,128 @@
+package vars
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "vars.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(content), 0o644))
+	return file
+}
+
+func TestParseYAML(t *testing.T) {
+	file := writeFile(t, `
+k8s_version: 1.20
+node_exporter_version: 1.2.3
+port: 8080
+enabled: true
+empty:
+ntp_servers: &ntp
+  - ntp1.domain.com
+  - ntp2.domain.com
+proxy:
+  url: http://proxy.com
+  no_proxy: [localhost, .local]
+fallback_ntp_servers: *ntp
+`)
+	vars, err := ParseYAML(file)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"k8s_version":           "1.20",
+		"node_exporter_version": "1.2.3",
+		"port":                  "8080",
+		"enabled":               "true",
+		"empty":                 nil,
+		"ntp_servers":           []any{"ntp1.domain.com", "ntp2.domain.com"},
+		"proxy": map[string]any{
+			"url":      "http://proxy.com",
+			"no_proxy": []any{"localhost", ".local"},
+		},
+		"fallback_ntp_servers": []any{"ntp1.domain.com", "ntp2.domain.com"},
+	}, vars)
+
+	_, err = ParseYAML(writeFile(t, "- a\n- b\n"))
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+}
+
+func TestParseYAMLKeepsBooleansAsWritten(t *testing.T) {
+	const content = "enabled: true\ndisabled: false\nquoted: \"false\"\n"
+	tpl := template.Must(template.New("config").Option("missingkey=error").Parse(
+		`{{ if eq .enabled "true" }}on{{ end }} {{ .disabled }} {{ if .quoted }}quoted{{ end }} {{ if .disabled }}disabled{{ end }}`))
+	render := func(vars any) string {
+		var b strings.Builder
+		require.NoError(t, tpl.Execute(&b, vars))
+		return b.String()
+	}
+
+	// vars used to be read as strings
+	var before map[string]string
+	require.NoError(t, yaml.Unmarshal([]byte(content), &before))
+	after, err := ParseYAML(writeFile(t, content))
+	require.NoError(t, err)
+	assert.Equal(t, "on false quoted disabled", render(before))
+	assert.Equal(t, render(before), render(after))
+}
+
+func TestParseAdmins(t *testing.T) {
+	file := writeFile(t, `
+bob:
+  - ssh-ed25519 bob1
+  - ssh-ed25519 bob2
+alice: ssh-ed25519 alice
+carol:
+  groups: [sudo, docker]
+  ssh_authorized_keys: [ssh-ed25519 carol]
+`)
+	users, err := ParseAdmins(file)
+	require.NoError(t, err)
+	assert.Equal(t, []User{
+		{Name: "alice", Groups: []string{"sudo"}, SSHAuthorizedKeys: []string{"ssh-ed25519 alice"}},
+		{Name: "bob", Groups: []string{"sudo"}, SSHAuthorizedKeys: []string{"ssh-ed25519 bob1", "ssh-ed25519 bob2"}},
+		{Name: "carol", Groups: []string{"sudo", "docker"}, SSHAuthorizedKeys: []string{"ssh-ed25519 carol"}},
+	}, users)
+
+	assert.Equal(t, `    - name: alice
+      groups: [sudo]
+      ssh_authorized_keys:
+      - "ssh-ed25519 alice"
+    - name: carol
+      groups: [sudo, docker]
+      ssh_authorized_keys:
+      - "ssh-ed25519 carol"
+`, BuildUsersString([]User{users[0], users[2]}))
+}
+
+func TestResolveRuntimeVars(t *testing.T) {
+	cluster := &Cluster{
+		Etcd:      []Node{{Hostname: "etcd1.domain.local"}, {Hostname: "etcd2.domain.local"}},
+		Apiserver: []Node{{Hostname: "apiserver.domain.local"}},
+		Worker:    []Node{{Hostname: "worker1.domain.local"}},
+	}
+	resolver := &StaticResolver{IPs: map[string]string{
+		"etcd1.domain.local":     "10.0.0.1",
+		"etcd2.domain.local":     "10.0.0.2",
+		"apiserver.domain.local": "10.0.0.10",
+		"worker1.domain.local":   "10.0.0.21",
+	}}
+
+	vars, err := resolveRuntimeVars(cluster, resolver)
+	require.NoError(t, err)
+	assert.Equal(t, []Host{{Hostname: "worker1.domain.local", ShortName: "worker1", IP: "10.0.0.21"}}, vars["workers"])
+	assert.Equal(t, []EtcdHost{
+		{Host: Host{Hostname: "etcd1.domain.local", ShortName: "etcd1", IP: "10.0.0.1"}, ClientURL: "https://10.0.0.1:2379", PeerURL: "https://10.0.0.1:2380"},
+		{Host: Host{Hostname: "etcd2.domain.local", ShortName: "etcd2", IP: "10.0.0.2"}, ClientURL: "https://10.0.0.2:2379", PeerURL: "https://10.0.0.2:2380"},
+	}, vars["etcd_members"])
+	assert.Equal(t, "etcd1=https://10.0.0.1:2380,etcd2=https://10.0.0.2:2380", vars["etcd_initial_cluster"])
+	assert.Equal(t, "etcd1.domain.local\",\n\"etcd2.domain.local", vars["etcd_hostnames"])
+	assert.Equal(t, "10.0.0.21", vars["worker_ips"])
+}